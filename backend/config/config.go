@@ -2,8 +2,10 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strconv"
+	"time"
 )
 
 // Config holds all application configuration loaded from environment variables.
@@ -17,6 +19,36 @@ type Config struct {
 	SMTPFrom  string
 	AppURL    string
 	Port      string
+
+	MailTransport string
+	MailSpoolDir  string
+
+	// RejectSharedKeys refuses a peer public key that another user has
+	// already registered in a different network.
+	RejectSharedKeys bool
+
+	// KeyMasterFile points at the master key file used to encrypt
+	// server-managed private keys. Server key mode is disabled when empty.
+	KeyMasterFile string
+
+	// Mesh DNS serves <hostname>.<network>.<zone> on MeshDNSListen; it is
+	// disabled when the listen address is empty. MeshDNSAddress is the
+	// resolver IP written into rendered configs.
+	MeshDNSListen  string
+	MeshDNSAddress string
+	MeshDNSZone    string
+
+	// SSEHeartbeat is the interval between keep-alive comments on idle
+	// event streams.
+	SSEHeartbeat time.Duration
+
+	// SSEBackend is "memory" for a single replica or "postgres" to fan
+	// events out to every replica through LISTEN/NOTIFY.
+	SSEBackend string
+
+	// MetricsToken, when set, is the bearer token /metrics requires. The
+	// endpoint is open when it is empty.
+	MetricsToken string
 }
 
 // Load reads configuration from environment variables.
@@ -34,8 +66,30 @@ func Load() (*Config, error) {
 	c.SMTPUser = getEnv("SMTP_USER", "")
 	c.SMTPPass = getEnv("SMTP_PASS", "")
 	c.SMTPFrom = getEnv("SMTP_FROM", "noreply@example.com")
+	c.MailTransport = getEnv("MAIL_TRANSPORT", "smtp")
+	c.MailSpoolDir  = getEnv("MAIL_SPOOL_DIR", "/var/spool/wgctrl/mail")
 	c.AppURL   = getEnv("APP_URL", "http://localhost:5173")
 	c.Port     = getEnv("PORT", "8080")
+	c.RejectSharedKeys, err = getEnvBool("REJECT_SHARED_KEYS", false)
+	if err != nil { return nil, err }
+	c.KeyMasterFile = getEnv("KEY_MASTER_FILE", "")
+	c.MeshDNSListen  = getEnv("MESH_DNS_LISTEN", "")
+	c.MeshDNSAddress = getEnv("MESH_DNS_ADDRESS", "")
+	c.MeshDNSZone    = getEnv("MESH_DNS_ZONE", "mesh")
+	if c.MeshDNSListen != "" && c.MeshDNSAddress == "" {
+		host, _, err := net.SplitHostPort(c.MeshDNSListen)
+		if err != nil { return nil, fmt.Errorf("invalid MESH_DNS_LISTEN %q: %w", c.MeshDNSListen, err) }
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() { c.MeshDNSAddress = host }
+	}
+	if c.MeshDNSAddress != "" && net.ParseIP(c.MeshDNSAddress) == nil {
+		return nil, fmt.Errorf("invalid MESH_DNS_ADDRESS %q: must be an IP address", c.MeshDNSAddress)
+	}
+	hb, err := strconv.Atoi(getEnv("SSE_HEARTBEAT_INTERVAL", "15"))
+	if err != nil || hb < 1 { return nil, fmt.Errorf("invalid SSE_HEARTBEAT_INTERVAL: must be a positive number of seconds") }
+	c.SSEHeartbeat = time.Duration(hb) * time.Second
+	c.SSEBackend = getEnv("SSE_BACKEND", "memory")
+	if c.SSEBackend != "memory" && c.SSEBackend != "postgres" { return nil, fmt.Errorf("invalid SSE_BACKEND %q: must be memory or postgres", c.SSEBackend) }
+	c.MetricsToken = getEnv("METRICS_TOKEN", "")
 	return c, nil
 }
 
@@ -54,3 +108,15 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvBool(key string, fallback bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return b, nil
+}
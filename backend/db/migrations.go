@@ -30,6 +30,71 @@ func Migrate(db *sql.DB) error {
 		"CREATE TABLE IF NOT EXISTS network_activity_logs (id UUID PRIMARY KEY DEFAULT gen_random_uuid(), network_id UUID NOT NULL REFERENCES networks(id) ON DELETE CASCADE, user_id UUID REFERENCES users(id) ON DELETE SET NULL, event_type TEXT NOT NULL, metadata JSONB NOT NULL DEFAULT '{}', created_at TIMESTAMPTZ NOT NULL DEFAULT NOW())",
 		"CREATE INDEX IF NOT EXISTS al_network_idx ON network_activity_logs (network_id)",
 		"CREATE INDEX IF NOT EXISTS al_created_at_idx ON network_activity_logs (created_at DESC)",
+		"ALTER TABLE invitations ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ NOT NULL DEFAULT NOW() + INTERVAL '7 days'",
+		"ALTER TABLE invitations ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'member'",
+		"UPDATE invitations SET status = 'revoked', updated_at = NOW() WHERE status = 'pending' AND id NOT IN (SELECT DISTINCT ON (network_id, invited_email) id FROM invitations WHERE status = 'pending' ORDER BY network_id, invited_email, created_at DESC)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS inv_pending_uniq ON invitations (network_id, invited_email) WHERE status = 'pending'",
+		"ALTER TABLE invite_links ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'member'",
+		"ALTER TABLE invite_links ADD COLUMN IF NOT EXISTS auto_approve BOOLEAN NOT NULL DEFAULT TRUE",
+		"CREATE TABLE IF NOT EXISTS invite_link_redemptions (id UUID PRIMARY KEY DEFAULT gen_random_uuid(), link_id UUID NOT NULL REFERENCES invite_links(id) ON DELETE CASCADE, network_id UUID NOT NULL REFERENCES networks(id) ON DELETE CASCADE, user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE, redeemed_at TIMESTAMPTZ NOT NULL DEFAULT NOW())",
+		"CREATE INDEX IF NOT EXISTS ilr_link_idx ON invite_link_redemptions (link_id)",
+		"CREATE TABLE IF NOT EXISTS join_requests (id UUID PRIMARY KEY DEFAULT gen_random_uuid(), network_id UUID NOT NULL REFERENCES networks(id) ON DELETE CASCADE, link_id UUID REFERENCES invite_links(id) ON DELETE SET NULL, user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE, role TEXT NOT NULL DEFAULT 'member', status TEXT NOT NULL DEFAULT 'pending', decided_by UUID REFERENCES users(id) ON DELETE SET NULL, decided_at TIMESTAMPTZ, created_at TIMESTAMPTZ NOT NULL DEFAULT NOW())",
+		"CREATE INDEX IF NOT EXISTS jr_network_idx ON join_requests (network_id)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS jr_pending_uniq ON join_requests (network_id, user_id) WHERE status = 'pending'",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ",
+		"CREATE TABLE IF NOT EXISTS email_verification_tokens (id UUID PRIMARY KEY DEFAULT gen_random_uuid(), user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE, token TEXT NOT NULL UNIQUE, expires_at TIMESTAMPTZ NOT NULL, used_at TIMESTAMPTZ, created_at TIMESTAMPTZ NOT NULL DEFAULT NOW())",
+		"ALTER TABLE networks ADD COLUMN IF NOT EXISTS allowed_domains TEXT[] NOT NULL DEFAULT '{}'",
+		"ALTER TABLE networks ADD COLUMN IF NOT EXISTS domain_join_role TEXT NOT NULL DEFAULT 'member'",
+		"ALTER TABLE networks ADD COLUMN IF NOT EXISTS domain_auto_join BOOLEAN NOT NULL DEFAULT FALSE",
+		"CREATE INDEX IF NOT EXISTS networks_domains_idx ON networks USING GIN (allowed_domains)",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS key_created_at TIMESTAMPTZ",
+		"UPDATE peers SET key_created_at = created_at WHERE key_created_at IS NULL",
+		"ALTER TABLE peers ALTER COLUMN key_created_at SET DEFAULT NOW()",
+		"ALTER TABLE peers ALTER COLUMN key_created_at SET NOT NULL",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS previous_public_key TEXT",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS previous_key_expires_at TIMESTAMPTZ",
+		"ALTER TABLE networks ADD COLUMN IF NOT EXISTS key_rotation_days INTEGER",
+		"CREATE TABLE IF NOT EXISTS email_outbox (id UUID PRIMARY KEY DEFAULT gen_random_uuid(), to_addr TEXT NOT NULL, template TEXT NOT NULL, subject TEXT NOT NULL, text_body TEXT NOT NULL, html_body TEXT NOT NULL, status TEXT NOT NULL DEFAULT 'pending', attempts INTEGER NOT NULL DEFAULT 0, last_error TEXT NOT NULL DEFAULT '', next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(), sent_at TIMESTAMPTZ, created_at TIMESTAMPTZ NOT NULL DEFAULT NOW())",
+		"CREATE INDEX IF NOT EXISTS eo_due_idx ON email_outbox (next_attempt_at) WHERE status = 'pending'",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS key_mode TEXT NOT NULL DEFAULT 'client'",
+		"CREATE TABLE IF NOT EXISTS peer_private_keys (peer_id UUID PRIMARY KEY REFERENCES peers(id) ON DELETE CASCADE, key_id TEXT NOT NULL, wrapped_dek BYTEA NOT NULL, nonce BYTEA NOT NULL, ciphertext BYTEA NOT NULL, created_at TIMESTAMPTZ NOT NULL DEFAULT NOW())",
+		"ALTER TABLE networks ADD COLUMN IF NOT EXISTS psk_mode TEXT NOT NULL DEFAULT 'off'",
+		"ALTER TABLE networks ADD COLUMN IF NOT EXISTS psk_hub_peer_id UUID REFERENCES peers(id) ON DELETE SET NULL",
+		"CREATE TABLE IF NOT EXISTS peer_psks (id UUID PRIMARY KEY DEFAULT gen_random_uuid(), network_id UUID NOT NULL REFERENCES networks(id) ON DELETE CASCADE, peer_a UUID NOT NULL REFERENCES peers(id) ON DELETE CASCADE, peer_b UUID NOT NULL REFERENCES peers(id) ON DELETE CASCADE, key_id TEXT NOT NULL, wrapped_dek BYTEA NOT NULL, nonce BYTEA NOT NULL, ciphertext BYTEA NOT NULL, created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(), UNIQUE (peer_a, peer_b), CHECK (peer_a < peer_b))",
+		"CREATE INDEX IF NOT EXISTS peer_psks_b_idx ON peer_psks (peer_b)",
+		"CREATE INDEX IF NOT EXISTS peer_psks_network_idx ON peer_psks (network_id)",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS posture JSONB",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS posture_reported_at TIMESTAMPTZ",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS quarantined BOOLEAN NOT NULL DEFAULT FALSE",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS quarantine_reason TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE networks ADD COLUMN IF NOT EXISTS posture_rules JSONB",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS hostname TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS os TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}'",
+		"CREATE UNIQUE INDEX IF NOT EXISTS peers_hostname_uniq ON peers (network_id, lower(hostname)) WHERE hostname <> ''",
+		"CREATE INDEX IF NOT EXISTS peers_tags_idx ON peers USING GIN (tags)",
+		"ALTER TABLE networks ADD COLUMN IF NOT EXISTS dns_name TEXT",
+		"CREATE UNIQUE INDEX IF NOT EXISTS networks_dns_name_uniq ON networks (dns_name)",
+		"ALTER TABLE networks ADD COLUMN IF NOT EXISTS dns_config JSONB",
+		"CREATE TABLE IF NOT EXISTS peer_routes (id UUID PRIMARY KEY DEFAULT gen_random_uuid(), network_id UUID NOT NULL REFERENCES networks(id) ON DELETE CASCADE, peer_id UUID NOT NULL REFERENCES peers(id) ON DELETE CASCADE, cidr TEXT NOT NULL, status TEXT NOT NULL DEFAULT 'pending', approved_by UUID REFERENCES users(id) ON DELETE SET NULL, approved_at TIMESTAMPTZ, created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(), UNIQUE (peer_id, cidr))",
+		"CREATE INDEX IF NOT EXISTS peer_routes_network_idx ON peer_routes (network_id)",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS exit_node TEXT NOT NULL DEFAULT 'none'",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS exit_node_id UUID REFERENCES peers(id) ON DELETE SET NULL",
+		"ALTER TABLE networks ADD COLUMN IF NOT EXISTS cidr TEXT NOT NULL DEFAULT '10.10.0.0/24'",
+		"CREATE TABLE IF NOT EXISTS network_peerings (id UUID PRIMARY KEY DEFAULT gen_random_uuid(), network_a UUID NOT NULL REFERENCES networks(id) ON DELETE CASCADE, network_b UUID NOT NULL REFERENCES networks(id) ON DELETE CASCADE, tags_a TEXT[] NOT NULL DEFAULT '{}', tags_b TEXT[] NOT NULL DEFAULT '{}', status TEXT NOT NULL DEFAULT 'pending', requested_by UUID REFERENCES users(id) ON DELETE SET NULL, approved_by UUID REFERENCES users(id) ON DELETE SET NULL, approved_at TIMESTAMPTZ, revoked_by UUID REFERENCES users(id) ON DELETE SET NULL, revoked_at TIMESTAMPTZ, created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(), CHECK (network_a <> network_b))",
+		"CREATE UNIQUE INDEX IF NOT EXISTS network_peerings_pair_uniq ON network_peerings (LEAST(network_a, network_b), GREATEST(network_a, network_b)) WHERE status <> 'revoked'",
+		"ALTER TABLE networks ADD COLUMN IF NOT EXISTS interface_settings JSONB",
+		"ALTER TABLE peers ADD COLUMN IF NOT EXISTS interface_settings JSONB",
+		"ALTER TABLE networks ADD COLUMN IF NOT EXISTS config_version BIGINT NOT NULL DEFAULT 1",
+		"CREATE TABLE IF NOT EXISTS sse_events (id BIGSERIAL PRIMARY KEY, payload JSONB NOT NULL, created_at TIMESTAMPTZ NOT NULL DEFAULT NOW())",
+		"CREATE INDEX IF NOT EXISTS sse_events_created_idx ON sse_events (created_at)",
+		"CREATE TABLE IF NOT EXISTS revoked_sessions (session_id TEXT PRIMARY KEY, expires_at TIMESTAMPTZ, revoked_at TIMESTAMPTZ NOT NULL DEFAULT NOW())",
+		"CREATE INDEX IF NOT EXISTS revoked_sessions_expires_idx ON revoked_sessions (expires_at)",
+		"CREATE TABLE IF NOT EXISTS network_domains (network_id UUID NOT NULL REFERENCES networks(id) ON DELETE CASCADE, domain TEXT NOT NULL, token TEXT NOT NULL, verified_at TIMESTAMPTZ, created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(), PRIMARY KEY (network_id, domain))",
+		"INSERT INTO network_domains (network_id, domain, token) SELECT n.id, d, replace(gen_random_uuid()::text, '-', '') FROM networks n, unnest(n.allowed_domains) d ON CONFLICT (network_id, domain) DO NOTHING",
+		"ALTER TABLE peer_private_keys ADD COLUMN IF NOT EXISTS aad_bound BOOLEAN NOT NULL DEFAULT FALSE",
+		"ALTER TABLE peer_psks ADD COLUMN IF NOT EXISTS aad_bound BOOLEAN NOT NULL DEFAULT FALSE",
 	}
 
 	for _, stmt := range stmts {
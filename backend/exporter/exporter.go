@@ -0,0 +1,92 @@
+// Package exporter renders a device configuration in the formats the
+// different WireGuard front ends read.
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+// Format names accepted by Render.
+const (
+	FormatWGQuick        = "wg-quick"
+	FormatNetworkd       = "systemd-networkd"
+	FormatNetworkManager = "networkmanager"
+	FormatSetconf        = "wg-setconf"
+	FormatJSON           = "json"
+)
+
+// Formats lists every supported format, wg-quick first as the default.
+var Formats = []string{FormatWGQuick, FormatNetworkd, FormatNetworkManager, FormatSetconf, FormatJSON}
+
+// Supported reports whether format is a known format; "" means wg-quick.
+func Supported(format string) bool {
+	if format == "" { return true }
+	for _, f := range Formats { if f == format { return true } }
+	return false
+}
+
+// DefaultInterface is the interface name used when none is given.
+const DefaultInterface = "wg0"
+
+// ifaceNameRe matches names Linux accepts for a network interface.
+var ifaceNameRe = regexp.MustCompile(`^[a-zA-Z0-9_=+.-]{1,15}$`)
+
+// ValidInterfaceName reports whether name can be used as an interface name.
+func ValidInterfaceName(name string) bool { return ifaceNameRe.MatchString(name) }
+
+// Document is a rendered configuration ready to be served as a download.
+type Document struct {
+	ContentType string
+	Filename    string
+	Body        []byte
+}
+
+// Render renders cfg for the interface called name in the given format.
+func Render(format, name string, cfg *wireguard.Config) (*Document, error) {
+	if !ValidInterfaceName(name) { return nil, fmt.Errorf("invalid interface name %q", name) }
+	switch format {
+	case "", FormatWGQuick:
+		return &Document{ContentType: "text/plain; charset=utf-8", Filename: name + ".conf", Body: []byte(cfg.WGQuick())}, nil
+	case FormatNetworkd:
+		return &Document{ContentType: "text/plain; charset=utf-8", Filename: name + ".networkd.txt", Body: []byte(networkd(name, cfg))}, nil
+	case FormatNetworkManager:
+		return &Document{ContentType: "text/plain; charset=utf-8", Filename: name + ".nmconnection", Body: []byte(networkManager(name, cfg))}, nil
+	case FormatSetconf:
+		return &Document{ContentType: "text/plain; charset=utf-8", Filename: name + ".setconf.conf", Body: []byte(setconf(cfg))}, nil
+	case FormatJSON:
+		b, err := json.MarshalIndent(newJSONConfig(name, cfg), "", "  ")
+		if err != nil { return nil, err }
+		return &Document{ContentType: "application/json", Filename: name + ".json", Body: append(b, '\n')}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q; use one of %s", format, strings.Join(Formats, ", "))
+}
+
+// privateKey returns the key or, for client-held keys, a placeholder.
+func privateKey(cfg *wireguard.Config) string {
+	if cfg.Interface.PrivateKey != "" { return cfg.Interface.PrivateKey }
+	return "<your-private-key>"
+}
+
+// setconf renders the subset of the config `wg setconf` understands: no
+// addresses, DNS, MTU, routing or hooks.
+func setconf(cfg *wireguard.Config) string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", privateKey(cfg))
+	if cfg.Interface.ListenPort > 0 { fmt.Fprintf(&b, "ListenPort = %d\n", cfg.Interface.ListenPort) }
+	if cfg.Interface.FwMark > 0 { fmt.Fprintf(&b, "FwMark = %d\n", cfg.Interface.FwMark) }
+	for _, p := range cfg.Peers {
+		b.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", p.PublicKey)
+		if p.PresharedKey != "" { fmt.Fprintf(&b, "PresharedKey = %s\n", p.PresharedKey) }
+		if p.Endpoint != "" { fmt.Fprintf(&b, "Endpoint = %s\n", p.Endpoint) }
+		if len(p.AllowedIPs) > 0 { fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(p.AllowedIPs, ", ")) }
+		if p.PersistentKeepalive > 0 { fmt.Fprintf(&b, "PersistentKeepalive = %d\n", p.PersistentKeepalive) }
+	}
+	return b.String()
+}
@@ -0,0 +1,86 @@
+package exporter
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/*.golden from the current output")
+
+// goldenConfigs are rendered in every format and compared against
+// testdata/<name>.<format>.golden.
+var goldenConfigs = map[string]*wireguard.Config{
+	// Server-managed key, PSK, split DNS, Table = off and hooks.
+	"full": {
+		Interface: wireguard.Interface{
+			PrivateKey:    "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+			Address:       []string{"10.10.0.2/24", "fd00:10::2/64"},
+			DNS:           []string{"10.10.0.1", "1.1.1.1"},
+			SearchDomains: []string{"office.mesh", "corp.example"},
+			DNSRoutes: []wireguard.DNSRoute{
+				{Domain: "internal.example", Nameservers: []string{"10.20.0.53", "1.1.1.1"}},
+				{Domain: "lab.example", Nameservers: []string{"10.30.0.53"}},
+			},
+			ListenPort: 51820,
+			MTU:        1380,
+			FwMark:     51820,
+			Table:      "off",
+			PostUp:     []string{"ip rule add fwmark 51820 table 200", "iptables -A FORWARD -i %i -j ACCEPT"},
+			PostDown:   []string{"ip rule del fwmark 51820 table 200"},
+		},
+		Peers: []wireguard.PeerConfig{
+			{
+				PublicKey:           "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+				PresharedKey:        "FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE=",
+				Endpoint:            "vpn.example.com:51820",
+				AllowedIPs:          []string{"10.10.0.1/32", "192.168.1.0/24"},
+				PersistentKeepalive: 25,
+			},
+			{
+				PublicKey:  "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=",
+				AllowedIPs: []string{"10.10.0.3/32", "fd00:10::3/128"},
+			},
+		},
+	},
+	// Client-held key: the private key is a placeholder (null in JSON).
+	"client-key": {
+		Interface: wireguard.Interface{
+			Address: []string{"10.10.0.5/24"},
+			Table:   "1234",
+		},
+		Peers: []wireguard.PeerConfig{
+			{PublicKey: "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", Endpoint: "203.0.113.10:51820", AllowedIPs: []string{"10.10.0.0/24"}},
+		},
+	},
+}
+
+func TestRenderGolden(t *testing.T) {
+	for name, cfg := range goldenConfigs {
+		for _, format := range Formats {
+			t.Run(name+"/"+format, func(t *testing.T) {
+				doc, err := Render(format, "wg0", cfg)
+				if err != nil { t.Fatalf("Render: %v", err) }
+				path := filepath.Join("testdata", name+"."+format+".golden")
+				if *update {
+					if err := os.WriteFile(path, doc.Body, 0o644); err != nil { t.Fatal(err) }
+					return
+				}
+				want, err := os.ReadFile(path)
+				if err != nil { t.Fatalf("%v (run go test -update to create it)", err) }
+				if !bytes.Equal(doc.Body, want) { t.Errorf("%s differs from the golden file:\n%s", path, doc.Body) }
+			})
+		}
+	}
+}
+
+func TestRenderRejectsUnknownFormatAndName(t *testing.T) {
+	cfg := goldenConfigs["client-key"]
+	if _, err := Render("ini", "wg0", cfg); err == nil { t.Error("unknown format accepted") }
+	if _, err := Render(FormatWGQuick, "wg0; rm -rf /", cfg); err == nil { t.Error("invalid interface name accepted") }
+	if doc, err := Render("", "wg1", cfg); err != nil || doc.Filename != "wg1.conf" { t.Errorf("default format: %v, %+v", err, doc) }
+}
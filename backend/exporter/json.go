@@ -0,0 +1,79 @@
+package exporter
+
+import "github.com/wgcloudctrl/server/wireguard"
+
+// jsonConfig is the structured document served for FormatJSON. Field names
+// and zero-value omission are part of the API; see DOCUMENTATION.md.
+type jsonConfig struct {
+	Name      string     `json:"name"`
+	Interface jsonIface  `json:"interface"`
+	Peers     []jsonPeer `json:"peers"`
+}
+
+type jsonIface struct {
+	PrivateKey    *string        `json:"private_key"`
+	Addresses     []string       `json:"addresses"`
+	ListenPort    int            `json:"listen_port,omitempty"`
+	MTU           int            `json:"mtu,omitempty"`
+	FwMark        uint32         `json:"fwmark,omitempty"`
+	Table         string         `json:"table,omitempty"`
+	DNS           []string       `json:"dns"`
+	SearchDomains []string       `json:"search_domains"`
+	DNSRoutes     []jsonDNSRoute `json:"dns_routes"`
+	PostUp        []string       `json:"post_up"`
+	PostDown      []string       `json:"post_down"`
+}
+
+type jsonDNSRoute struct {
+	Domain      string   `json:"domain"`
+	Nameservers []string `json:"nameservers"`
+}
+
+type jsonPeer struct {
+	PublicKey           string   `json:"public_key"`
+	PresharedKey        string   `json:"preshared_key,omitempty"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"`
+}
+
+// orEmpty keeps lists as [] rather than null in the JSON document.
+func orEmpty(list []string) []string {
+	if list == nil { return []string{} }
+	return list
+}
+
+func newJSONConfig(name string, cfg *wireguard.Config) jsonConfig {
+	iface := cfg.Interface
+	out := jsonConfig{
+		Name: name,
+		Interface: jsonIface{
+			Addresses:     orEmpty(iface.Address),
+			ListenPort:    iface.ListenPort,
+			MTU:           iface.MTU,
+			FwMark:        iface.FwMark,
+			Table:         iface.Table,
+			DNS:           orEmpty(iface.DNS),
+			SearchDomains: orEmpty(iface.SearchDomains),
+			DNSRoutes:     []jsonDNSRoute{},
+			PostUp:        orEmpty(iface.PostUp),
+			PostDown:      orEmpty(iface.PostDown),
+		},
+		Peers: []jsonPeer{},
+	}
+	// A client-held key is null rather than a placeholder.
+	if iface.PrivateKey != "" { k := iface.PrivateKey; out.Interface.PrivateKey = &k }
+	for _, rt := range iface.DNSRoutes {
+		out.Interface.DNSRoutes = append(out.Interface.DNSRoutes, jsonDNSRoute{Domain: rt.Domain, Nameservers: orEmpty(rt.Nameservers)})
+	}
+	for _, p := range cfg.Peers {
+		out.Peers = append(out.Peers, jsonPeer{
+			PublicKey:           p.PublicKey,
+			PresharedKey:        p.PresharedKey,
+			Endpoint:            p.Endpoint,
+			AllowedIPs:          orEmpty(p.AllowedIPs),
+			PersistentKeepalive: p.PersistentKeepalive,
+		})
+	}
+	return out
+}
@@ -0,0 +1,69 @@
+package exporter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+// networkd renders the .netdev and .network files systemd-networkd needs,
+// one after the other, each introduced by a "# File:" line naming where it
+// goes. PostUp/PostDown have no networkd equivalent and are kept as comments.
+func networkd(name string, cfg *wireguard.Config) string {
+	iface := cfg.Interface
+	var b strings.Builder
+	fmt.Fprintf(&b, "# File: /etc/systemd/network/90-%s.netdev\n", name)
+	b.WriteString("[NetDev]\n")
+	fmt.Fprintf(&b, "Name=%s\n", name)
+	b.WriteString("Kind=wireguard\n")
+	if iface.MTU > 0 { fmt.Fprintf(&b, "MTUBytes=%d\n", iface.MTU) }
+	b.WriteString("\n[WireGuard]\n")
+	fmt.Fprintf(&b, "PrivateKey=%s\n", privateKey(cfg))
+	if iface.ListenPort > 0 { fmt.Fprintf(&b, "ListenPort=%d\n", iface.ListenPort) }
+	if iface.FwMark > 0 { fmt.Fprintf(&b, "FirewallMark=%d\n", iface.FwMark) }
+	// networkd only installs AllowedIPs routes when asked to; "auto" is
+	// wg-quick's behaviour of using the main table.
+	switch iface.Table {
+	case "", "auto":
+		b.WriteString("RouteTable=main\n")
+	default:
+		fmt.Fprintf(&b, "RouteTable=%s\n", iface.Table)
+	}
+	for _, p := range cfg.Peers {
+		b.WriteString("\n[WireGuardPeer]\n")
+		fmt.Fprintf(&b, "PublicKey=%s\n", p.PublicKey)
+		if p.PresharedKey != "" { fmt.Fprintf(&b, "PresharedKey=%s\n", p.PresharedKey) }
+		if p.Endpoint != "" { fmt.Fprintf(&b, "Endpoint=%s\n", p.Endpoint) }
+		if len(p.AllowedIPs) > 0 { fmt.Fprintf(&b, "AllowedIPs=%s\n", strings.Join(p.AllowedIPs, ",")) }
+		if p.PersistentKeepalive > 0 { fmt.Fprintf(&b, "PersistentKeepalive=%d\n", p.PersistentKeepalive) }
+	}
+
+	fmt.Fprintf(&b, "\n# File: /etc/systemd/network/90-%s.network\n", name)
+	b.WriteString("[Match]\n")
+	fmt.Fprintf(&b, "Name=%s\n", name)
+	b.WriteString("\n[Network]\n")
+	for _, a := range iface.Address { fmt.Fprintf(&b, "Address=%s\n", a) }
+	dns := append([]string{}, iface.DNS...)
+	domains := append([]string{}, iface.SearchDomains...)
+	// Split DNS: the route's resolvers join the link's DNS servers and the
+	// domain becomes a routing-only domain (~domain).
+	for _, rt := range iface.DNSRoutes {
+		dns = append(dns, rt.Nameservers...)
+		domains = append(domains, "~"+rt.Domain)
+	}
+	if len(dns) > 0 { fmt.Fprintf(&b, "DNS=%s\n", strings.Join(dedupe(dns), " ")) }
+	if len(domains) > 0 { fmt.Fprintf(&b, "Domains=%s\n", strings.Join(domains, " ")) }
+	for _, cmd := range iface.PostUp { fmt.Fprintf(&b, "# PostUp (not supported by networkd): %s\n", cmd) }
+	for _, cmd := range iface.PostDown { fmt.Fprintf(&b, "# PostDown (not supported by networkd): %s\n", cmd) }
+	return b.String()
+}
+
+func dedupe(list []string) []string {
+	seen := make(map[string]bool, len(list))
+	out := list[:0]
+	for _, s := range list {
+		if !seen[s] { seen[s] = true; out = append(out, s) }
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package exporter
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+// networkManager renders a NetworkManager keyfile, to be saved as
+// /etc/NetworkManager/system-connections/<name>.nmconnection with mode 0600.
+// PostUp/PostDown have no NetworkManager equivalent and are kept as comments.
+func networkManager(name string, cfg *wireguard.Config) string {
+	iface := cfg.Interface
+	var b strings.Builder
+	b.WriteString("[connection]\n")
+	fmt.Fprintf(&b, "id=%s\n", name)
+	b.WriteString("type=wireguard\n")
+	fmt.Fprintf(&b, "interface-name=%s\n", name)
+	for _, cmd := range iface.PostUp { fmt.Fprintf(&b, "# PostUp (not supported by NetworkManager): %s\n", cmd) }
+	for _, cmd := range iface.PostDown { fmt.Fprintf(&b, "# PostDown (not supported by NetworkManager): %s\n", cmd) }
+
+	b.WriteString("\n[wireguard]\n")
+	fmt.Fprintf(&b, "private-key=%s\n", privateKey(cfg))
+	if iface.ListenPort > 0 { fmt.Fprintf(&b, "listen-port=%d\n", iface.ListenPort) }
+	if iface.FwMark > 0 { fmt.Fprintf(&b, "fwmark=%d\n", iface.FwMark) }
+	if iface.MTU > 0 { fmt.Fprintf(&b, "mtu=%d\n", iface.MTU) }
+	if iface.Table == "off" { b.WriteString("peer-routes=false\n") }
+
+	for _, p := range cfg.Peers {
+		fmt.Fprintf(&b, "\n[wireguard-peer.%s]\n", p.PublicKey)
+		if p.Endpoint != "" { fmt.Fprintf(&b, "endpoint=%s\n", p.Endpoint) }
+		if p.PresharedKey != "" {
+			fmt.Fprintf(&b, "preshared-key=%s\n", p.PresharedKey)
+			b.WriteString("preshared-key-flags=0\n")
+		}
+		if p.PersistentKeepalive > 0 { fmt.Fprintf(&b, "persistent-keepalive=%d\n", p.PersistentKeepalive) }
+		if len(p.AllowedIPs) > 0 { fmt.Fprintf(&b, "allowed-ips=%s;\n", strings.Join(p.AllowedIPs, ";")) }
+	}
+
+	// NetworkManager keeps resolver settings per address family.
+	var v4, v6 []string
+	for _, a := range iface.Address {
+		if p, err := netip.ParsePrefix(a); err == nil && p.Addr().Is6() { v6 = append(v6, a) } else { v4 = append(v4, a) }
+	}
+	var dns4, dns6 []string
+	for _, ns := range iface.DNS {
+		if a, err := netip.ParseAddr(ns); err == nil && a.Is6() { dns6 = append(dns6, ns) } else { dns4 = append(dns4, ns) }
+	}
+	search := append([]string{}, iface.SearchDomains...)
+	for _, rt := range iface.DNSRoutes {
+		for _, ns := range rt.Nameservers {
+			if a, err := netip.ParseAddr(ns); err == nil && a.Is6() { dns6 = append(dns6, ns) } else { dns4 = append(dns4, ns) }
+		}
+		search = append(search, "~"+rt.Domain)
+	}
+	table := ""
+	if _, err := strconv.ParseUint(iface.Table, 10, 32); err == nil { table = iface.Table }
+
+	writeIPSection(&b, "ipv4", v4, dedupe(dns4), search, table)
+	writeIPSection(&b, "ipv6", v6, dedupe(dns6), search, table)
+	return b.String()
+}
+
+func writeIPSection(b *strings.Builder, family string, addrs, dns, search []string, table string) {
+	fmt.Fprintf(b, "\n[%s]\n", family)
+	if len(addrs) == 0 {
+		b.WriteString("method=disabled\n")
+		return
+	}
+	b.WriteString("method=manual\n")
+	for i, a := range addrs { fmt.Fprintf(b, "address%d=%s\n", i+1, a) }
+	if len(dns) > 0 { fmt.Fprintf(b, "dns=%s;\n", strings.Join(dns, ";")) }
+	if len(search) > 0 { fmt.Fprintf(b, "dns-search=%s;\n", strings.Join(search, ";")) }
+	if table != "" { fmt.Fprintf(b, "route-table=%s\n", table) }
+}
@@ -1,27 +1,32 @@
 package handlers
 
 import (
+	"context"
 	"crypto/rand"
-	"crypto/tls"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"net/smtp"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/lib/pq"
 	"github.com/wgcloudctrl/server/config"
+	"github.com/wgcloudctrl/server/mailer"
 	mw "github.com/wgcloudctrl/server/middleware"
+	"github.com/wgcloudctrl/server/sse"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthHandler struct {
-	DB  *sql.DB
-	Cfg *config.Config
+	DB     *sql.DB
+	Cfg    *config.Config
+	Mail   *mailer.Outbox
+	Broker *sse.Broker
 }
 
 func jsonOK(w http.ResponseWriter, code int, v interface{}) {
@@ -36,6 +41,12 @@ func jsonError(w http.ResponseWriter, msg string, code int) {
 	json.NewEncoder(w).Encode(map[string]string{"error": msg})
 }
 
+// isUniqueViolation reports whether err is a Postgres unique constraint violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
 func makeJWT(userID, email, secret string) (string, error) {
 	now := time.Now()
 	claims := mw.Claims{UserID: userID, Email: email, RegisteredClaims: jwt.RegisteredClaims{
@@ -45,8 +56,9 @@ func makeJWT(userID, email, secret string) (string, error) {
 
 func (h *AuthHandler) Signup(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email       string `json:"email"`
+		Password    string `json:"password"`
+		InviteToken string `json:"invite_token"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
 	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
@@ -62,7 +74,74 @@ func (h *AuthHandler) Signup(w http.ResponseWriter, r *http.Request) {
 	if err != nil { log.Printf("signup error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
 	token, err := makeJWT(userID, req.Email, h.Cfg.JWTSecret)
 	if err != nil { log.Printf("jwt error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
-	jsonOK(w, http.StatusCreated, map[string]string{"user_id": userID, "token": token})
+	resp := map[string]string{"user_id": userID, "token": token}
+	if req.InviteToken != "" {
+		// Signing up from an emailed invitation accepts it straight away.
+		networkID, err := acceptInvitationToken(r.Context(), h.DB, h.Cfg.JWTSecret, req.InviteToken, userID, req.Email)
+		if err != nil {
+			log.Printf("signup invitation accept error: %v", err)
+			resp["invitation_error"] = err.Error()
+		} else {
+			resp["network_id"] = networkID
+			// The invitation link was delivered to this address, which proves ownership.
+			h.markEmailVerified(r.Context(), userID, req.Email)
+		}
+	}
+	if resp["network_id"] == "" {
+		if err := h.sendVerificationEmail(r.Context(), userID, req.Email); err != nil { log.Printf("verification email error: %v", err) }
+	}
+	jsonOK(w, http.StatusCreated, resp)
+}
+
+// sendVerificationEmail issues a fresh email verification token and queues
+// the verification email.
+func (h *AuthHandler) sendVerificationEmail(ctx context.Context, userID, email string) error {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil { return err }
+	token := hex.EncodeToString(raw)
+	_, err := h.DB.ExecContext(ctx, "INSERT INTO email_verification_tokens (user_id, token, expires_at) VALUES ($1, $2, $3)", userID, token, time.Now().Add(24*time.Hour))
+	if err != nil { return fmt.Errorf("store verification token: %w", err) }
+	verifyURL := fmt.Sprintf("%s/verify-email?token=%s", h.Cfg.AppURL, token)
+	return h.Mail.Enqueue(ctx, email, mailer.TemplateVerify, mailer.VerifyData{Email: email, URL: verifyURL})
+}
+
+// markEmailVerified records the user's address as verified and applies any
+// domain auto-join rules it now qualifies for.
+func (h *AuthHandler) markEmailVerified(ctx context.Context, userID, email string) []string {
+	if _, err := h.DB.ExecContext(ctx, "UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW()), updated_at = NOW() WHERE id = $1", userID); err != nil {
+		log.Printf("mark email verified error: %v", err)
+		return nil
+	}
+	return applyDomainAutoJoin(ctx, h.DB, userID, email)
+}
+
+// POST /api/auth/verify-email
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct { Token string `json:"token"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
+	if req.Token == "" { jsonError(w, "token is required", http.StatusBadRequest); return }
+	var userID, email string
+	err := h.DB.QueryRowContext(r.Context(),
+		"UPDATE email_verification_tokens t SET used_at = NOW() FROM users u WHERE t.token = $1 AND t.used_at IS NULL AND t.expires_at > NOW() AND u.id = t.user_id RETURNING u.id, u.email",
+		req.Token).Scan(&userID, &email)
+	if err == sql.ErrNoRows { jsonError(w, "invalid or expired verification link", http.StatusGone); return }
+	if err != nil { log.Printf("verify email error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	joined := h.markEmailVerified(r.Context(), userID, email)
+	if joined == nil { joined = []string{} }
+	jsonOK(w, http.StatusOK, map[string]interface{}{"message": "email verified", "joined_networks": joined})
+}
+
+// POST /api/auth/resend-verification
+func (h *AuthHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	email := mw.EmailFromContext(r.Context())
+	var verifiedAt *time.Time
+	if err := h.DB.QueryRowContext(r.Context(), "SELECT email_verified_at FROM users WHERE id = $1", userID).Scan(&verifiedAt); err != nil {
+		log.Printf("verification status error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return
+	}
+	if verifiedAt != nil { jsonError(w, "email is already verified", http.StatusConflict); return }
+	if err := h.sendVerificationEmail(r.Context(), userID, email); err != nil { log.Printf("verification email error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	jsonOK(w, http.StatusOK, map[string]string{"message": "verification email sent"})
 }
 
 func (h *AuthHandler) Signin(w http.ResponseWriter, r *http.Request) {
@@ -73,41 +152,46 @@ func (h *AuthHandler) Signin(w http.ResponseWriter, r *http.Request) {
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
 	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
 	var userID, hash string
-	err := h.DB.QueryRowContext(r.Context(), "SELECT id, password_hash FROM users WHERE email = $1", req.Email).Scan(&userID, &hash)
+	var verifiedAt *time.Time
+	err := h.DB.QueryRowContext(r.Context(), "SELECT id, password_hash, email_verified_at FROM users WHERE email = $1", req.Email).Scan(&userID, &hash, &verifiedAt)
 	if err == sql.ErrNoRows { jsonError(w, "invalid credentials", http.StatusUnauthorized); return }
 	if err != nil { log.Printf("signin error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
 	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil { jsonError(w, "invalid credentials", http.StatusUnauthorized); return }
 	token, err := makeJWT(userID, req.Email, h.Cfg.JWTSecret)
 	if err != nil { log.Printf("jwt error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
-	jsonOK(w, http.StatusOK, map[string]string{"user_id": userID, "email": req.Email, "token": token})
+	resp := map[string]interface{}{"user_id": userID, "email": req.Email, "token": token, "email_verified": verifiedAt != nil}
+	if verifiedAt != nil {
+		if joined := applyDomainAutoJoin(r.Context(), h.DB, userID, req.Email); len(joined) > 0 { resp["joined_networks"] = joined }
+	}
+	jsonOK(w, http.StatusOK, resp)
 }
 
+// Signout revokes the caller's token, which the auth middleware then refuses
+// (see SessionRevoked), and ends the event streams opened with it.
 func (h *AuthHandler) Signout(w http.ResponseWriter, r *http.Request) {
+	if tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if claims, err := mw.ParseToken(tok); err == nil {
+			session := mw.SessionID(tok)
+			var expires *time.Time
+			if claims.ExpiresAt != nil { expires = &claims.ExpiresAt.Time }
+			_, err := h.DB.ExecContext(r.Context(), "INSERT INTO revoked_sessions (session_id, expires_at) VALUES ($1, $2) ON CONFLICT (session_id) DO NOTHING", session, expires)
+			if err != nil { log.Printf("revoke session error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+			// Expired tokens are refused anyway; their rows are no longer needed.
+			if _, err := h.DB.ExecContext(r.Context(), "DELETE FROM revoked_sessions WHERE expires_at < NOW()"); err != nil { log.Printf("revoked sessions cleanup error: %v", err) }
+			h.Broker.RevokeSession(session, "signed_out")
+		}
+	}
 	jsonOK(w, http.StatusOK, map[string]string{"message": "signed out"})
 }
 
-func sendEmail(cfg *config.Config, to, subject, body string) error {
-	addr := fmt.Sprintf("%s:%d", cfg.SMTPHost, cfg.SMTPPort)
-	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s", cfg.SMTPFrom, to, subject, body)
-	var auth smtp.Auth
-	if cfg.SMTPUser != "" {
-		auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPass, cfg.SMTPHost)
-	}
-	conn, err := smtp.Dial(addr)
-	if err != nil { return fmt.Errorf("smtp.Dial: %w", err) }
-	defer conn.Close()
-	if ok, _ := conn.Extension("STARTTLS"); ok {
-		tlsCfg := &tls.Config{ServerName: cfg.SMTPHost}
-		if err := conn.StartTLS(tlsCfg); err != nil { return fmt.Errorf("StartTLS: %w", err) }
+// SessionRevoked returns the auth middleware's check against the sessions
+// revoked by Signout.
+func SessionRevoked(db *sql.DB) mw.SessionCheck {
+	return func(ctx context.Context, session string) (bool, error) {
+		var revoked bool
+		err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM revoked_sessions WHERE session_id = $1)", session).Scan(&revoked)
+		return revoked, err
 	}
-	if auth != nil { if err := conn.Auth(auth); err != nil { return fmt.Errorf("smtp.Auth: %w", err) } }
-	if err := conn.Mail(cfg.SMTPFrom); err != nil { return err }
-	if err := conn.Rcpt(to); err != nil { return err }
-	wc, err := conn.Data()
-	if err != nil { return err }
-	defer wc.Close()
-	_, err = fmt.Fprint(wc, msg)
-	return err
 }
 
 func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
@@ -124,12 +208,9 @@ func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	_, err = h.DB.ExecContext(r.Context(), "INSERT INTO password_reset_tokens (user_id, token, expires_at) VALUES ($1, $2, $3)", userID, token, expires)
 	if err != nil { log.Printf("reset token error: %v", err); jsonOK(w, http.StatusOK, map[string]string{"message": "if that email exists, a reset link has been sent"}); return }
 	resetURL := fmt.Sprintf("%s/reset-password?token=%s", h.Cfg.AppURL, token)
-	body := fmt.Sprintf("Click here to reset your password (valid 1 hour):\n%s\n", resetURL)
-	go func() {
-		if err := sendEmail(h.Cfg, req.Email, "Password Reset - Simple Mesh Link", body); err != nil {
-			log.Printf("failed to send reset email to %s: %v", req.Email, err)
-		}
-	}()
+	if err := h.Mail.Enqueue(r.Context(), req.Email, mailer.TemplateReset, mailer.ResetData{URL: resetURL}); err != nil {
+		log.Printf("failed to queue reset email to %s: %v", req.Email, err)
+	}
 	jsonOK(w, http.StatusOK, map[string]string{"message": "if that email exists, a reset link has been sent"})
 }
 
@@ -148,5 +229,9 @@ func (h *AuthHandler) UpdatePassword(w http.ResponseWriter, r *http.Request) {
 func (h *AuthHandler) Me(w http.ResponseWriter, r *http.Request) {
 	userID := mw.UserIDFromContext(r.Context())
 	email := mw.EmailFromContext(r.Context())
-	jsonOK(w, http.StatusOK, map[string]string{"user_id": userID, "email": email})
+	var verifiedAt *time.Time
+	if err := h.DB.QueryRowContext(r.Context(), "SELECT email_verified_at FROM users WHERE id = $1", userID).Scan(&verifiedAt); err != nil && err != sql.ErrNoRows {
+		log.Printf("me query error: %v", err)
+	}
+	jsonOK(w, http.StatusOK, map[string]interface{}{"user_id": userID, "email": email, "email_verified": verifiedAt != nil})
 }
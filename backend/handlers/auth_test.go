@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	mw "github.com/wgcloudctrl/server/middleware"
+	"github.com/wgcloudctrl/server/sse"
+)
+
+func TestSignoutRevokesToken(t *testing.T) {
+	db := testDB(t)
+	const secret = "test-secret"
+	mw.SetJWTSecret(secret)
+	mw.SetSessionCheck(SessionRevoked(db))
+	t.Cleanup(func() { mw.SetSessionCheck(nil) })
+	userID, email := createUser(t, db)
+	tok, err := makeJWT(userID, email, secret)
+	if err != nil { t.Fatal(err) }
+	other, err := makeJWT(userID, email+".other", secret)
+	if err != nil { t.Fatal(err) }
+
+	protected := mw.Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	call := func(token string) int {
+		req := httptest.NewRequest("GET", "/api/auth/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		protected.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := call(tok); code != http.StatusOK { t.Fatalf("before signout: status %d", code) }
+
+	h := &AuthHandler{DB: db, Broker: sse.NewBroker()}
+	req := httptest.NewRequest("POST", "/api/auth/signout", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	rec := httptest.NewRecorder()
+	h.Signout(rec, req)
+	if rec.Code != http.StatusOK { t.Fatalf("signout: status %d: %s", rec.Code, rec.Body) }
+	t.Cleanup(func() { db.Exec("DELETE FROM revoked_sessions WHERE session_id = $1", mw.SessionID(tok)) })
+
+	if code := call(tok); code != http.StatusUnauthorized { t.Errorf("after signout: status %d, want 401", code) }
+	if code := call(other); code != http.StatusOK { t.Errorf("another session of the user: status %d, want 200", code) }
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/wgcloudctrl/server/exporter"
+	mw "github.com/wgcloudctrl/server/middleware"
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+// defaultKeepalive matches the PersistentKeepalive used by the web client. It
+// applies unless the network or peer sets persistent_keepalive.
+const defaultKeepalive = 25
+
+// buildPeerConfig assembles the device configuration for self. The private
+// key is only filled in for server-managed peers, and preshared keys only for
+// tunnels the network's PSK policy covers. Quarantined peers are left out of
+// every other peer's config, and a quarantined peer gets no peers at all.
+// A peer's approved subnet routes are added to its AllowedIPs, and the exit
+// node self has selected gets the full-tunnel range. Peers of networks
+// joined to self's network by an active peering follow the local ones.
+// Interface settings are the network's defaults overlaid with self's own.
+func (h *PeersHandler) buildPeerConfig(ctx context.Context, self *Peer) (*wireguard.Config, error) {
+	prefix, err := networkPrefix(ctx, h.DB, self.NetworkID)
+	if err != nil { return nil, err }
+	cfg := &wireguard.Config{Interface: wireguard.Interface{Address: []string{fmt.Sprintf("%s/%d", self.VirtualIP, prefix.Bits())}}}
+	if self.KeyMode == keyModeServer {
+		priv, err := loadPrivateKey(ctx, h.DB, h.Keys, self.ID)
+		if err != nil { return nil, err }
+		cfg.Interface.PrivateKey = priv.String()
+	}
+	netSettings, peerSettings, err := loadInterfaceSettings(ctx, h.DB, self.ID)
+	if err != nil { return nil, err }
+	settings := netSettings.merge(peerSettings)
+	settings.apply(&cfg.Interface)
+	keepalive := settings.keepalive()
+	dns, err := h.effectiveDNS(ctx, self.NetworkID)
+	if err != nil { return nil, err }
+	cfg.Interface.DNS, cfg.Interface.SearchDomains = dns.Nameservers, dns.SearchDomains
+	for _, rt := range dns.Routes {
+		cfg.Interface.DNSRoutes = append(cfg.Interface.DNSRoutes, wireguard.DNSRoute{Domain: rt.Domain, Nameservers: rt.Nameservers})
+	}
+	policy, err := loadPSKPolicy(ctx, h.DB, self.NetworkID)
+	if err != nil { return nil, err }
+	peers, err := getPeers(h.DB, self.NetworkID)
+	if err != nil { return nil, err }
+	if self.Quarantined { return cfg, nil }
+	for _, p := range peers {
+		if p.ID == self.ID || p.Quarantined { continue }
+		pc := wireguard.PeerConfig{
+			PublicKey:           p.PublicKey,
+			Endpoint:            p.Endpoint,
+			AllowedIPs:          append([]string{p.VirtualIP + "/32"}, p.Routes...),
+			PersistentKeepalive: keepalive,
+		}
+		if self.ExitNodeID != nil && *self.ExitNodeID == p.ID && p.ExitNode == exitNodeApproved { pc.AllowedIPs = fullTunnel }
+		if policy.covers(self.ID, p.ID) {
+			psk, err := ensurePSK(ctx, h.DB, h.Keys, self.NetworkID, self.ID, p.ID)
+			if err != nil { return nil, err }
+			pc.PresharedKey = psk.String()
+		}
+		cfg.Peers = append(cfg.Peers, pc)
+	}
+	peered, err := peeredPeerConfigs(ctx, h.DB, self, keepalive)
+	if err != nil { return nil, err }
+	cfg.Peers = append(cfg.Peers, peered...)
+	return cfg, nil
+}
+
+// stillMember answers 403 and returns false if userID is no longer a member
+// of the network: removing a member leaves their peers in place.
+func (h *PeersHandler) stillMember(w http.ResponseWriter, r *http.Request, networkID, userID string) bool {
+	_, err := memberRole(r.Context(), h.DB, networkID, userID)
+	if err == sql.ErrNoRows { jsonError(w, "not a member of this network", http.StatusForbidden); return false }
+	if err != nil { log.Printf("member role error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return false }
+	return true
+}
+
+// GET /api/peers/:id/config?format=wg-quick&name=wg0
+// Only the peer's owner may download its configuration, since it can carry
+// the server-managed private key, and only while a member of the network.
+// format selects the exporter (wg-quick by default) and name the interface
+// name written into it. The ETag follows the network's config version;
+// ?wait_for_version= long-polls for a newer one.
+func (h *PeersHandler) Config(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	peerID := mux.Vars(r)["id"]
+	format := r.URL.Query().Get("format")
+	name := r.URL.Query().Get("name")
+	if !exporter.Supported(format) { jsonError(w, "format must be one of "+strings.Join(exporter.Formats, ", "), http.StatusBadRequest); return }
+	if name == "" { name = exporter.DefaultInterface }
+	if !exporter.ValidInterfaceName(name) { jsonError(w, "name must be a valid interface name (up to 15 letters, digits or _=+.-)", http.StatusBadRequest); return }
+	self, err := getPeer(r.Context(), h.DB, peerID)
+	if err == sql.ErrNoRows { jsonError(w, "peer not found", http.StatusNotFound); return }
+	if err != nil { log.Printf("peer query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if self.UserID != userID { jsonError(w, "only the peer's owner can download its configuration", http.StatusForbidden); return }
+	if !h.stillMember(w, r, self.NetworkID, userID) { return }
+	version, done := currentVersion(w, r, h.DB, h.Broker, self.NetworkID)
+	if done { return }
+	// The wait may have outlasted the caller's membership.
+	if !h.stillMember(w, r, self.NetworkID, userID) { return }
+	if checkETag(w, r, fmt.Sprintf(`"v%d-%s-%s"`, version, format, name)) { return }
+	self, err = getPeer(r.Context(), h.DB, peerID)
+	if err == sql.ErrNoRows { jsonError(w, "peer not found", http.StatusNotFound); return }
+	if err != nil { log.Printf("peer query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	cfg, err := h.buildPeerConfig(r.Context(), self)
+	if err == errServerKeysDisabled { jsonError(w, "this configuration needs server-held keys but no master key is configured", http.StatusServiceUnavailable); return }
+	if err != nil { log.Printf("build config error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	doc, err := exporter.Render(format, name, cfg)
+	if err != nil { jsonError(w, err.Error(), http.StatusBadRequest); return }
+	w.Header().Set("Content-Type", doc.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, doc.Filename))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(doc.Body)
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	dbpkg "github.com/wgcloudctrl/server/db"
+	mw "github.com/wgcloudctrl/server/middleware"
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+// testDB opens TEST_DB_URL and migrates it, or skips the test.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DB_URL")
+	if dsn == "" { t.Skip("TEST_DB_URL not set") }
+	db, err := dbpkg.Open(dsn)
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() { db.Close() })
+	if err := dbpkg.Migrate(db); err != nil { t.Fatal(err) }
+	return db
+}
+
+// createUser inserts a user that is deleted, with everything it owns, when
+// the test ends.
+func createUser(t *testing.T, db *sql.DB) (id, email string) {
+	t.Helper()
+	b := make([]byte, 6)
+	rand.Read(b)
+	email = "test-" + hex.EncodeToString(b) + "@example.com"
+	if err := db.QueryRow("INSERT INTO users (email, password_hash) VALUES ($1, 'x') RETURNING id", email).Scan(&id); err != nil { t.Fatal(err) }
+	t.Cleanup(func() { db.Exec("DELETE FROM users WHERE id = $1", id) })
+	return id, email
+}
+
+// createNetwork inserts a network owned by ownerID with the given members,
+// keyed by user ID with their role.
+func createNetwork(t *testing.T, db *sql.DB, ownerID string, members map[string]string) string {
+	t.Helper()
+	var id string
+	if err := db.QueryRow("INSERT INTO networks (owner_id, name) VALUES ($1, 'test') RETURNING id", ownerID).Scan(&id); err != nil { t.Fatal(err) }
+	if _, err := db.Exec("INSERT INTO network_members (network_id, user_id, role) VALUES ($1, $2, 'owner')", id, ownerID); err != nil { t.Fatal(err) }
+	for userID, role := range members {
+		if _, err := db.Exec("INSERT INTO network_members (network_id, user_id, role) VALUES ($1, $2, $3)", id, userID, role); err != nil { t.Fatal(err) }
+	}
+	return id
+}
+
+// createPeer inserts a peer for userID with a fresh key at virtual IP ip.
+func createPeer(t *testing.T, db *sql.DB, netID, userID, ip string) string {
+	t.Helper()
+	_, pub, err := wireguard.GenerateKeyPair()
+	if err != nil { t.Fatal(err) }
+	var id string
+	if err := db.QueryRow("INSERT INTO peers (network_id, user_id, public_key, virtual_ip) VALUES ($1, $2, $3, $4) RETURNING id", netID, userID, pub.String(), ip).Scan(&id); err != nil { t.Fatal(err) }
+	return id
+}
+
+// asUser returns ctx as the auth middleware would set it for userID.
+func asUser(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, mw.ContextKeyUserID, userID)
+}
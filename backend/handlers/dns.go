@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	mw "github.com/wgcloudctrl/server/middleware"
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+// DNSConfig is the resolver configuration pushed to a network's peers.
+type DNSConfig struct {
+	Nameservers   []string   `json:"nameservers"`
+	SearchDomains []string   `json:"search_domains"`
+	Routes        []DNSRoute `json:"routes"`
+}
+
+// DNSRoute sends queries for Domain and its subdomains to Nameservers.
+type DNSRoute struct {
+	Domain      string   `json:"domain"`
+	Nameservers []string `json:"nameservers"`
+}
+
+const (
+	maxNameservers   = 8
+	maxSearchDomains = 16
+	maxDNSRoutes     = 32
+)
+
+func normalizeNameservers(list []string) ([]string, error) {
+	if len(list) > maxNameservers { return nil, fmt.Errorf("at most %d nameservers are allowed", maxNameservers) }
+	out := []string{}
+	for _, ns := range list {
+		ip := net.ParseIP(strings.TrimSpace(ns))
+		if ip == nil { return nil, fmt.Errorf("nameserver %q is not an IP address", ns) }
+		out = append(out, ip.String())
+	}
+	return out, nil
+}
+
+func normalizeDNSDomain(d string) (string, error) {
+	n := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+	if !wireguard.ValidHostname(n) { return "", fmt.Errorf("invalid domain %q", d) }
+	return n, nil
+}
+
+// Validate normalizes c in place.
+func (c *DNSConfig) Validate() error {
+	var err error
+	if c.Nameservers, err = normalizeNameservers(c.Nameservers); err != nil { return err }
+	if len(c.SearchDomains) > maxSearchDomains { return fmt.Errorf("at most %d search domains are allowed", maxSearchDomains) }
+	for i, d := range c.SearchDomains {
+		if c.SearchDomains[i], err = normalizeDNSDomain(d); err != nil { return err }
+	}
+	if c.SearchDomains == nil { c.SearchDomains = []string{} }
+	if len(c.Routes) > maxDNSRoutes { return fmt.Errorf("at most %d DNS routes are allowed", maxDNSRoutes) }
+	seen := map[string]bool{}
+	for i := range c.Routes {
+		rt := &c.Routes[i]
+		if rt.Domain, err = normalizeDNSDomain(rt.Domain); err != nil { return err }
+		if seen[rt.Domain] { return fmt.Errorf("duplicate route for %s", rt.Domain) }
+		seen[rt.Domain] = true
+		if len(rt.Nameservers) == 0 { return fmt.Errorf("route for %s needs at least one nameserver", rt.Domain) }
+		if rt.Nameservers, err = normalizeNameservers(rt.Nameservers); err != nil { return err }
+	}
+	if c.Routes == nil { c.Routes = []DNSRoute{} }
+	return nil
+}
+
+// loadDNSConfig returns the network's configured DNS settings (empty when
+// none are set) and its mesh DNS name.
+func loadDNSConfig(ctx context.Context, db *sql.DB, networkID string) (*DNSConfig, *string, error) {
+	var raw []byte
+	var dnsName *string
+	if err := db.QueryRowContext(ctx, "SELECT dns_config, dns_name FROM networks WHERE id = $1", networkID).Scan(&raw, &dnsName); err != nil { return nil, nil, err }
+	c := &DNSConfig{Nameservers: []string{}, SearchDomains: []string{}, Routes: []DNSRoute{}}
+	if raw != nil {
+		if err := json.Unmarshal(raw, c); err != nil { return nil, nil, err }
+	}
+	return c, dnsName, nil
+}
+
+// effectiveDNS is what peers of the network should use: the mesh resolver and
+// search domain (when mesh DNS is enabled) followed by the network's own
+// settings.
+func (h *PeersHandler) effectiveDNS(ctx context.Context, networkID string) (*DNSConfig, error) {
+	c, dnsName, err := loadDNSConfig(ctx, h.DB, networkID)
+	if err != nil { return nil, err }
+	if h.Cfg != nil && h.Cfg.MeshDNSAddress != "" {
+		c.Nameservers = append([]string{h.Cfg.MeshDNSAddress}, c.Nameservers...)
+		if dnsName != nil { c.SearchDomains = append([]string{*dnsName + "." + h.Cfg.MeshDNSZone}, c.SearchDomains...) }
+	}
+	return c, nil
+}
+
+// GET /api/networks/:id/dns
+func (h *NetworksHandler) GetDNS(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	netID := mux.Vars(r)["id"]
+	_, err := memberRole(r.Context(), h.DB, netID, userID)
+	if err == sql.ErrNoRows { jsonError(w, "not a member of this network", http.StatusForbidden); return }
+	if err != nil { log.Printf("member role error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	c, _, err := loadDNSConfig(r.Context(), h.DB, netID)
+	if err != nil { log.Printf("load dns config error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	jsonOK(w, http.StatusOK, c)
+}
+
+// PUT /api/networks/:id/dns
+func (h *NetworksHandler) UpdateDNS(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	netID := mux.Vars(r)["id"]
+	role, err := memberRole(r.Context(), h.DB, netID, userID)
+	if err == sql.ErrNoRows || (err == nil && !isNetworkAdmin(role)) { jsonError(w, "only network owners and admins can change DNS settings", http.StatusForbidden); return }
+	if err != nil { log.Printf("member role error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	var c DNSConfig
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
+	if err := c.Validate(); err != nil { jsonError(w, err.Error(), http.StatusBadRequest); return }
+	b, _ := json.Marshal(c)
+	_, err = h.DB.ExecContext(r.Context(), "UPDATE networks SET dns_config = $2, updated_at = NOW() WHERE id = $1", netID, string(b))
+	if err != nil { log.Printf("update dns config error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	logActivity(h.DB, netID, userID, "dns_config_updated", map[string]interface{}{"dns": c})
+	publishPeers(h.DB, h.Broker, netID, "network_updated", peerChange{})
+	jsonOK(w, http.StatusOK, c)
+}
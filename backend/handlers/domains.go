@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	mw "github.com/wgcloudctrl/server/middleware"
+)
+
+// A domain in allowed_domains only admits users automatically, or with
+// domain_join_role, once the owner has proved control of it by publishing a
+// TXT record. Until then it merely suggests the network to users of the
+// domain (GET /networks/joinable), who join as plain members if they choose.
+
+const (
+	domainChallengeLabel  = "_wgctrl-challenge."
+	domainChallengePrefix = "wgctrl-verify="
+)
+
+// lookupTXT resolves TXT records; tests replace it.
+var lookupTXT = net.DefaultResolver.LookupTXT
+
+type DomainStatus struct {
+	Domain     string     `json:"domain"`
+	Verified   bool       `json:"verified"`
+	VerifiedAt *time.Time `json:"verified_at"`
+	// RecordName and RecordValue are the TXT record proving control.
+	RecordName  string `json:"record_name"`
+	RecordValue string `json:"record_value"`
+}
+
+// domainChallenge returns the TXT record the owner publishes for domain.
+func domainChallenge(domain, token string) (name, value string) {
+	return domainChallengeLabel + domain, domainChallengePrefix + token
+}
+
+// challengeMet reports whether one of the TXT records found is value.
+func challengeMet(records []string, value string) bool {
+	for _, r := range records {
+		if strings.TrimSpace(r) == value { return true }
+	}
+	return false
+}
+
+// syncDomainChallenges gives every domain in the list a challenge token and
+// drops the verification of domains no longer listed, so removing a domain
+// and adding it back needs a fresh proof.
+func syncDomainChallenges(ctx context.Context, db *sql.DB, netID string, domains []string) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM network_domains WHERE network_id = $1 AND NOT (domain = ANY($2))", netID, pq.Array(domains)); err != nil { return err }
+	for _, d := range domains {
+		token, err := generateToken()
+		if err != nil { return err }
+		if _, err := db.ExecContext(ctx, "INSERT INTO network_domains (network_id, domain, token) VALUES ($1, $2, $3) ON CONFLICT (network_id, domain) DO NOTHING", netID, d, token); err != nil { return err }
+	}
+	return nil
+}
+
+// ownsNetwork answers for the caller and returns false unless they own netID.
+func ownsNetwork(w http.ResponseWriter, r *http.Request, db *sql.DB, netID, userID string) bool {
+	var one int
+	err := db.QueryRowContext(r.Context(), "SELECT 1 FROM networks WHERE id = $1 AND owner_id = $2", netID, userID).Scan(&one)
+	if err == sql.ErrNoRows { jsonError(w, "network not found or not owner", http.StatusNotFound); return false }
+	if err != nil { log.Printf("owner check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return false }
+	return true
+}
+
+// GET /api/networks/:id/domains (owner only)
+func (h *NetworksHandler) ListDomains(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	netID := mux.Vars(r)["id"]
+	if !ownsNetwork(w, r, h.DB, netID, userID) { return }
+	rows, err := h.DB.QueryContext(r.Context(), "SELECT domain, token, verified_at FROM network_domains WHERE network_id = $1 ORDER BY domain", netID)
+	if err != nil { log.Printf("list domains error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	defer rows.Close()
+	out := []DomainStatus{}
+	for rows.Next() {
+		var d DomainStatus
+		var token string
+		if err := rows.Scan(&d.Domain, &token, &d.VerifiedAt); err != nil { log.Printf("scan domain error: %v", err); continue }
+		d.Verified = d.VerifiedAt != nil
+		d.RecordName, d.RecordValue = domainChallenge(d.Domain, token)
+		out = append(out, d)
+	}
+	jsonOK(w, http.StatusOK, out)
+}
+
+// POST /api/networks/:id/domains/:domain/verify (owner only)
+func (h *NetworksHandler) VerifyDomain(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	netID := mux.Vars(r)["id"]
+	domain, ok := normalizeDomain(mux.Vars(r)["domain"])
+	if !ok { jsonError(w, "invalid domain", http.StatusBadRequest); return }
+	if !ownsNetwork(w, r, h.DB, netID, userID) { return }
+	var d DomainStatus
+	var token string
+	err := h.DB.QueryRowContext(r.Context(), "SELECT domain, token, verified_at FROM network_domains WHERE network_id = $1 AND domain = $2", netID, domain).Scan(&d.Domain, &token, &d.VerifiedAt)
+	if err == sql.ErrNoRows { jsonError(w, "domain is not in allowed_domains", http.StatusNotFound); return }
+	if err != nil { log.Printf("domain query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	d.RecordName, d.RecordValue = domainChallenge(d.Domain, token)
+	if d.VerifiedAt == nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		records, err := lookupTXT(ctx, d.RecordName)
+		cancel()
+		if err != nil || !challengeMet(records, d.RecordValue) { jsonError(w, "TXT record "+d.RecordName+" with value "+d.RecordValue+" not found", http.StatusConflict); return }
+		err = h.DB.QueryRowContext(r.Context(), "UPDATE network_domains SET verified_at = NOW() WHERE network_id = $1 AND domain = $2 RETURNING verified_at", netID, domain).Scan(&d.VerifiedAt)
+		if err != nil { log.Printf("verify domain error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+		logActivity(h.DB, netID, userID, "domain_verified", map[string]interface{}{"domain": domain})
+	}
+	d.Verified = true
+	jsonOK(w, http.StatusOK, d)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+func TestChallengeMet(t *testing.T) {
+	name, value := domainChallenge("corp.example", "tok")
+	if name != "_wgctrl-challenge.corp.example" || value != "wgctrl-verify=tok" { t.Fatalf("domainChallenge = %q, %q", name, value) }
+	tests := []struct {
+		records []string
+		want    bool
+	}{
+		{nil, false},
+		{[]string{"v=spf1 -all"}, false},
+		{[]string{"v=spf1 -all", " wgctrl-verify=tok "}, true},
+		{[]string{"wgctrl-verify=tok2"}, false},
+		{[]string{"wgctrl-verify="}, false},
+	}
+	for _, tt := range tests {
+		if got := challengeMet(tt.records, value); got != tt.want { t.Errorf("challengeMet(%q) = %v, want %v", tt.records, got, tt.want) }
+	}
+}
+
+func TestDomainAutoJoinNeedsVerification(t *testing.T) {
+	db := testDB(t)
+	owner, _ := createUser(t, db)
+	netID := createNetwork(t, db, owner, nil)
+	// A domain of its own, so no other test user is involved.
+	domain := netID[:8] + ".example.com"
+	var userID string
+	if err := db.QueryRow("INSERT INTO users (email, password_hash, email_verified_at) VALUES ($1, 'x', NOW()) RETURNING id", "someone@"+domain).Scan(&userID); err != nil { t.Fatal(err) }
+	t.Cleanup(func() { db.Exec("DELETE FROM users WHERE id = $1", userID) })
+	if _, err := db.Exec("UPDATE networks SET allowed_domains = $2, domain_auto_join = TRUE, domain_join_role = 'admin' WHERE id = $1", netID, pq.Array([]string{domain})); err != nil { t.Fatal(err) }
+	if err := syncDomainChallenges(context.Background(), db, netID, []string{domain}); err != nil { t.Fatal(err) }
+
+	if joined := applyDomainAutoJoin(context.Background(), db, userID, "someone@"+domain); len(joined) != 0 { t.Fatalf("joined %v through an unverified domain", joined) }
+
+	h := &NetworksHandler{DB: db}
+	verify := func(records []string) int {
+		lookupTXT = func(ctx context.Context, name string) ([]string, error) { return records, nil }
+		req := httptest.NewRequest("POST", "/", nil)
+		req = mux.SetURLVars(req.WithContext(asUser(req.Context(), owner)), map[string]string{"id": netID, "domain": domain})
+		rec := httptest.NewRecorder()
+		h.VerifyDomain(rec, req)
+		return rec.Code
+	}
+	defer func(orig func(context.Context, string) ([]string, error)) { lookupTXT = orig }(lookupTXT)
+	if code := verify([]string{"wgctrl-verify=wrong"}); code != http.StatusConflict { t.Fatalf("wrong TXT value: status %d, want 409", code) }
+	var token string
+	if err := db.QueryRow("SELECT token FROM network_domains WHERE network_id = $1 AND domain = $2", netID, domain).Scan(&token); err != nil { t.Fatal(err) }
+	_, value := domainChallenge(domain, token)
+	if code := verify([]string{value}); code != http.StatusOK { t.Fatalf("verify: status %d", code) }
+
+	joined := applyDomainAutoJoin(context.Background(), db, userID, "someone@"+domain)
+	if len(joined) != 1 || joined[0] != netID { t.Fatalf("joined %v after verification, want [%s]", joined, netID) }
+	if role, err := memberRole(context.Background(), db, netID, userID); err != nil || role != "admin" { t.Errorf("role = %q, %v; want admin", role, err) }
+
+	// Removing the domain drops its verification.
+	if err := syncDomainChallenges(context.Background(), db, netID, nil); err != nil { t.Fatal(err) }
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM network_domains WHERE network_id = $1", netID).Scan(&n)
+	if n != 0 { t.Errorf("%d domain rows left after removing the domain", n) }
+}
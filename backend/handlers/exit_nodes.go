@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/wgcloudctrl/server/sse"
+	mw "github.com/wgcloudctrl/server/middleware"
+)
+
+// Exit node states of a peer. Only approved exit nodes can be selected.
+const (
+	exitNodeNone     = "none"
+	exitNodeOffered  = "offered"
+	exitNodeApproved = "approved"
+)
+
+// fullTunnel is the AllowedIPs set on the selected exit node.
+var fullTunnel = []string{"0.0.0.0/0", "::/0"}
+
+// POST /api/peers/:id/exit-node
+// Offers the peer as an exit node, pending admin approval.
+func (h *RoutesHandler) OfferExitNode(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	peerID := mux.Vars(r)["id"]
+	networkID, code, err := authorizePeer(r.Context(), h.DB, peerID, userID)
+	if code == http.StatusInternalServerError { log.Printf("peer auth error: %v", err); jsonError(w, "internal error", code); return }
+	if err != nil { jsonError(w, err.Error(), code); return }
+	res, err := h.DB.ExecContext(r.Context(), "UPDATE peers SET exit_node = $2 WHERE id = $1 AND exit_node = $3", peerID, exitNodeOffered, exitNodeNone)
+	if err != nil { log.Printf("offer exit node error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if n, _ := res.RowsAffected(); n == 0 { jsonError(w, "peer is already offered as an exit node", http.StatusConflict); return }
+	logActivity(h.DB, networkID, userID, "exit_node_offered", map[string]interface{}{"peer_id": peerID})
+	h.Broker.PublishToNetwork(networkID, "admin", sse.Event{Type: "exit_node_offered", Payload: map[string]string{"peer_id": peerID}})
+	jsonOK(w, http.StatusOK, map[string]string{"exit_node": exitNodeOffered})
+}
+
+// POST /api/peers/:id/exit-node/approve
+func (h *RoutesHandler) ApproveExitNode(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	peerID := mux.Vars(r)["id"]
+	var networkID string
+	err := h.DB.QueryRowContext(r.Context(), "SELECT network_id FROM peers WHERE id = $1", peerID).Scan(&networkID)
+	if err == sql.ErrNoRows { jsonError(w, "peer not found", http.StatusNotFound); return }
+	if err != nil { log.Printf("peer query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	role, err := memberRole(r.Context(), h.DB, networkID, userID)
+	if err == sql.ErrNoRows || (err == nil && !isNetworkAdmin(role)) { jsonError(w, "only network owners and admins can approve exit nodes", http.StatusForbidden); return }
+	if err != nil { log.Printf("member role error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	res, err := h.DB.ExecContext(r.Context(), "UPDATE peers SET exit_node = $2 WHERE id = $1 AND exit_node = $3", peerID, exitNodeApproved, exitNodeOffered)
+	if err != nil { log.Printf("approve exit node error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if n, _ := res.RowsAffected(); n == 0 { jsonError(w, "peer has no pending exit node offer", http.StatusConflict); return }
+	logActivity(h.DB, networkID, userID, "exit_node_approved", map[string]interface{}{"peer_id": peerID})
+	h.routesChanged(networkID, peerID)
+	jsonOK(w, http.StatusOK, map[string]string{"exit_node": exitNodeApproved})
+}
+
+// DELETE /api/peers/:id/exit-node
+// Withdraws an offer or approval. Peers that had selected this exit node fall
+// back to split tunnelling.
+func (h *RoutesHandler) WithdrawExitNode(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	peerID := mux.Vars(r)["id"]
+	networkID, code, err := authorizePeer(r.Context(), h.DB, peerID, userID)
+	if code == http.StatusInternalServerError { log.Printf("peer auth error: %v", err); jsonError(w, "internal error", code); return }
+	if err != nil { jsonError(w, err.Error(), code); return }
+	tx, err := h.DB.BeginTx(r.Context(), nil)
+	if err != nil { log.Printf("begin tx error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	defer tx.Rollback()
+	res, err := tx.ExecContext(r.Context(), "UPDATE peers SET exit_node = $2 WHERE id = $1 AND exit_node <> $2", peerID, exitNodeNone)
+	if err != nil { log.Printf("withdraw exit node error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if n, _ := res.RowsAffected(); n == 0 { jsonError(w, "peer is not an exit node", http.StatusConflict); return }
+	rows, err := tx.QueryContext(r.Context(), "UPDATE peers SET exit_node_id = NULL WHERE exit_node_id = $1 RETURNING id", peerID)
+	if err != nil { log.Printf("clear exit node selections error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	changed := []string{peerID}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil { changed = append(changed, id) }
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil { log.Printf("clear exit node selections error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	cleared := len(changed) - 1
+	if err := tx.Commit(); err != nil { log.Printf("commit error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	logActivity(h.DB, networkID, userID, "exit_node_withdrawn", map[string]interface{}{"peer_id": peerID, "selections_cleared": cleared})
+	h.routesChanged(networkID, changed...)
+	jsonOK(w, http.StatusOK, map[string]string{"exit_node": exitNodeNone})
+}
+
+// PUT /api/peers/:id/exit-node-selection
+// Selects (or with null clears) the exit node that carries all of the peer's
+// internet traffic. Only the peer's owner may choose.
+func (h *RoutesHandler) SelectExitNode(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	peerID := mux.Vars(r)["id"]
+	var req struct { ExitNodeID *string `json:"exit_node_id"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
+	var networkID, ownerID string
+	err := h.DB.QueryRowContext(r.Context(), "SELECT network_id, user_id FROM peers WHERE id = $1", peerID).Scan(&networkID, &ownerID)
+	if err == sql.ErrNoRows { jsonError(w, "peer not found", http.StatusNotFound); return }
+	if err != nil { log.Printf("peer query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if ownerID != userID { jsonError(w, "only the peer's owner can select its exit node", http.StatusForbidden); return }
+	if req.ExitNodeID != nil {
+		if *req.ExitNodeID == peerID { jsonError(w, "a peer cannot be its own exit node", http.StatusBadRequest); return }
+		var status string
+		var quarantined bool
+		err := h.DB.QueryRowContext(r.Context(), "SELECT exit_node, quarantined FROM peers WHERE id = $1 AND network_id = $2", *req.ExitNodeID, networkID).Scan(&status, &quarantined)
+		if err == sql.ErrNoRows { jsonError(w, "exit_node_id must be a peer in this network", http.StatusBadRequest); return }
+		if err != nil { log.Printf("exit node query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+		if status != exitNodeApproved || quarantined { jsonError(w, "that peer is not an approved exit node", http.StatusBadRequest); return }
+	}
+	_, err = h.DB.ExecContext(r.Context(), "UPDATE peers SET exit_node_id = $2 WHERE id = $1", peerID, req.ExitNodeID)
+	if err != nil { log.Printf("select exit node error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	logActivity(h.DB, networkID, userID, "exit_node_selected", map[string]interface{}{"peer_id": peerID, "exit_node_id": req.ExitNodeID})
+	h.routesChanged(networkID, peerID)
+	jsonOK(w, http.StatusOK, map[string]interface{}{"exit_node_id": req.ExitNodeID})
+}
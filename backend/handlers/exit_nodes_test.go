@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/wgcloudctrl/server/sse"
+)
+
+func TestSelectExitNode(t *testing.T) {
+	db := testDB(t)
+	owner, _ := createUser(t, db)
+	member, _ := createUser(t, db)
+	netID := createNetwork(t, db, owner, map[string]string{member: "member"})
+	otherNet := createNetwork(t, db, owner, nil)
+	self := createPeer(t, db, netID, member, "10.10.0.2")
+	approved := createPeer(t, db, netID, owner, "10.10.0.3")
+	offered := createPeer(t, db, netID, owner, "10.10.0.4")
+	quarantined := createPeer(t, db, netID, owner, "10.10.0.5")
+	foreign := createPeer(t, db, otherNet, owner, "10.10.0.2")
+	if _, err := db.Exec("UPDATE peers SET exit_node = 'approved' WHERE id IN ($1, $2, $3)", approved, quarantined, foreign); err != nil { t.Fatal(err) }
+	if _, err := db.Exec("UPDATE peers SET exit_node = 'offered' WHERE id = $1", offered); err != nil { t.Fatal(err) }
+	if _, err := db.Exec("UPDATE peers SET quarantined = TRUE WHERE id = $1", quarantined); err != nil { t.Fatal(err) }
+	h := &RoutesHandler{DB: db, Broker: sse.NewBroker()}
+	selected := func() *string {
+		var id *string
+		if err := db.QueryRow("SELECT exit_node_id FROM peers WHERE id = $1", self).Scan(&id); err != nil { t.Fatal(err) }
+		return id
+	}
+
+	tests := []struct {
+		name, user, body string
+		want             int
+	}{
+		{"not the peer's owner", owner, `{"exit_node_id":"` + approved + `"}`, http.StatusForbidden},
+		{"itself", member, `{"exit_node_id":"` + self + `"}`, http.StatusBadRequest},
+		{"only offered", member, `{"exit_node_id":"` + offered + `"}`, http.StatusBadRequest},
+		{"quarantined", member, `{"exit_node_id":"` + quarantined + `"}`, http.StatusBadRequest},
+		{"another network", member, `{"exit_node_id":"` + foreign + `"}`, http.StatusBadRequest},
+		{"not a peer", member, `{"exit_node_id":"00000000-0000-0000-0000-000000000000"}`, http.StatusBadRequest},
+		{"malformed body", member, `{"exit_node_id":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/api/peers/"+self+"/exit-node-selection", strings.NewReader(tt.body))
+			req = mux.SetURLVars(req.WithContext(asUser(req.Context(), tt.user)), map[string]string{"id": self})
+			rec := httptest.NewRecorder()
+			h.SelectExitNode(rec, req)
+			if rec.Code != tt.want { t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body) }
+			if id := selected(); id != nil { t.Errorf("exit_node_id = %s after a refused selection", *id) }
+		})
+	}
+
+	put := func(body string) int {
+		req := httptest.NewRequest("PUT", "/api/peers/"+self+"/exit-node-selection", strings.NewReader(body))
+		req = mux.SetURLVars(req.WithContext(asUser(req.Context(), member)), map[string]string{"id": self})
+		rec := httptest.NewRecorder()
+		h.SelectExitNode(rec, req)
+		return rec.Code
+	}
+	if code := put(`{"exit_node_id":"` + approved + `"}`); code != http.StatusOK { t.Fatalf("select an approved exit node: status %d", code) }
+	if id := selected(); id == nil || *id != approved { t.Errorf("exit_node_id = %v, want %s", id, approved) }
+	if code := put(`{"exit_node_id":null}`); code != http.StatusOK { t.Fatalf("clear the selection: status %d", code) }
+	if id := selected(); id != nil { t.Errorf("exit_node_id = %s after clearing", *id) }
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	mw "github.com/wgcloudctrl/server/middleware"
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+// InterfaceSettings are the tunable [Interface] parameters of a device
+// config. A network holds the defaults and each peer may override them
+// field by field; nil means "not set here".
+type InterfaceSettings struct {
+	MTU                 *int     `json:"mtu"`
+	ListenPort          *int     `json:"listen_port"`
+	PersistentKeepalive *int     `json:"persistent_keepalive"`
+	FwMark              *int64   `json:"fwmark"`
+	Table               *string  `json:"table"`
+	PostUp              []string `json:"post_up"`
+	PostDown            []string `json:"post_down"`
+}
+
+const (
+	minMTU          = 1280 // smallest MTU that still carries IPv6
+	maxMTU          = 9000
+	maxHookCommands = 8
+	maxHookLength   = 1024
+)
+
+func validateHooks(name string, cmds []string) error {
+	if len(cmds) > maxHookCommands { return fmt.Errorf("%s allows at most %d commands", name, maxHookCommands) }
+	for _, c := range cmds {
+		if strings.TrimSpace(c) == "" { return fmt.Errorf("%s commands must not be empty", name) }
+		if len(c) > maxHookLength { return fmt.Errorf("%s commands must be at most %d characters", name, maxHookLength) }
+		if strings.ContainsAny(c, "\r\n\x00") { return fmt.Errorf("%s commands must be a single line", name) }
+	}
+	return nil
+}
+
+// Validate checks value ranges and normalizes Table.
+func (s *InterfaceSettings) Validate() error {
+	if s.MTU != nil && (*s.MTU < minMTU || *s.MTU > maxMTU) { return fmt.Errorf("mtu must be between %d and %d", minMTU, maxMTU) }
+	if s.ListenPort != nil && (*s.ListenPort < 1 || *s.ListenPort > 65535) { return fmt.Errorf("listen_port must be between 1 and 65535") }
+	if s.PersistentKeepalive != nil && (*s.PersistentKeepalive < 0 || *s.PersistentKeepalive > 65535) { return fmt.Errorf("persistent_keepalive must be between 0 (off) and 65535 seconds") }
+	if s.FwMark != nil && (*s.FwMark < 0 || *s.FwMark > math.MaxUint32) { return fmt.Errorf("fwmark must be between 0 (off) and %d", uint32(math.MaxUint32)) }
+	if s.Table != nil {
+		t := strings.ToLower(strings.TrimSpace(*s.Table))
+		if t != "off" && t != "auto" {
+			n, err := strconv.ParseUint(t, 10, 32)
+			if err != nil || n == 0 { return fmt.Errorf("table must be off, auto or a routing table number") }
+			t = strconv.FormatUint(n, 10)
+		}
+		s.Table = &t
+	}
+	if err := validateHooks("post_up", s.PostUp); err != nil { return err }
+	return validateHooks("post_down", s.PostDown)
+}
+
+// hasHooks reports whether s sets PostUp or PostDown. Hooks run as root on
+// the device, so only network owners and admins may set them.
+func (s *InterfaceSettings) hasHooks() bool { return s.PostUp != nil || s.PostDown != nil }
+
+// merge returns the network defaults s overlaid with the peer's overrides.
+func (s InterfaceSettings) merge(o *InterfaceSettings) InterfaceSettings {
+	if o == nil { return s }
+	if o.MTU != nil { s.MTU = o.MTU }
+	if o.ListenPort != nil { s.ListenPort = o.ListenPort }
+	if o.PersistentKeepalive != nil { s.PersistentKeepalive = o.PersistentKeepalive }
+	if o.FwMark != nil { s.FwMark = o.FwMark }
+	if o.Table != nil { s.Table = o.Table }
+	if o.PostUp != nil { s.PostUp = o.PostUp }
+	if o.PostDown != nil { s.PostDown = o.PostDown }
+	return s
+}
+
+// keepalive is the PersistentKeepalive to use towards every peer.
+func (s InterfaceSettings) keepalive() int {
+	if s.PersistentKeepalive != nil { return *s.PersistentKeepalive }
+	return defaultKeepalive
+}
+
+// apply copies the settings into a rendered [Interface] section.
+func (s InterfaceSettings) apply(iface *wireguard.Interface) {
+	if s.MTU != nil { iface.MTU = *s.MTU }
+	if s.ListenPort != nil { iface.ListenPort = *s.ListenPort }
+	if s.FwMark != nil { iface.FwMark = uint32(*s.FwMark) }
+	if s.Table != nil { iface.Table = *s.Table }
+	iface.PostUp, iface.PostDown = s.PostUp, s.PostDown
+}
+
+func decodeInterfaceSettings(raw []byte) (*InterfaceSettings, error) {
+	s := &InterfaceSettings{}
+	if raw == nil { return s, nil }
+	if err := json.Unmarshal(raw, s); err != nil { return nil, err }
+	return s, nil
+}
+
+// loadInterfaceSettings returns the network defaults and the peer's own
+// overrides.
+func loadInterfaceSettings(ctx context.Context, db *sql.DB, peerID string) (network, peer *InterfaceSettings, err error) {
+	var netRaw, peerRaw []byte
+	err = db.QueryRowContext(ctx, "SELECT n.interface_settings, p.interface_settings FROM peers p JOIN networks n ON n.id = p.network_id WHERE p.id = $1", peerID).Scan(&netRaw, &peerRaw)
+	if err != nil { return nil, nil, err }
+	if network, err = decodeInterfaceSettings(netRaw); err != nil { return nil, nil, err }
+	if peer, err = decodeInterfaceSettings(peerRaw); err != nil { return nil, nil, err }
+	return network, peer, nil
+}
+
+// GET /api/networks/:id/interface
+func (h *NetworksHandler) GetInterface(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	netID := mux.Vars(r)["id"]
+	_, err := memberRole(r.Context(), h.DB, netID, userID)
+	if err == sql.ErrNoRows { jsonError(w, "not a member of this network", http.StatusForbidden); return }
+	if err != nil { log.Printf("member role error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	var raw []byte
+	if err := h.DB.QueryRowContext(r.Context(), "SELECT interface_settings FROM networks WHERE id = $1", netID).Scan(&raw); err != nil { log.Printf("interface settings query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	s, err := decodeInterfaceSettings(raw)
+	if err != nil { log.Printf("decode interface settings error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	jsonOK(w, http.StatusOK, s)
+}
+
+// PUT /api/networks/:id/interface
+// Replaces the network's defaults. Owners and admins only.
+func (h *NetworksHandler) UpdateInterface(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	netID := mux.Vars(r)["id"]
+	role, err := memberRole(r.Context(), h.DB, netID, userID)
+	if err == sql.ErrNoRows || (err == nil && !isNetworkAdmin(role)) { jsonError(w, "only network owners and admins can change interface settings", http.StatusForbidden); return }
+	if err != nil { log.Printf("member role error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	var s InterfaceSettings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
+	if err := s.Validate(); err != nil { jsonError(w, err.Error(), http.StatusBadRequest); return }
+	b, _ := json.Marshal(s)
+	_, err = h.DB.ExecContext(r.Context(), "UPDATE networks SET interface_settings = $2, updated_at = NOW() WHERE id = $1", netID, string(b))
+	if err != nil { log.Printf("update interface settings error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	logActivity(h.DB, netID, userID, "interface_settings_updated", map[string]interface{}{"settings": s})
+	publishPeers(h.DB, h.Broker, netID, "network_updated", peerChange{})
+	jsonOK(w, http.StatusOK, s)
+}
+
+// GET /api/peers/:id/interface
+// Returns the peer's overrides and the settings its config is rendered with.
+func (h *PeersHandler) GetInterface(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	peerID := mux.Vars(r)["id"]
+	_, code, err := authorizePeer(r.Context(), h.DB, peerID, userID)
+	if code == http.StatusInternalServerError { log.Printf("peer auth error: %v", err); jsonError(w, "internal error", code); return }
+	if err != nil { jsonError(w, err.Error(), code); return }
+	network, peer, err := loadInterfaceSettings(r.Context(), h.DB, peerID)
+	if err != nil { log.Printf("load interface settings error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	jsonOK(w, http.StatusOK, map[string]interface{}{"overrides": peer, "effective": network.merge(peer)})
+}
+
+// PUT /api/peers/:id/interface
+// Replaces the peer's overrides. The peer's owner may change everything but
+// the PostUp/PostDown hooks, which stay as an admin left them.
+func (h *PeersHandler) UpdateInterface(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	peerID := mux.Vars(r)["id"]
+	var s InterfaceSettings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
+	if err := s.Validate(); err != nil { jsonError(w, err.Error(), http.StatusBadRequest); return }
+	networkID, code, err := authorizePeer(r.Context(), h.DB, peerID, userID)
+	if code == http.StatusInternalServerError { log.Printf("peer auth error: %v", err); jsonError(w, "internal error", code); return }
+	if err != nil { jsonError(w, err.Error(), code); return }
+	role, err := memberRole(r.Context(), h.DB, networkID, userID)
+	if err != nil && err != sql.ErrNoRows { log.Printf("member role error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if !isNetworkAdmin(role) {
+		if s.hasHooks() { jsonError(w, "only network owners and admins can set post_up and post_down", http.StatusForbidden); return }
+		_, current, err := loadInterfaceSettings(r.Context(), h.DB, peerID)
+		if err != nil { log.Printf("load interface settings error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+		s.PostUp, s.PostDown = current.PostUp, current.PostDown
+	}
+	b, _ := json.Marshal(s)
+	_, err = h.DB.ExecContext(r.Context(), "UPDATE peers SET interface_settings = $2 WHERE id = $1", peerID, string(b))
+	if err != nil { log.Printf("update peer interface settings error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	logActivity(h.DB, networkID, userID, "peer_interface_updated", map[string]interface{}{"peer_id": peerID, "settings": s})
+	publishPeers(h.DB, h.Broker, networkID, "peer_updated", peerChange{Updated: []string{peerID}})
+	jsonOK(w, http.StatusOK, s)
+}
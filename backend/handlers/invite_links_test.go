@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOnlyAdminsCreateAutoApprovingLinks(t *testing.T) {
+	db := testDB(t)
+	owner, _ := createUser(t, db)
+	member, _ := createUser(t, db)
+	netID := createNetwork(t, db, owner, map[string]string{member: "member"})
+	h := &InviteLinksHandler{DB: db}
+	create := func(userID, extra string) (int, InviteLink) {
+		req := httptest.NewRequest("POST", "/api/invite-links", strings.NewReader(`{"network_id":"`+netID+`"`+extra+`}`))
+		req = req.WithContext(asUser(req.Context(), userID))
+		rec := httptest.NewRecorder()
+		h.Create(rec, req)
+		var link InviteLink
+		if rec.Code == http.StatusCreated {
+			if err := json.NewDecoder(rec.Body).Decode(&link); err != nil { t.Fatal(err) }
+		}
+		return rec.Code, link
+	}
+
+	if code, _ := create(member, `,"auto_approve":true`); code != http.StatusForbidden { t.Errorf("member asks for auto_approve: status %d, want 403", code) }
+	if code, link := create(member, ""); code != http.StatusCreated || link.AutoApprove { t.Errorf("member default: status %d, auto_approve %v, want 201 and false", code, link.AutoApprove) }
+	if code, link := create(member, `,"auto_approve":false`); code != http.StatusCreated || link.AutoApprove { t.Errorf("member without auto_approve: status %d, auto_approve %v", code, link.AutoApprove) }
+	if code, link := create(owner, ""); code != http.StatusCreated || !link.AutoApprove { t.Errorf("owner default: status %d, auto_approve %v, want 201 and true", code, link.AutoApprove) }
+	if code, link := create(owner, `,"auto_approve":false`); code != http.StatusCreated || link.AutoApprove { t.Errorf("owner without auto_approve: status %d, auto_approve %v", code, link.AutoApprove) }
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/wgcloudctrl/server/sse"
+	mw "github.com/wgcloudctrl/server/middleware"
+)
+
+type JoinRequestsHandler struct { DB *sql.DB; Broker *sse.Broker }
+
+// JoinRequest is a pending or decided request to join a network through an
+// invite link that requires approval.
+type JoinRequest struct {
+	ID        string     `json:"id"`
+	NetworkID string     `json:"network_id"`
+	LinkID    *string    `json:"link_id"`
+	UserID    string     `json:"user_id"`
+	Email     string     `json:"email"`
+	Role      string     `json:"role"`
+	Status    string     `json:"status"`
+	DecidedBy *string    `json:"decided_by"`
+	DecidedAt *time.Time `json:"decided_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// GET /api/networks/:id/join-requests?status=pending
+func (h *JoinRequestsHandler) List(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	netID := mux.Vars(r)["id"]
+	role, err := memberRole(r.Context(), h.DB, netID, userID)
+	if err == sql.ErrNoRows { jsonError(w, "not a member of this network", http.StatusForbidden); return }
+	if err != nil { log.Printf("member check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if !isNetworkAdmin(role) { jsonError(w, "only owners and admins can view join requests", http.StatusForbidden); return }
+	status := strings.TrimSpace(r.URL.Query().Get("status"))
+	if status != "" && status != "pending" && status != "approved" && status != "denied" { jsonError(w, "invalid status filter", http.StatusBadRequest); return }
+	rows, err := h.DB.QueryContext(r.Context(),
+		"SELECT jr.id, jr.network_id, jr.link_id, jr.user_id, u.email, jr.role, jr.status, jr.decided_by, jr.decided_at, jr.created_at FROM join_requests jr JOIN users u ON u.id = jr.user_id WHERE jr.network_id = $1 AND ($2 = '' OR jr.status = $2) ORDER BY jr.created_at DESC",
+		netID, status)
+	if err != nil { log.Printf("list join requests error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	defer rows.Close()
+	var out []JoinRequest
+	for rows.Next() {
+		var jr JoinRequest
+		if err := rows.Scan(&jr.ID, &jr.NetworkID, &jr.LinkID, &jr.UserID, &jr.Email, &jr.Role, &jr.Status, &jr.DecidedBy, &jr.DecidedAt, &jr.CreatedAt); err != nil { log.Printf("scan join request error: %v", err); continue }
+		out = append(out, jr)
+	}
+	if out == nil { out = []JoinRequest{} }
+	jsonOK(w, http.StatusOK, out)
+}
+
+// POST /api/join-requests/:id/approve
+func (h *JoinRequestsHandler) Approve(w http.ResponseWriter, r *http.Request) { h.decide(w, r, true) }
+
+// POST /api/join-requests/:id/deny
+func (h *JoinRequestsHandler) Deny(w http.ResponseWriter, r *http.Request) { h.decide(w, r, false) }
+
+func (h *JoinRequestsHandler) decide(w http.ResponseWriter, r *http.Request, approve bool) {
+	deciderID := mw.UserIDFromContext(r.Context())
+	reqID := mux.Vars(r)["id"]
+	var networkID string
+	err := h.DB.QueryRowContext(r.Context(), "SELECT network_id FROM join_requests WHERE id = $1", reqID).Scan(&networkID)
+	if err == sql.ErrNoRows { jsonError(w, "join request not found", http.StatusNotFound); return }
+	if err != nil { log.Printf("join request query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	role, err := memberRole(r.Context(), h.DB, networkID, deciderID)
+	if err != nil && err != sql.ErrNoRows { log.Printf("member check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if !isNetworkAdmin(role) { jsonError(w, "only owners and admins can decide join requests", http.StatusForbidden); return }
+	status := "denied"
+	if approve { status = "approved" }
+	tx, err := h.DB.BeginTx(r.Context(), nil)
+	if err != nil { log.Printf("begin tx error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	defer tx.Rollback()
+	var userID, grantRole string
+	err = tx.QueryRowContext(r.Context(),
+		"UPDATE join_requests SET status = $1, decided_by = $2, decided_at = NOW() WHERE id = $3 AND status = 'pending' RETURNING user_id, role",
+		status, deciderID, reqID).Scan(&userID, &grantRole)
+	if err == sql.ErrNoRows { jsonError(w, "join request is no longer pending", http.StatusConflict); return }
+	if err != nil { log.Printf("update join request error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if approve {
+		_, err = tx.ExecContext(r.Context(), "INSERT INTO network_members (network_id, user_id, role) VALUES ($1,$2,$3) ON CONFLICT (network_id, user_id) DO NOTHING", networkID, userID, grantRole)
+		if err != nil { log.Printf("add member via join request error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	}
+	if err := tx.Commit(); err != nil { log.Printf("commit join decision error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	logActivity(h.DB, networkID, deciderID, "join_request_"+status, map[string]interface{}{"join_request_id": reqID, "user_id": userID, "role": grantRole})
+	h.Broker.PublishToUser(userID, sse.Event{Type: "join_request_" + status, Payload: map[string]string{"join_request_id": reqID, "network_id": networkID}})
+	if approve {
+		publishPeers(h.DB, h.Broker, networkID, "member_joined", peerChange{})
+	}
+	jsonOK(w, http.StatusOK, map[string]string{"status": status})
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/wgcloudctrl/server/keystore"
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+// Peer key modes. In client mode the device generates its own keypair and
+// only the public key is registered; in server mode the server generates the
+// keypair and keeps the private key envelope-encrypted in peer_private_keys.
+const (
+	keyModeClient = "client"
+	keyModeServer = "server"
+)
+
+var errServerKeysDisabled = errors.New("server key mode is not enabled")
+
+// sealedAAD is the associated data binding a stored secret to its row, so that
+// an envelope copied into another row does not decrypt there. rowKey is the
+// row's aadKey from sealedTables.
+func sealedAAD(table, rowKey string) []byte { return []byte(table + "/" + rowKey) }
+
+func privateKeyAAD(peerID string) []byte { return sealedAAD("peer_private_keys", peerID) }
+
+// pskAAD binds a preshared key to its ordered peer pair (a < b).
+func pskAAD(a, b string) []byte { return sealedAAD("peer_psks", a+"/"+b) }
+
+// envelopeAAD returns the associated data to open a row with: rows written
+// before secrets were bound to their rows (aad_bound false) have none until
+// RewrapServerKeys upgrades them.
+func envelopeAAD(bound bool, aad []byte) []byte {
+	if !bound { return nil }
+	return aad
+}
+
+// storePrivateKey encrypts priv and stores it for peerID, replacing any
+// previous key.
+func storePrivateKey(ctx context.Context, tx *sql.Tx, kms keystore.KMS, peerID string, priv wireguard.Key) error {
+	if kms == nil { return errServerKeysDisabled }
+	env, err := keystore.Seal(kms, priv[:], privateKeyAAD(peerID))
+	if err != nil { return err }
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO peer_private_keys (peer_id, key_id, wrapped_dek, nonce, ciphertext, aad_bound) VALUES ($1, $2, $3, $4, $5, TRUE)
+		 ON CONFLICT (peer_id) DO UPDATE SET key_id = EXCLUDED.key_id, wrapped_dek = EXCLUDED.wrapped_dek, nonce = EXCLUDED.nonce, ciphertext = EXCLUDED.ciphertext, aad_bound = TRUE, created_at = NOW()`,
+		peerID, env.KeyID, env.WrappedDEK, env.Nonce, env.Ciphertext)
+	return err
+}
+
+// loadPrivateKey decrypts the stored private key for peerID.
+func loadPrivateKey(ctx context.Context, db *sql.DB, kms keystore.KMS, peerID string) (wireguard.Key, error) {
+	var key wireguard.Key
+	if kms == nil { return key, errServerKeysDisabled }
+	var env keystore.Envelope
+	var bound bool
+	err := db.QueryRowContext(ctx, "SELECT key_id, wrapped_dek, nonce, ciphertext, aad_bound FROM peer_private_keys WHERE peer_id = $1", peerID).
+		Scan(&env.KeyID, &env.WrappedDEK, &env.Nonce, &env.Ciphertext, &bound)
+	if err != nil { return key, err }
+	raw, err := keystore.Open(kms, &env, envelopeAAD(bound, privateKeyAAD(peerID)))
+	if err != nil { return key, err }
+	if len(raw) != wireguard.KeyLen { return key, fmt.Errorf("stored private key for peer %s has length %d", peerID, len(raw)) }
+	copy(key[:], raw)
+	return key, nil
+}
+
+// sealedTables lists the tables holding keystore envelopes, their key column
+// and the SQL expression for the row key their associated data names, for
+// re-wrapping after a master key rotation.
+var sealedTables = []struct{ table, idCol, aadKey string }{
+	{"peer_private_keys", "peer_id", "peer_id::text"},
+	{"peer_psks", "id", "peer_a::text || '/' || peer_b::text"},
+}
+
+// RewrapServerKeys re-wraps every stored secret that is not yet under the
+// active master key, and binds secrets stored before envelopes carried
+// associated data to their rows. It is run at startup so that rotating the
+// master key only requires updating the key file and restarting.
+func RewrapServerKeys(ctx context.Context, db *sql.DB, kms keystore.KMS) (int, error) {
+	total := 0
+	for _, t := range sealedTables {
+		if err := bindTable(ctx, db, kms, t.table, t.idCol, t.aadKey); err != nil { return total, err }
+		n, err := rewrapTable(ctx, db, kms, t.table, t.idCol)
+		total += n
+		if err != nil { return total, err }
+	}
+	return total, nil
+}
+
+func bindTable(ctx context.Context, db *sql.DB, kms keystore.KMS, table, idCol, aadKey string) error {
+	rows, err := db.QueryContext(ctx, "SELECT "+idCol+", "+aadKey+", key_id, wrapped_dek, nonce, ciphertext FROM "+table+" WHERE NOT aad_bound")
+	if err != nil { return fmt.Errorf("query %s: %w", table, err) }
+	type unbound struct { id, rowKey string; env keystore.Envelope }
+	var pending []unbound
+	for rows.Next() {
+		var u unbound
+		if err := rows.Scan(&u.id, &u.rowKey, &u.env.KeyID, &u.env.WrappedDEK, &u.env.Nonce, &u.env.Ciphertext); err != nil { rows.Close(); return fmt.Errorf("scan %s: %w", table, err) }
+		pending = append(pending, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil { return err }
+	for _, u := range pending {
+		if err := keystore.Bind(kms, &u.env, sealedAAD(table, u.rowKey)); err != nil { return fmt.Errorf("bind %s %s: %w", table, u.id, err) }
+		_, err := db.ExecContext(ctx, "UPDATE "+table+" SET nonce = $2, ciphertext = $3, aad_bound = TRUE WHERE "+idCol+" = $1 AND NOT aad_bound",
+			u.id, u.env.Nonce, u.env.Ciphertext)
+		if err != nil { return fmt.Errorf("update %s %s: %w", table, u.id, err) }
+	}
+	return nil
+}
+
+func rewrapTable(ctx context.Context, db *sql.DB, kms keystore.KMS, table, idCol string) (int, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+idCol+", key_id, wrapped_dek FROM "+table+" WHERE key_id <> $1", kms.ActiveKeyID())
+	if err != nil { return 0, fmt.Errorf("query %s: %w", table, err) }
+	type stale struct { id string; env keystore.Envelope }
+	var pending []stale
+	for rows.Next() {
+		var s stale
+		if err := rows.Scan(&s.id, &s.env.KeyID, &s.env.WrappedDEK); err != nil { rows.Close(); return 0, fmt.Errorf("scan %s: %w", table, err) }
+		pending = append(pending, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil { return 0, err }
+	n := 0
+	for _, s := range pending {
+		oldKeyID := s.env.KeyID
+		if _, err := keystore.Rewrap(kms, &s.env); err != nil { return n, fmt.Errorf("rewrap %s %s: %w", table, s.id, err) }
+		res, err := db.ExecContext(ctx, "UPDATE "+table+" SET key_id = $2, wrapped_dek = $3 WHERE "+idCol+" = $1 AND key_id = $4",
+			s.id, s.env.KeyID, s.env.WrappedDEK, oldKeyID)
+		if err != nil { return n, fmt.Errorf("update %s %s: %w", table, s.id, err) }
+		if c, _ := res.RowsAffected(); c > 0 { n++ }
+	}
+	return n, nil
+}
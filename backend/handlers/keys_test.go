@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wgcloudctrl/server/keystore"
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+func testKMS(t *testing.T) keystore.KMS {
+	t.Helper()
+	k := make([]byte, 32)
+	rand.Read(k)
+	path := filepath.Join(t.TempDir(), "master-keys.json")
+	if err := os.WriteFile(path, []byte(`{"active": "k1", "keys": {"k1": "`+base64.StdEncoding.EncodeToString(k)+`"}}`), 0o600); err != nil { t.Fatal(err) }
+	kms, err := keystore.LoadLocalKMS(path)
+	if err != nil { t.Fatal(err) }
+	return kms
+}
+
+func TestStoredKeysAreBoundToTheirRow(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	kms := testKMS(t)
+	owner, _ := createUser(t, db)
+	netID := createNetwork(t, db, owner, nil)
+	p1 := createPeer(t, db, netID, owner, "10.10.0.2")
+	p2 := createPeer(t, db, netID, owner, "10.10.0.3")
+	store := func(peerID string) wireguard.Key {
+		priv, _, err := wireguard.GenerateKeyPair()
+		if err != nil { t.Fatal(err) }
+		tx, err := db.Begin()
+		if err != nil { t.Fatal(err) }
+		if err := storePrivateKey(ctx, tx, kms, peerID, priv); err != nil { t.Fatal(err) }
+		if err := tx.Commit(); err != nil { t.Fatal(err) }
+		return priv
+	}
+
+	priv := store(p1)
+	store(p2)
+	if got, err := loadPrivateKey(ctx, db, kms, p1); err != nil || got != priv { t.Fatalf("loadPrivateKey = %v", err) }
+	// p1's envelope copied onto p2's row does not decrypt as p2's key.
+	if _, err := db.Exec("UPDATE peer_private_keys d SET key_id = s.key_id, wrapped_dek = s.wrapped_dek, nonce = s.nonce, ciphertext = s.ciphertext FROM peer_private_keys s WHERE s.peer_id = $1 AND d.peer_id = $2", p1, p2); err != nil { t.Fatal(err) }
+	if _, err := loadPrivateKey(ctx, db, kms, p2); err == nil { t.Error("loaded another peer's private key") }
+
+	// A row stored before keys were bound still loads, and is bound on the
+	// next startup.
+	env, err := keystore.Seal(kms, priv[:], nil)
+	if err != nil { t.Fatal(err) }
+	if _, err := db.Exec("UPDATE peer_private_keys SET nonce = $2, ciphertext = $3, aad_bound = FALSE WHERE peer_id = $1", p1, env.Nonce, env.Ciphertext); err != nil { t.Fatal(err) }
+	if got, err := loadPrivateKey(ctx, db, kms, p1); err != nil || got != priv { t.Fatalf("legacy row: %v", err) }
+	if _, err := RewrapServerKeys(ctx, db, kms); err != nil { t.Fatal(err) }
+	var bound bool
+	if err := db.QueryRow("SELECT aad_bound FROM peer_private_keys WHERE peer_id = $1", p1).Scan(&bound); err != nil { t.Fatal(err) }
+	if !bound { t.Error("RewrapServerKeys left a legacy row unbound") }
+	if got, err := loadPrivateKey(ctx, db, kms, p1); err != nil || got != priv { t.Fatalf("after binding: %v", err) }
+}
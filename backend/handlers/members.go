@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"net/http"
@@ -22,6 +23,17 @@ type Member struct {
 	Email     string    `json:"email"`
 }
 
+// memberRole returns the caller's role in a network, or sql.ErrNoRows if
+// they are not a member.
+func memberRole(ctx context.Context, db *sql.DB, networkID, userID string) (string, error) {
+	var role string
+	err := db.QueryRowContext(ctx, "SELECT role FROM network_members WHERE network_id = $1 AND user_id = $2", networkID, userID).Scan(&role)
+	return role, err
+}
+
+// isNetworkAdmin reports whether role may manage a network's membership.
+func isNetworkAdmin(role string) bool { return role == "owner" || role == "admin" }
+
 func (h *MembersHandler) List(w http.ResponseWriter, r *http.Request) {
 	userID := mw.UserIDFromContext(r.Context())
 	netID := mux.Vars(r)["id"]
@@ -59,5 +71,6 @@ func (h *MembersHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	_, err = h.DB.ExecContext(r.Context(), "DELETE FROM network_members WHERE id = $1", memberID)
 	if err != nil { log.Printf("delete member error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
 	logActivity(h.DB, networkID, requesterID, "member_removed", map[string]interface{}{"removed_user_id": targetUserID})
+	revokeNetworkStreams(h.Broker, networkID, targetUserID, "removed_from_network")
 	jsonOK(w, http.StatusOK, map[string]string{"message": "member removed"})
 }
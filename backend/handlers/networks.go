@@ -1,13 +1,21 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/wgcloudctrl/server/keystore"
+	"github.com/wgcloudctrl/server/posture"
 	"github.com/wgcloudctrl/server/sse"
 	mw "github.com/wgcloudctrl/server/middleware"
 )
@@ -15,13 +23,109 @@ import (
 type NetworksHandler struct {
 	DB     *sql.DB
 	Broker *sse.Broker
+	Keys   keystore.KMS
 }
 
 type Network struct {
-	ID          string    `json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID              string         `json:"id"`
+	Name            string         `json:"name"`
+	Description     string         `json:"description"`
+	DNSName         *string        `json:"dns_name"`
+	CIDR            string         `json:"cidr"`
+	AllowedDomains  []string       `json:"allowed_domains"`
+	DomainJoinRole  string         `json:"domain_join_role"`
+	DomainAutoJoin  bool           `json:"domain_auto_join"`
+	KeyRotationDays *int           `json:"key_rotation_days"`
+	PSKMode         string         `json:"psk_mode"`
+	PSKHubPeerID    *string        `json:"psk_hub_peer_id"`
+	PostureRules    *posture.Rules `json:"posture_rules"`
+	CreatedAt       time.Time      `json:"created_at"`
+}
+
+// parseNetworkCIDR validates an address range for a network's virtual IPs:
+// a private or shared (100.64.0.0/10) IPv4 prefix between /16 and /29.
+func parseNetworkCIDR(s string) (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(strings.TrimSpace(s))
+	if err != nil || !p.Addr().Is4() { return netip.Prefix{}, fmt.Errorf("cidr must be an IPv4 prefix such as 10.20.0.0/24") }
+	if p.Bits() < 16 || p.Bits() > 29 { return netip.Prefix{}, fmt.Errorf("cidr must be between /16 and /29") }
+	if !p.Addr().IsPrivate() && !cgnatPrefix.Contains(p.Addr()) { return netip.Prefix{}, fmt.Errorf("cidr must be a private (RFC 1918) or shared (100.64.0.0/10) range") }
+	return p.Masked(), nil
+}
+
+// defaultNetworkCIDR is the range networks get unless one is chosen.
+const defaultNetworkCIDR = "10.10.0.0/24"
+
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+var nonLabelChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// dnsLabel turns a network name into a DNS label, e.g. "Berlin Office" into
+// "berlin-office".
+func dnsLabel(name string) string {
+	l := strings.Trim(nonLabelChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(l) > 40 { l = strings.TrimRight(l[:40], "-") }
+	return l
+}
+
+// assignDNSName gives a new network a mesh DNS name derived from its display
+// name, falling back to a suffixed name when it is taken.
+func assignDNSName(ctx context.Context, db *sql.DB, netID, name string) {
+	base := dnsLabel(name)
+	candidates := []string{base, base + "-" + netID[:8]}
+	if base == "" { candidates = []string{"net-" + netID[:8]} }
+	for _, c := range candidates {
+		_, err := db.ExecContext(ctx, "UPDATE networks SET dns_name = $2 WHERE id = $1", netID, c)
+		if err == nil { return }
+		if !isUniqueViolation(err) { log.Printf("assign dns name error: %v", err); return }
+	}
+}
+
+// emailDomain returns the lower-cased domain part of an email address.
+func emailDomain(email string) string {
+	if i := strings.LastIndex(email, "@"); i != -1 { return strings.ToLower(email[i+1:]) }
+	return ""
+}
+
+// normalizeDomain lower-cases d, strips a leading "@" and reports whether the
+// result looks like a DNS domain name.
+func normalizeDomain(d string) (string, bool) {
+	d = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(d)), "@")
+	if len(d) < 3 || len(d) > 253 || !strings.Contains(d, ".") { return "", false }
+	for _, label := range strings.Split(d, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' { return "", false }
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') { return "", false }
+		}
+	}
+	return d, true
+}
+
+func emailVerified(ctx context.Context, db *sql.DB, userID string) (bool, error) {
+	var verifiedAt *time.Time
+	err := db.QueryRowContext(ctx, "SELECT email_verified_at FROM users WHERE id = $1", userID).Scan(&verifiedAt)
+	return verifiedAt != nil, err
+}
+
+// applyDomainAutoJoin adds a user with a verified address to every network
+// that auto-admits their email domain, once the network's owner has verified
+// the domain (see domains.go). It returns the IDs of networks joined.
+func applyDomainAutoJoin(ctx context.Context, db *sql.DB, userID, email string) []string {
+	domain := emailDomain(email)
+	if domain == "" { return nil }
+	rows, err := db.QueryContext(ctx,
+		"INSERT INTO network_members (network_id, user_id, role) SELECT n.id, $1, n.domain_join_role FROM networks n WHERE n.domain_auto_join AND $2 = ANY(n.allowed_domains) AND EXISTS (SELECT 1 FROM network_domains d WHERE d.network_id = n.id AND d.domain = $2 AND d.verified_at IS NOT NULL) ON CONFLICT (network_id, user_id) DO NOTHING RETURNING network_id",
+		userID, domain)
+	if err != nil { log.Printf("domain auto-join error: %v", err); return nil }
+	var joined []string
+	for rows.Next() {
+		var netID string
+		if err := rows.Scan(&netID); err == nil { joined = append(joined, netID) }
+	}
+	rows.Close()
+	for _, netID := range joined {
+		logActivity(db, netID, userID, "member_joined", map[string]interface{}{"via": "domain", "domain": domain})
+	}
+	return joined
 }
 
 // POST /api/networks/create
@@ -30,19 +134,24 @@ func (h *NetworksHandler) Create(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Name        string `json:"name"`
 		Description string `json:"description"`
+		CIDR        string `json:"cidr"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
 	if req.Name == "" { req.Name = "My Network" }
+	if req.CIDR == "" { req.CIDR = defaultNetworkCIDR }
+	cidr, err := parseNetworkCIDR(req.CIDR)
+	if err != nil { jsonError(w, err.Error(), http.StatusBadRequest); return }
 	var netID string
-	err := h.DB.QueryRowContext(r.Context(),
-		"INSERT INTO networks (owner_id, name, description) VALUES ($1, $2, $3) RETURNING id",
-		userID, req.Name, req.Description,
+	err = h.DB.QueryRowContext(r.Context(),
+		"INSERT INTO networks (owner_id, name, description, cidr) VALUES ($1, $2, $3, $4) RETURNING id",
+		userID, req.Name, req.Description, cidr.String(),
 	).Scan(&netID)
 	if err != nil { log.Printf("create network error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
 	_, err = h.DB.ExecContext(r.Context(),
 		"INSERT INTO network_members (network_id, user_id, role) VALUES ($1, $2, 'owner')",
 		netID, userID)
 	if err != nil { log.Printf("add owner member error: %v", err) }
+	assignDNSName(r.Context(), h.DB, netID, req.Name)
 	logActivity(h.DB, netID, userID, "network_created", map[string]interface{}{})
 	jsonOK(w, http.StatusCreated, map[string]string{"network_id": netID})
 }
@@ -51,17 +160,22 @@ func (h *NetworksHandler) Create(w http.ResponseWriter, r *http.Request) {
 func (h *NetworksHandler) List(w http.ResponseWriter, r *http.Request) {
 	userID := mw.UserIDFromContext(r.Context())
 	rows, err := h.DB.QueryContext(r.Context(),
-		"SELECT n.id, n.name, n.description, n.created_at FROM networks n JOIN network_members nm ON nm.network_id = n.id WHERE nm.user_id = $1 ORDER BY n.created_at DESC",
+		"SELECT n.id, n.name, n.description, n.dns_name, n.cidr, n.allowed_domains, n.domain_join_role, n.domain_auto_join, n.key_rotation_days, n.psk_mode, n.psk_hub_peer_id, n.posture_rules, n.created_at FROM networks n JOIN network_members nm ON nm.network_id = n.id WHERE nm.user_id = $1 ORDER BY n.created_at DESC",
 		userID)
 	if err != nil { log.Printf("list networks error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
 	defer rows.Close()
 	var nets []Network
 	for rows.Next() {
 		var n Network
-		if err := rows.Scan(&n.ID, &n.Name, &n.Description, &n.CreatedAt); err != nil {
+		var rulesJSON []byte
+		if err := rows.Scan(&n.ID, &n.Name, &n.Description, &n.DNSName, &n.CIDR, pq.Array(&n.AllowedDomains), &n.DomainJoinRole, &n.DomainAutoJoin, &n.KeyRotationDays, &n.PSKMode, &n.PSKHubPeerID, &rulesJSON, &n.CreatedAt); err != nil {
 			log.Printf("scan network error: %v", err)
 			continue
 		}
+		if rulesJSON != nil {
+			n.PostureRules = &posture.Rules{}
+			if err := json.Unmarshal(rulesJSON, n.PostureRules); err != nil { n.PostureRules = nil }
+		}
 		nets = append(nets, n)
 	}
 	if nets == nil { nets = []Network{} }
@@ -72,17 +186,149 @@ func (h *NetworksHandler) List(w http.ResponseWriter, r *http.Request) {
 func (h *NetworksHandler) Update(w http.ResponseWriter, r *http.Request) {
 	userID := mw.UserIDFromContext(r.Context())
 	netID := mux.Vars(r)["id"]
-	var req struct { Name string `json:"name"`; Description string `json:"description"` }
+	var req struct {
+		Name            *string         `json:"name"`
+		Description     *string         `json:"description"`
+		DNSName         *string         `json:"dns_name"`
+		CIDR            *string         `json:"cidr"`
+		AllowedDomains  *[]string       `json:"allowed_domains"`
+		DomainJoinRole  *string         `json:"domain_join_role"`
+		DomainAutoJoin  *bool           `json:"domain_auto_join"`
+		KeyRotationDays *int            `json:"key_rotation_days"`
+		PSKMode         *string         `json:"psk_mode"`
+		PSKHubPeerID    *string         `json:"psk_hub_peer_id"`
+		PostureRules    json.RawMessage `json:"posture_rules"`
+	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
-	res, err := h.DB.ExecContext(r.Context(),
-		"UPDATE networks SET name = $1, description = $2 WHERE id = $3 AND owner_id = $4",
-		req.Name, req.Description, netID, userID)
+	var domains interface{}
+	domainList := []string{}
+	if req.AllowedDomains != nil {
+		seen := map[string]bool{}
+		for _, d := range *req.AllowedDomains {
+			nd, ok := normalizeDomain(d)
+			if !ok { jsonError(w, "invalid domain: "+d, http.StatusBadRequest); return }
+			if !seen[nd] { seen[nd] = true; domainList = append(domainList, nd) }
+		}
+		domains = pq.Array(domainList)
+	}
+	if req.DomainJoinRole != nil && *req.DomainJoinRole != "member" && *req.DomainJoinRole != "admin" { jsonError(w, "domain_join_role must be member or admin", http.StatusBadRequest); return }
+	if req.KeyRotationDays != nil && (*req.KeyRotationDays < 0 || *req.KeyRotationDays > 3650) { jsonError(w, "key_rotation_days must be between 0 (no policy) and 3650", http.StatusBadRequest); return }
+	if req.PSKMode != nil {
+		if !validPSKMode(*req.PSKMode) { jsonError(w, "psk_mode must be off, pair or hub", http.StatusBadRequest); return }
+		if *req.PSKMode != pskModeOff && h.Keys == nil { jsonError(w, "preshared keys need a master key (KEY_MASTER_FILE)", http.StatusBadRequest); return }
+	}
+	if req.PSKHubPeerID != nil && *req.PSKHubPeerID != "" {
+		var mc int
+		err := h.DB.QueryRowContext(r.Context(), "SELECT 1 FROM peers WHERE id = $1 AND network_id = $2", *req.PSKHubPeerID, netID).Scan(&mc)
+		if err == sql.ErrNoRows { jsonError(w, "psk_hub_peer_id must be a peer in this network", http.StatusBadRequest); return }
+		if err != nil { log.Printf("hub peer check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	}
+	if req.DNSName != nil {
+		d := strings.ToLower(strings.TrimSpace(*req.DNSName))
+		if !peerHostnameRe.MatchString(d) { jsonError(w, "dns_name must be a single DNS label (letters, digits and hyphens, max 63 characters)", http.StatusBadRequest); return }
+		req.DNSName = &d
+	}
+	if req.CIDR != nil {
+		p, err := parseNetworkCIDR(*req.CIDR)
+		if err != nil { jsonError(w, err.Error(), http.StatusBadRequest); return }
+		// Virtual IPs are never renumbered, so the range is fixed once a peer
+		// has joined.
+		var peers int
+		if err := h.DB.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM peers WHERE network_id = $1", netID).Scan(&peers); err != nil { log.Printf("peer count error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+		if peers > 0 { jsonError(w, "cidr can only be changed while the network has no peers", http.StatusConflict); return }
+		other, err := overlappingPeering(r.Context(), h.DB, netID, p)
+		if err != nil { log.Printf("peering overlap check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+		if other != "" { jsonError(w, fmt.Sprintf("cidr overlaps the range %s of a peered network", other), http.StatusConflict); return }
+		c := p.String()
+		req.CIDR = &c
+	}
+	// posture_rules: omitted leaves the rules alone, null clears them.
+	var rules *posture.Rules
+	var rulesJSON interface{}
+	clearRules := string(req.PostureRules) == "null"
+	if req.PostureRules != nil && !clearRules {
+		rules = &posture.Rules{}
+		if err := json.Unmarshal(req.PostureRules, rules); err != nil { jsonError(w, "invalid posture_rules", http.StatusBadRequest); return }
+		if err := rules.Validate(); err != nil { jsonError(w, "invalid posture_rules: "+err.Error(), http.StatusBadRequest); return }
+		b, _ := json.Marshal(rules)
+		rulesJSON = string(b)
+	}
+	var n Network
+	err := h.DB.QueryRowContext(r.Context(),
+		"UPDATE networks SET name = COALESCE($1, name), description = COALESCE($2, description), allowed_domains = COALESCE($3, allowed_domains), domain_join_role = COALESCE($4, domain_join_role), domain_auto_join = COALESCE($5, domain_auto_join), key_rotation_days = CASE WHEN $8::int IS NULL THEN key_rotation_days ELSE NULLIF($8, 0) END, psk_mode = COALESCE($9, psk_mode), psk_hub_peer_id = CASE WHEN $10::text IS NULL THEN psk_hub_peer_id ELSE NULLIF($10, '')::uuid END, posture_rules = CASE WHEN $11 THEN NULL ELSE COALESCE($12::jsonb, posture_rules) END, dns_name = COALESCE($13, dns_name), cidr = COALESCE($14, cidr), updated_at = NOW() WHERE id = $6 AND owner_id = $7 RETURNING allowed_domains, domain_join_role, domain_auto_join, psk_mode, psk_hub_peer_id",
+		req.Name, req.Description, domains, req.DomainJoinRole, req.DomainAutoJoin, netID, userID, req.KeyRotationDays, req.PSKMode, req.PSKHubPeerID, clearRules, rulesJSON, req.DNSName, req.CIDR).Scan(pq.Array(&n.AllowedDomains), &n.DomainJoinRole, &n.DomainAutoJoin, &n.PSKMode, &n.PSKHubPeerID)
+	if err == sql.ErrNoRows { jsonError(w, "network not found or not owner", http.StatusNotFound); return }
+	if isUniqueViolation(err) { jsonError(w, "dns_name is already used by another network", http.StatusConflict); return }
 	if err != nil { log.Printf("update network error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
-	n, _ := res.RowsAffected()
-	if n == 0 { jsonError(w, "network not found or not owner", http.StatusNotFound); return }
+	if req.AllowedDomains != nil {
+		if err := syncDomainChallenges(r.Context(), h.DB, netID, domainList); err != nil { log.Printf("domain challenges error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	}
+	if req.AllowedDomains != nil || req.DomainJoinRole != nil || req.DomainAutoJoin != nil {
+		logActivity(h.DB, netID, userID, "domain_rule_updated", map[string]interface{}{"allowed_domains": n.AllowedDomains, "domain_join_role": n.DomainJoinRole, "domain_auto_join": n.DomainAutoJoin})
+	}
+	if req.PSKMode != nil || req.PSKHubPeerID != nil {
+		// Keys issued under the old policy are discarded; the new policy's
+		// keys are generated as configs are rendered.
+		if _, err := h.DB.ExecContext(r.Context(), "DELETE FROM peer_psks WHERE network_id = $1", netID); err != nil { log.Printf("purge psks error: %v", err) }
+		logActivity(h.DB, netID, userID, "psk_policy_updated", map[string]interface{}{"psk_mode": n.PSKMode, "psk_hub_peer_id": n.PSKHubPeerID})
+	}
+	if req.DNSName != nil || req.PSKMode != nil || req.PSKHubPeerID != nil {
+		// Peers topic subscribers (and the mesh DNS responder) refresh names
+		// and configs.
+		publishPeers(h.DB, h.Broker, netID, "network_updated", peerChange{})
+	}
+	if req.PostureRules != nil {
+		logActivity(h.DB, netID, userID, "posture_rules_updated", map[string]interface{}{"posture_rules": rules})
+		if err := reevaluateNetworkPosture(r.Context(), h.DB, h.Broker, netID, userID, rules); err != nil { log.Printf("reevaluate posture error: %v", err) }
+	}
 	jsonOK(w, http.StatusOK, map[string]string{"message": "updated"})
 }
 
+// GET /api/networks/joinable
+func (h *NetworksHandler) Joinable(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	email := mw.EmailFromContext(r.Context())
+	verified, err := emailVerified(r.Context(), h.DB, userID)
+	if err != nil { log.Printf("verification status error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	nets := []Network{}
+	if !verified { jsonOK(w, http.StatusOK, nets); return }
+	rows, err := h.DB.QueryContext(r.Context(),
+		"SELECT n.id, n.name, n.description, n.created_at FROM networks n WHERE $2 = ANY(n.allowed_domains) AND NOT EXISTS (SELECT 1 FROM network_members nm WHERE nm.network_id = n.id AND nm.user_id = $1) ORDER BY n.name",
+		userID, emailDomain(email))
+	if err != nil { log.Printf("joinable networks error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	defer rows.Close()
+	for rows.Next() {
+		var n Network
+		if err := rows.Scan(&n.ID, &n.Name, &n.Description, &n.CreatedAt); err != nil { log.Printf("scan network error: %v", err); continue }
+		nets = append(nets, n)
+	}
+	jsonOK(w, http.StatusOK, nets)
+}
+
+// POST /api/networks/:id/join-domain
+func (h *NetworksHandler) JoinByDomain(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	email := mw.EmailFromContext(r.Context())
+	netID := mux.Vars(r)["id"]
+	verified, err := emailVerified(r.Context(), h.DB, userID)
+	if err != nil { log.Printf("verification status error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if !verified { jsonError(w, "verify your email address first", http.StatusForbidden); return }
+	domain := emailDomain(email)
+	// Until the owner verifies the domain, joining through it only makes a
+	// member.
+	var role string
+	err = h.DB.QueryRowContext(r.Context(), "SELECT CASE WHEN EXISTS (SELECT 1 FROM network_domains d WHERE d.network_id = n.id AND d.domain = $2 AND d.verified_at IS NOT NULL) THEN n.domain_join_role ELSE 'member' END FROM networks n WHERE n.id = $1 AND $2 = ANY(n.allowed_domains)", netID, domain).Scan(&role)
+	if err == sql.ErrNoRows { jsonError(w, "your email domain may not join this network", http.StatusForbidden); return }
+	if err != nil { log.Printf("domain rule query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	res, err := h.DB.ExecContext(r.Context(), "INSERT INTO network_members (network_id, user_id, role) VALUES ($1, $2, $3) ON CONFLICT (network_id, user_id) DO NOTHING", netID, userID, role)
+	if err != nil { log.Printf("domain join error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if n, _ := res.RowsAffected(); n > 0 {
+		logActivity(h.DB, netID, userID, "member_joined", map[string]interface{}{"via": "domain", "domain": domain})
+		publishPeers(h.DB, h.Broker, netID, "member_joined", peerChange{})
+	}
+	jsonOK(w, http.StatusOK, map[string]string{"network_id": netID})
+}
+
 // DELETE /api/networks/:id
 func (h *NetworksHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	userID := mw.UserIDFromContext(r.Context())
@@ -92,5 +338,6 @@ func (h *NetworksHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	if err != nil { log.Printf("delete network error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
 	n, _ := res.RowsAffected()
 	if n == 0 { jsonError(w, "network not found or not owner", http.StatusNotFound); return }
+	revokeNetworkStreams(h.Broker, netID, "", "network_deleted")
 	jsonOK(w, http.StatusOK, map[string]string{"message": "deleted"})
 }
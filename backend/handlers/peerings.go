@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/wgcloudctrl/server/sse"
+	mw "github.com/wgcloudctrl/server/middleware"
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+type PeeringsHandler struct { DB *sql.DB; Broker *sse.Broker }
+
+// Peering connects two networks. Each side chooses, by tag, which of its
+// peers take part; an empty tag list means all peers. Once both owners have
+// approved, participating peers on each side get the other side's
+// participating peers in their configs.
+type Peering struct {
+	ID          string     `json:"id"`
+	NetworkA    string     `json:"network_a"`
+	NetworkB    string     `json:"network_b"`
+	TagsA       []string   `json:"tags_a"`
+	TagsB       []string   `json:"tags_b"`
+	Status      string     `json:"status"`
+	RequestedBy string     `json:"requested_by"`
+	ApprovedBy  *string    `json:"approved_by"`
+	ApprovedAt  *time.Time `json:"approved_at"`
+	RevokedBy   *string    `json:"revoked_by"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+const peeringColumns = "id, network_a, network_b, tags_a, tags_b, status, requested_by, approved_by, approved_at, revoked_by, revoked_at, created_at"
+
+func scanPeering(row interface{ Scan(...interface{}) error }, p *Peering) error {
+	return row.Scan(&p.ID, &p.NetworkA, &p.NetworkB, pq.Array(&p.TagsA), pq.Array(&p.TagsB), &p.Status, &p.RequestedBy, &p.ApprovedBy, &p.ApprovedAt, &p.RevokedBy, &p.RevokedAt, &p.CreatedAt)
+}
+
+func isNetworkOwner(ctx context.Context, db *sql.DB, networkID, userID string) (bool, error) {
+	var ownerID string
+	err := db.QueryRowContext(ctx, "SELECT owner_id FROM networks WHERE id = $1", networkID).Scan(&ownerID)
+	if err == sql.ErrNoRows { return false, nil }
+	return ownerID == userID, err
+}
+
+// checkPeeringCIDRs refuses to peer networks whose address ranges overlap,
+// since their peers' AllowedIPs would collide.
+func checkPeeringCIDRs(ctx context.Context, db *sql.DB, a, b string) (int, error) {
+	pa, err := networkPrefix(ctx, db, a)
+	if err != nil { return http.StatusInternalServerError, err }
+	pb, err := networkPrefix(ctx, db, b)
+	if err == sql.ErrNoRows { return http.StatusNotFound, fmt.Errorf("network not found") }
+	if err != nil { return http.StatusInternalServerError, err }
+	if pa.Overlaps(pb) { return http.StatusConflict, fmt.Errorf("network ranges %s and %s overlap; change one network's cidr first", pa, pb) }
+	return 0, nil
+}
+
+// POST /api/networks/:id/peerings
+// Requests a peering with another network. Only the owner of :id may ask.
+func (h *PeeringsHandler) Request(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	netID := mux.Vars(r)["id"]
+	var req struct { PeerNetworkID string `json:"peer_network_id"`; Tags []string `json:"tags"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
+	if req.PeerNetworkID == "" || req.PeerNetworkID == netID { jsonError(w, "peer_network_id must name another network", http.StatusBadRequest); return }
+	tags, err := normalizePeerTags(req.Tags)
+	if err != nil { jsonError(w, err.Error(), http.StatusBadRequest); return }
+	owner, err := isNetworkOwner(r.Context(), h.DB, netID, userID)
+	if err != nil { log.Printf("owner check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if !owner { jsonError(w, "only the network owner can request a peering", http.StatusForbidden); return }
+	if code, err := checkPeeringCIDRs(r.Context(), h.DB, netID, req.PeerNetworkID); err != nil {
+		if code == http.StatusInternalServerError { log.Printf("peering cidr check error: %v", err); jsonError(w, "internal error", code); return }
+		jsonError(w, err.Error(), code)
+		return
+	}
+	var p Peering
+	err = scanPeering(h.DB.QueryRowContext(r.Context(),
+		"INSERT INTO network_peerings (network_a, network_b, tags_a, requested_by) VALUES ($1, $2, $3, $4) RETURNING "+peeringColumns,
+		netID, req.PeerNetworkID, pq.Array(tags), userID), &p)
+	if isUniqueViolation(err) { jsonError(w, "these networks already have a pending or active peering", http.StatusConflict); return }
+	if err != nil { log.Printf("create peering error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	logActivity(h.DB, netID, userID, "peering_requested", map[string]interface{}{"peering_id": p.ID, "peer_network_id": req.PeerNetworkID})
+	logActivity(h.DB, req.PeerNetworkID, userID, "peering_requested", map[string]interface{}{"peering_id": p.ID, "peer_network_id": netID})
+	h.Broker.PublishToNetwork(req.PeerNetworkID, "admin", sse.Event{Type: "peering_requested", Payload: p})
+	jsonOK(w, http.StatusCreated, p)
+}
+
+// GET /api/networks/:id/peerings
+func (h *PeeringsHandler) List(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	netID := mux.Vars(r)["id"]
+	role, err := memberRole(r.Context(), h.DB, netID, userID)
+	if err == sql.ErrNoRows || (err == nil && !isNetworkAdmin(role)) { jsonError(w, "only network owners and admins can view peerings", http.StatusForbidden); return }
+	if err != nil { log.Printf("member role error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	rows, err := h.DB.QueryContext(r.Context(), "SELECT "+peeringColumns+" FROM network_peerings WHERE network_a = $1 OR network_b = $1 ORDER BY created_at DESC", netID)
+	if err != nil { log.Printf("list peerings error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	defer rows.Close()
+	out := []Peering{}
+	for rows.Next() {
+		var p Peering
+		if err := scanPeering(rows, &p); err != nil { log.Printf("scan peering error: %v", err); continue }
+		out = append(out, p)
+	}
+	jsonOK(w, http.StatusOK, out)
+}
+
+// POST /api/peerings/:id/approve
+// The owner of the requested network accepts, choosing its own tags.
+func (h *PeeringsHandler) Approve(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	id := mux.Vars(r)["id"]
+	var req struct { Tags []string `json:"tags"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
+	tags, err := normalizePeerTags(req.Tags)
+	if err != nil { jsonError(w, err.Error(), http.StatusBadRequest); return }
+	var p Peering
+	err = scanPeering(h.DB.QueryRowContext(r.Context(), "SELECT "+peeringColumns+" FROM network_peerings WHERE id = $1", id), &p)
+	if err == sql.ErrNoRows { jsonError(w, "peering not found", http.StatusNotFound); return }
+	if err != nil { log.Printf("peering query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	owner, err := isNetworkOwner(r.Context(), h.DB, p.NetworkB, userID)
+	if err != nil { log.Printf("owner check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if !owner { jsonError(w, "only the owner of the requested network can approve", http.StatusForbidden); return }
+	if code, err := checkPeeringCIDRs(r.Context(), h.DB, p.NetworkA, p.NetworkB); err != nil {
+		if code == http.StatusInternalServerError { log.Printf("peering cidr check error: %v", err); jsonError(w, "internal error", code); return }
+		jsonError(w, err.Error(), code)
+		return
+	}
+	err = scanPeering(h.DB.QueryRowContext(r.Context(),
+		"UPDATE network_peerings SET status = 'active', tags_b = $2, approved_by = $3, approved_at = NOW() WHERE id = $1 AND status = 'pending' RETURNING "+peeringColumns,
+		id, pq.Array(tags), userID), &p)
+	if err == sql.ErrNoRows { jsonError(w, "peering is not pending", http.StatusConflict); return }
+	if err != nil { log.Printf("approve peering error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	h.changed(&p, userID, "peering_approved")
+	jsonOK(w, http.StatusOK, p)
+}
+
+// DELETE /api/peerings/:id
+// Either network's owner can withdraw a request or revoke an active peering.
+// The row is kept for the record.
+func (h *PeeringsHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	id := mux.Vars(r)["id"]
+	var p Peering
+	err := scanPeering(h.DB.QueryRowContext(r.Context(), "SELECT "+peeringColumns+" FROM network_peerings WHERE id = $1", id), &p)
+	if err == sql.ErrNoRows { jsonError(w, "peering not found", http.StatusNotFound); return }
+	if err != nil { log.Printf("peering query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	ownerA, err := isNetworkOwner(r.Context(), h.DB, p.NetworkA, userID)
+	if err != nil { log.Printf("owner check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	ownerB, err := isNetworkOwner(r.Context(), h.DB, p.NetworkB, userID)
+	if err != nil { log.Printf("owner check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if !ownerA && !ownerB { jsonError(w, "only the owner of either network can revoke a peering", http.StatusForbidden); return }
+	wasActive := p.Status == "active"
+	err = scanPeering(h.DB.QueryRowContext(r.Context(),
+		"UPDATE network_peerings SET status = 'revoked', revoked_by = $2, revoked_at = NOW() WHERE id = $1 AND status <> 'revoked' RETURNING "+peeringColumns,
+		id, userID), &p)
+	if err == sql.ErrNoRows { jsonError(w, "peering is already revoked", http.StatusConflict); return }
+	if err != nil { log.Printf("revoke peering error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if wasActive {
+		h.changed(&p, userID, "peering_revoked")
+	} else {
+		logActivity(h.DB, p.NetworkA, userID, "peering_revoked", map[string]interface{}{"peering_id": p.ID, "peer_network_id": p.NetworkB})
+		logActivity(h.DB, p.NetworkB, userID, "peering_revoked", map[string]interface{}{"peering_id": p.ID, "peer_network_id": p.NetworkA})
+	}
+	jsonOK(w, http.StatusOK, p)
+}
+
+// changed logs evt in both networks and pushes their peer lists so clients
+// re-fetch configs.
+func (h *PeeringsHandler) changed(p *Peering, userID, evt string) {
+	for _, side := range [][2]string{{p.NetworkA, p.NetworkB}, {p.NetworkB, p.NetworkA}} {
+		logActivity(h.DB, side[0], userID, evt, map[string]interface{}{"peering_id": p.ID, "peer_network_id": side[1]})
+		publishPeers(h.DB, h.Broker, side[0], evt, peerChange{})
+	}
+}
+
+// peeredPeerConfigs returns [Peer] sections for the peers of other networks
+// that self reaches through active peerings.
+func peeredPeerConfigs(ctx context.Context, db *sql.DB, self *Peer, keepalive int) ([]wireguard.PeerConfig, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT CASE WHEN network_a = $1 THEN tags_a ELSE tags_b END, CASE WHEN network_a = $1 THEN network_b ELSE network_a END, CASE WHEN network_a = $1 THEN tags_b ELSE tags_a END
+		 FROM network_peerings WHERE status = 'active' AND (network_a = $1 OR network_b = $1)`, self.NetworkID)
+	if err != nil { return nil, err }
+	type link struct { localTags, remoteTags []string; remote string }
+	var links []link
+	for rows.Next() {
+		var l link
+		if err := rows.Scan(pq.Array(&l.localTags), &l.remote, pq.Array(&l.remoteTags)); err != nil { rows.Close(); return nil, err }
+		links = append(links, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil { return nil, err }
+	var out []wireguard.PeerConfig
+	for _, l := range links {
+		if !hasAllTags(self.Tags, l.localTags) { continue }
+		remote, err := searchPeers(ctx, db, l.remote, l.remoteTags, "")
+		if err != nil { return nil, err }
+		for _, p := range remote {
+			if p.Quarantined { continue }
+			out = append(out, wireguard.PeerConfig{
+				PublicKey:           p.PublicKey,
+				Endpoint:            p.Endpoint,
+				AllowedIPs:          []string{p.VirtualIP + "/32"},
+				PersistentKeepalive: keepalive,
+			})
+		}
+	}
+	return out, nil
+}
+
+func hasAllTags(have, want []string) bool {
+	set := make(map[string]bool, len(have))
+	for _, t := range have { set[t] = true }
+	for _, t := range want { if !set[t] { return false } }
+	return true
+}
+
+// networkPrefix returns the address range a network assigns virtual IPs from.
+func networkPrefix(ctx context.Context, db *sql.DB, networkID string) (netip.Prefix, error) {
+	var cidr string
+	if err := db.QueryRowContext(ctx, "SELECT cidr FROM networks WHERE id = $1", networkID).Scan(&cidr); err != nil { return netip.Prefix{}, err }
+	return netip.ParsePrefix(cidr)
+}
+
+// overlappingPeering returns the range of a network peered (pending or
+// active) with networkID that overlaps p, or "" if there is none.
+func overlappingPeering(ctx context.Context, db *sql.DB, networkID string, p netip.Prefix) (string, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT n.cidr FROM network_peerings np JOIN networks n ON n.id = CASE WHEN np.network_a = $1 THEN np.network_b ELSE np.network_a END
+		 WHERE (np.network_a = $1 OR np.network_b = $1) AND np.status <> 'revoked'`, networkID)
+	if err != nil { return "", err }
+	defer rows.Close()
+	for rows.Next() {
+		var cidr string
+		if err := rows.Scan(&cidr); err != nil { return "", err }
+		if other, err := netip.ParsePrefix(cidr); err == nil && other.Overlaps(p) { return cidr, nil }
+	}
+	return "", rows.Err()
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestHasAllTags(t *testing.T) {
+	tests := []struct {
+		have, want []string
+		ok         bool
+	}{
+		{nil, nil, true},
+		{[]string{"web"}, nil, true},
+		{nil, []string{"web"}, false},
+		{[]string{"web", "prod"}, []string{"prod"}, true},
+		{[]string{"web", "prod"}, []string{"prod", "web"}, true},
+		{[]string{"web"}, []string{"web", "prod"}, false},
+		{[]string{"web"}, []string{"Web"}, false},
+		{[]string{"web", "web"}, []string{"web", "web"}, true},
+	}
+	for _, tt := range tests {
+		if got := hasAllTags(tt.have, tt.want); got != tt.ok { t.Errorf("hasAllTags(%v, %v) = %v, want %v", tt.have, tt.want, got, tt.ok) }
+	}
+}
+
+func TestCheckPeeringCIDRs(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	owner, _ := createUser(t, db)
+	network := func(cidr string) string {
+		id := createNetwork(t, db, owner, nil)
+		if _, err := db.Exec("UPDATE networks SET cidr = $2 WHERE id = $1", id, cidr); err != nil { t.Fatal(err) }
+		return id
+	}
+	a := network("10.10.0.0/24")
+	same := network("10.10.0.0/24")
+	inside := network("10.10.0.128/25")
+	covering := network("10.0.0.0/8")
+	disjoint := network("10.20.0.0/24")
+
+	tests := []struct {
+		name string
+		b    string
+		want int
+	}{
+		{"same range", same, http.StatusConflict},
+		{"range inside", inside, http.StatusConflict},
+		{"range covering", covering, http.StatusConflict},
+		{"disjoint", disjoint, 0},
+		{"missing network", "00000000-0000-0000-0000-000000000000", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		code, err := checkPeeringCIDRs(ctx, db, a, tt.b)
+		if code != tt.want || (tt.want == 0) != (err == nil) { t.Errorf("%s: checkPeeringCIDRs = %d, %v; want %d", tt.name, code, err, tt.want) }
+	}
+}
@@ -1,75 +1,310 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/wgcloudctrl/server/config"
+	"github.com/wgcloudctrl/server/keystore"
+	"github.com/wgcloudctrl/server/posture"
 	"github.com/wgcloudctrl/server/sse"
 	mw "github.com/wgcloudctrl/server/middleware"
+	"github.com/wgcloudctrl/server/wireguard"
 )
 
-type PeersHandler struct { DB *sql.DB; Broker *sse.Broker }
+type PeersHandler struct { DB *sql.DB; Broker *sse.Broker; Cfg *config.Config; Keys keystore.KMS }
 
 type Peer struct {
-	ID        string     `json:"id"`
-	NetworkID string     `json:"network_id"`
-	UserID    string     `json:"user_id"`
-	PublicKey string     `json:"public_key"`
-	Endpoint  string     `json:"endpoint"`
-	VirtualIP string     `json:"virtual_ip"`
-	LastSeen  *time.Time `json:"last_seen"`
-	CreatedAt time.Time  `json:"created_at"`
+	ID                   string          `json:"id"`
+	NetworkID            string          `json:"network_id"`
+	UserID               string          `json:"user_id"`
+	PublicKey            string          `json:"public_key"`
+	KeyMode              string          `json:"key_mode"`
+	Endpoint             string          `json:"endpoint"`
+	VirtualIP            string          `json:"virtual_ip"`
+	Hostname             string          `json:"hostname"`
+	Description          string          `json:"description"`
+	OS                   string          `json:"os"`
+	Tags                 []string        `json:"tags"`
+	Routes               []string        `json:"routes"`
+	ExitNode             string          `json:"exit_node"`
+	ExitNodeID           *string         `json:"exit_node_id"`
+	KeyCreatedAt         time.Time       `json:"key_created_at"`
+	KeyRotationDue       bool            `json:"key_rotation_due"`
+	// PreviousPublicKey is the rotated-out key while Join still resolves it
+	// to this peer. It is never rendered into configs.
+	PreviousPublicKey    *string         `json:"previous_public_key,omitempty"`
+	PreviousKeyExpiresAt *time.Time      `json:"previous_key_expires_at,omitempty"`
+	Posture              *posture.Report `json:"posture,omitempty"`
+	Quarantined          bool            `json:"quarantined"`
+	QuarantineReason     string          `json:"quarantine_reason,omitempty"`
+	LastSeen             *time.Time      `json:"last_seen"`
+	CreatedAt            time.Time       `json:"created_at"`
 }
 
+// maxKeyGrace caps how long a rotated-out key keeps resolving to its peer.
+const maxKeyGrace = 7 * 24 * time.Hour
+
+// peerColumns selects a Peer from "peers p JOIN networks n". The previous key
+// is only reported while its grace window is open.
+const peerColumns = `p.id, p.network_id, p.user_id, p.public_key, p.key_mode, p.endpoint, p.virtual_ip,
+	p.hostname, p.description, p.os, p.tags,
+	ARRAY(SELECT r.cidr FROM peer_routes r WHERE r.peer_id = p.id AND r.status = 'approved' ORDER BY r.cidr), p.exit_node, p.exit_node_id, p.key_created_at,
+	(n.key_rotation_days IS NOT NULL AND p.key_created_at < NOW() - n.key_rotation_days * INTERVAL '1 day'),
+	CASE WHEN p.previous_key_expires_at > NOW() THEN p.previous_public_key END,
+	CASE WHEN p.previous_key_expires_at > NOW() THEN p.previous_key_expires_at END,
+	p.posture, p.quarantined, p.quarantine_reason, p.last_seen, p.created_at`
+
+func scanPeer(row interface{ Scan(...interface{}) error }, p *Peer) error {
+	var postureJSON []byte
+	err := row.Scan(&p.ID, &p.NetworkID, &p.UserID, &p.PublicKey, &p.KeyMode, &p.Endpoint, &p.VirtualIP,
+		&p.Hostname, &p.Description, &p.OS, pq.Array(&p.Tags), pq.Array(&p.Routes), &p.ExitNode, &p.ExitNodeID, &p.KeyCreatedAt,
+		&p.KeyRotationDue, &p.PreviousPublicKey, &p.PreviousKeyExpiresAt, &postureJSON, &p.Quarantined, &p.QuarantineReason, &p.LastSeen, &p.CreatedAt)
+	if err != nil { return err }
+	if postureJSON != nil {
+		p.Posture = &posture.Report{}
+		if err := json.Unmarshal(postureJSON, p.Posture); err != nil { p.Posture = nil }
+	}
+	return nil
+}
+
+// authorizePeer checks that userID owns the peer or is an owner or admin of
+// its network, and returns the peer's network ID.
+func authorizePeer(ctx context.Context, db *sql.DB, peerID, userID string) (string, int, error) {
+	var networkID, ownerID string
+	err := db.QueryRowContext(ctx, "SELECT network_id, user_id FROM peers WHERE id = $1", peerID).Scan(&networkID, &ownerID)
+	if err == sql.ErrNoRows { return "", http.StatusNotFound, errors.New("peer not found") }
+	if err != nil { return "", http.StatusInternalServerError, err }
+	// Removing a member leaves their peers behind; they stay manageable by
+	// the network's admins only.
+	role, err := memberRole(ctx, db, networkID, userID)
+	if err == sql.ErrNoRows { return "", http.StatusForbidden, errors.New("not a member of this network") }
+	if err != nil { return "", http.StatusInternalServerError, err }
+	if ownerID != userID && !isNetworkAdmin(role) { return "", http.StatusForbidden, errors.New("not authorized to manage this peer") }
+	return networkID, 0, nil
+}
+
+// nextVirtualIP returns the lowest free address in the network's range,
+// skipping the network address, the first host (.1) and the broadcast
+// address.
 func nextVirtualIP(db *sql.DB, networkID string) (string, error) {
+	prefix, err := networkPrefix(context.Background(), db, networkID)
+	if err != nil { return "", fmt.Errorf("network range: %w", err) }
 	rows, err := db.Query("SELECT virtual_ip FROM peers WHERE network_id = $1", networkID)
 	if err != nil { return "", fmt.Errorf("query peers: %w", err) }
 	defer rows.Close()
 	used := make(map[string]bool)
 	for rows.Next() { var ip string; if err := rows.Scan(&ip); err == nil { used[ip] = true } }
-	for i := 2; i <= 254; i++ { ip := fmt.Sprintf("10.10.0.%d", i); if !used[ip] { return ip, nil } }
-	return "", fmt.Errorf("no available IP addresses in 10.10.0.0/24")
+	for ip := prefix.Addr().Next().Next(); prefix.Contains(ip.Next()); ip = ip.Next() { if !used[ip.String()] { return ip.String(), nil } }
+	return "", fmt.Errorf("no available IP addresses in %s", prefix)
 }
 
 func getPeers(db *sql.DB, networkID string) ([]Peer, error) {
-	rows, err := db.Query("SELECT id, network_id, user_id, public_key, endpoint, virtual_ip, last_seen, created_at FROM peers WHERE network_id = $1 ORDER BY created_at", networkID)
+	rows, err := db.Query("SELECT "+peerColumns+" FROM peers p JOIN networks n ON n.id = p.network_id WHERE p.network_id = $1 ORDER BY p.created_at", networkID)
 	if err != nil { return nil, err }
 	defer rows.Close()
 	var peers []Peer
 	for rows.Next() {
 		var p Peer
-		if err := rows.Scan(&p.ID, &p.NetworkID, &p.UserID, &p.PublicKey, &p.Endpoint, &p.VirtualIP, &p.LastSeen, &p.CreatedAt); err != nil { continue }
+		if err := scanPeer(rows, &p); err != nil { continue }
 		peers = append(peers, p)
 	}
 	if peers == nil { peers = []Peer{} }
 	return peers, nil
 }
+
+// redactPeers hides each peer's rotated-out key from everyone but the peer's
+// owner: until its grace window closes the old key still resolves to the
+// peer on Join. Pass an empty viewer for payloads every member receives.
+func redactPeers(peers []Peer, viewer string) []Peer {
+	for i := range peers {
+		if peers[i].UserID != viewer { peers[i].PreviousPublicKey = nil }
+	}
+	return peers
+}
+
+func getPeer(ctx context.Context, db *sql.DB, peerID string) (*Peer, error) {
+	var p Peer
+	err := scanPeer(db.QueryRowContext(ctx, "SELECT "+peerColumns+" FROM peers p JOIN networks n ON n.id = p.network_id WHERE p.id = $1", peerID), &p)
+	if err != nil { return nil, err }
+	return &p, nil
+}
+
+// searchPeers lists a network's peers carrying every tag in tags whose
+// hostname or description contains q.
+func searchPeers(ctx context.Context, db *sql.DB, networkID string, tags []string, q string) ([]Peer, error) {
+	if tags == nil { tags = []string{} }
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q) + "%"
+	rows, err := db.QueryContext(ctx,
+		"SELECT "+peerColumns+" FROM peers p JOIN networks n ON n.id = p.network_id WHERE p.network_id = $1 AND p.tags @> $2 AND ($3 = '' OR p.hostname ILIKE $4 OR p.description ILIKE $4) ORDER BY p.created_at",
+		networkID, pq.Array(tags), q, pattern)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	peers := []Peer{}
+	for rows.Next() {
+		var p Peer
+		if err := scanPeer(rows, &p); err != nil { continue }
+		peers = append(peers, p)
+	}
+	return peers, rows.Err()
+}
+
+var (
+	peerHostnameRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+	peerTagRe      = regexp.MustCompile(`^[a-z0-9][a-z0-9_.:-]{0,62}$`)
+)
+
+const (
+	maxPeerTags        = 32
+	maxPeerDescription = 500
+)
+
+// normalizePeerHostname lower-cases h and checks that it is a single DNS
+// label, so it can be used as <hostname>.<network> inside the mesh.
+func normalizePeerHostname(h string) (string, bool) {
+	h = strings.ToLower(strings.TrimSpace(h))
+	return h, h == "" || peerHostnameRe.MatchString(h)
+}
+
+// normalizePeerTags lower-cases, validates and de-duplicates tags.
+func normalizePeerTags(tags []string) ([]string, error) {
+	if len(tags) > maxPeerTags { return nil, fmt.Errorf("at most %d tags are allowed", maxPeerTags) }
+	out := []string{}
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if !peerTagRe.MatchString(t) { return nil, fmt.Errorf("invalid tag %q", t) }
+		if !seen[t] { seen[t] = true; out = append(out, t) }
+	}
+	return out, nil
+}
+// checkKeyReuse enforces REJECT_SHARED_KEYS: a public key registered by a
+// different user in another network may not be reused.
+func (h *PeersHandler) checkKeyReuse(ctx context.Context, publicKey, networkID, userID string) (int, error) {
+	if h.Cfg == nil || !h.Cfg.RejectSharedKeys { return 0, nil }
+	var mc int
+	err := h.DB.QueryRowContext(ctx, "SELECT 1 FROM peers WHERE public_key = $1 AND network_id <> $2 AND user_id <> $3 LIMIT 1", publicKey, networkID, userID).Scan(&mc)
+	if err == sql.ErrNoRows { return 0, nil }
+	if err != nil { return http.StatusInternalServerError, err }
+	return http.StatusBadRequest, errors.New("public_key is already registered by another user")
+}
+
+// POST /api/peers/join
 func (h *PeersHandler) Join(w http.ResponseWriter, r *http.Request) {
 	userID := mw.UserIDFromContext(r.Context())
-	var req struct { NetworkID string `json:"network_id"`; PublicKey string `json:"public_key"`; Endpoint string `json:"endpoint"` }
+	var req struct {
+		NetworkID string          `json:"network_id"`
+		PublicKey string          `json:"public_key"`
+		Endpoint  string          `json:"endpoint"`
+		KeyMode   string          `json:"key_mode"`
+		Posture   *posture.Report `json:"posture"`
+	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
-	if req.NetworkID == "" || req.PublicKey == "" { jsonError(w, "network_id and public_key are required", http.StatusBadRequest); return }
+	if req.KeyMode == "" { req.KeyMode = keyModeClient }
+	if req.NetworkID == "" { jsonError(w, "network_id is required", http.StatusBadRequest); return }
+	var serverKey wireguard.Key
+	switch req.KeyMode {
+	case keyModeClient:
+		if req.PublicKey == "" { jsonError(w, "public_key is required", http.StatusBadRequest); return }
+		if _, err := wireguard.ParseKey(req.PublicKey); err != nil { jsonError(w, "invalid public_key: "+err.Error(), http.StatusBadRequest); return }
+	case keyModeServer:
+		if h.Keys == nil { jsonError(w, errServerKeysDisabled.Error(), http.StatusBadRequest); return }
+		if req.PublicKey != "" { jsonError(w, "public_key must be omitted when key_mode is server", http.StatusBadRequest); return }
+	default:
+		jsonError(w, "key_mode must be client or server", http.StatusBadRequest)
+		return
+	}
+	if req.Endpoint != "" {
+		ep, err := wireguard.ParseEndpoint(req.Endpoint)
+		if err != nil { jsonError(w, "invalid endpoint: "+err.Error(), http.StatusBadRequest); return }
+		req.Endpoint = ep
+	}
 	var mc int
 	err := h.DB.QueryRowContext(r.Context(), "SELECT 1 FROM network_members WHERE network_id = $1 AND user_id = $2", req.NetworkID, userID).Scan(&mc)
 	if err == sql.ErrNoRows { jsonError(w, "not a member of this network", http.StatusForbidden); return }
 	if err != nil { log.Printf("member check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if req.Posture != nil { req.Posture.Normalize() }
+	rules, err := loadPostureRules(r.Context(), h.DB, req.NetworkID)
+	if err != nil { log.Printf("posture rules error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	failures := evaluatePosture(rules, req.Posture)
+	if len(failures) > 0 && rules.Action == posture.ActionReject {
+		logActivity(h.DB, req.NetworkID, userID, "posture_rejected", map[string]interface{}{"public_key": req.PublicKey, "failures": failures})
+		jsonOK(w, http.StatusForbidden, map[string]interface{}{"error": "device does not meet the network's posture requirements", "failures": failures})
+		return
+	}
+	// A key that was rotated out but is still inside its grace window keeps
+	// resolving to the caller's existing peer instead of registering a new
+	// one.
+	var rotatedID, rotatedIP string
+	err = h.DB.QueryRowContext(r.Context(),
+		"UPDATE peers SET endpoint = $3, last_seen = NOW() WHERE network_id = $1 AND previous_public_key = $2 AND previous_key_expires_at > NOW() AND user_id = $4 RETURNING id, virtual_ip",
+		req.NetworkID, req.PublicKey, req.Endpoint, userID).Scan(&rotatedID, &rotatedIP)
+	if err == nil {
+		if err := recordPosture(r.Context(), h.DB, h.Broker, req.NetworkID, rotatedID, userID, req.Posture, failures); err != nil { log.Printf("record posture error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+		peers, err := getPeers(h.DB, req.NetworkID)
+		if err != nil { log.Printf("get peers error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+		jsonOK(w, http.StatusOK, map[string]interface{}{"virtual_ip": rotatedIP, "peer_id": rotatedID, "key_rotated": true, "peers": redactPeers(peers, userID)})
+		return
+	}
+	if err != sql.ErrNoRows { log.Printf("rotated key lookup error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if req.KeyMode == keyModeServer {
+		priv, pub, err := wireguard.GenerateKeyPair()
+		if err != nil { log.Printf("generate key error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+		serverKey, req.PublicKey = priv, pub.String()
+	}
+	if code, err := h.checkKeyReuse(r.Context(), req.PublicKey, req.NetworkID, userID); err != nil {
+		if code == http.StatusInternalServerError { log.Printf("key reuse check error: %v", err); jsonError(w, "internal error", code); return }
+		jsonError(w, err.Error(), code)
+		return
+	}
 	vip, err := nextVirtualIP(h.DB, req.NetworkID)
 	if err != nil { log.Printf("nextVirtualIP error: %v", err); jsonError(w, "no available IPs", http.StatusConflict); return }
 	var peerID string
-	err = h.DB.QueryRowContext(r.Context(),
-		"INSERT INTO peers (network_id, user_id, public_key, endpoint, virtual_ip) VALUES ($1,$2,$3,$4,$5) ON CONFLICT (network_id, public_key) DO UPDATE SET endpoint=EXCLUDED.endpoint, last_seen=NOW() RETURNING id, virtual_ip",
-		req.NetworkID, userID, req.PublicKey, req.Endpoint, vip).Scan(&peerID, &vip)
+	inserted := true
+	if req.KeyMode == keyModeServer {
+		peerID, err = h.insertServerPeer(r.Context(), req.NetworkID, userID, req.PublicKey, req.Endpoint, vip, serverKey)
+	} else {
+		// xmax is 0 only when the row was inserted rather than updated.
+		err = h.DB.QueryRowContext(r.Context(),
+			"INSERT INTO peers (network_id, user_id, public_key, endpoint, virtual_ip) VALUES ($1,$2,$3,$4,$5) ON CONFLICT (network_id, public_key) DO UPDATE SET endpoint=EXCLUDED.endpoint, last_seen=NOW() RETURNING id, virtual_ip, xmax = 0",
+			req.NetworkID, userID, req.PublicKey, req.Endpoint, vip).Scan(&peerID, &vip, &inserted)
+	}
 	if err != nil { log.Printf("peer upsert error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if err := recordPosture(r.Context(), h.DB, h.Broker, req.NetworkID, peerID, userID, req.Posture, failures); err != nil { log.Printf("record posture error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
 	peers, err := getPeers(h.DB, req.NetworkID)
 	if err != nil { log.Printf("get peers error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
-	logActivity(h.DB, req.NetworkID, userID, "peer_joined", map[string]interface{}{"public_key": req.PublicKey, "virtual_ip": vip})
-	h.Broker.PublishToNetwork(req.NetworkID, "peers", sse.Event{Type: "peer_joined", Payload: peers})
-	jsonOK(w, http.StatusOK, map[string]interface{}{"virtual_ip": vip, "peers": peers})
+	dns, err := h.effectiveDNS(r.Context(), req.NetworkID)
+	if err != nil { log.Printf("dns config error: %v", err) }
+	logActivity(h.DB, req.NetworkID, userID, "peer_joined", map[string]interface{}{"public_key": req.PublicKey, "virtual_ip": vip, "key_mode": req.KeyMode})
+	change := peerChange{Added: []string{peerID}}
+	if !inserted { change = peerChange{Updated: []string{peerID}} }
+	publishPeers(h.DB, h.Broker, req.NetworkID, "peer_joined", change)
+	jsonOK(w, http.StatusOK, map[string]interface{}{"virtual_ip": vip, "peer_id": peerID, "public_key": req.PublicKey, "key_mode": req.KeyMode, "quarantined": len(failures) > 0, "failures": failures, "peers": redactPeers(peers, userID), "dns": dns})
+}
+
+// insertServerPeer registers a server-managed peer and stores its encrypted
+// private key in one transaction.
+func (h *PeersHandler) insertServerPeer(ctx context.Context, networkID, userID, publicKey, endpoint, vip string, priv wireguard.Key) (string, error) {
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil { return "", err }
+	defer tx.Rollback()
+	var peerID string
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO peers (network_id, user_id, public_key, key_mode, endpoint, virtual_ip) VALUES ($1,$2,$3,$4,$5,$6) RETURNING id",
+		networkID, userID, publicKey, keyModeServer, endpoint, vip).Scan(&peerID)
+	if err != nil { return "", err }
+	if err := storePrivateKey(ctx, tx, h.Keys, peerID, priv); err != nil { return "", err }
+	return peerID, tx.Commit()
 }
 
 func (h *PeersHandler) List(w http.ResponseWriter, r *http.Request) {
@@ -80,22 +315,146 @@ func (h *PeersHandler) List(w http.ResponseWriter, r *http.Request) {
 	err := h.DB.QueryRowContext(r.Context(), "SELECT 1 FROM network_members WHERE network_id = $1 AND user_id = $2", networkID, userID).Scan(&mc)
 	if err == sql.ErrNoRows { jsonError(w, "not a member of this network", http.StatusForbidden); return }
 	if err != nil { log.Printf("member check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
-	peers, err := getPeers(h.DB, networkID)
+	tags, err := normalizePeerTags(r.URL.Query()["tag"])
+	if err != nil { jsonError(w, err.Error(), http.StatusBadRequest); return }
+	version, done := currentVersion(w, r, h.DB, h.Broker, networkID)
+	if done { return }
+	peers, err := searchPeers(r.Context(), h.DB, networkID, tags, strings.TrimSpace(r.URL.Query().Get("q")))
 	if err != nil { log.Printf("get peers error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
-	jsonOK(w, http.StatusOK, map[string]interface{}{"peers": peers})
+	if checkETag(w, r, peerListETag(version, peers)) { return }
+	dns, err := h.effectiveDNS(r.Context(), networkID)
+	if err != nil { log.Printf("dns config error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	jsonOK(w, http.StatusOK, map[string]interface{}{"peers": redactPeers(peers, userID), "dns": dns, "config_version": version})
 }
 
-func (h *PeersHandler) Delete(w http.ResponseWriter, r *http.Request) {
+// PATCH /api/peers/:id
+func (h *PeersHandler) Update(w http.ResponseWriter, r *http.Request) {
 	userID := mw.UserIDFromContext(r.Context())
 	peerID := mux.Vars(r)["id"]
-	var networkID string
-	err := h.DB.QueryRowContext(r.Context(), "SELECT network_id FROM peers WHERE id = $1", peerID).Scan(&networkID)
+	var req struct {
+		Hostname    *string   `json:"hostname"`
+		Description *string   `json:"description"`
+		OS          *string   `json:"os"`
+		Tags        *[]string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
+	changed := map[string]interface{}{"peer_id": peerID}
+	if req.Hostname != nil {
+		h, ok := normalizePeerHostname(*req.Hostname)
+		if !ok { jsonError(w, "hostname must be a single DNS label (letters, digits and hyphens, max 63 characters)", http.StatusBadRequest); return }
+		req.Hostname = &h
+		changed["hostname"] = h
+	}
+	if req.Description != nil {
+		d := strings.TrimSpace(*req.Description)
+		if len(d) > maxPeerDescription { jsonError(w, fmt.Sprintf("description must be at most %d characters", maxPeerDescription), http.StatusBadRequest); return }
+		req.Description = &d
+		changed["description"] = d
+	}
+	if req.OS != nil {
+		o := strings.ToLower(strings.TrimSpace(*req.OS))
+		if len(o) > 64 { jsonError(w, "os must be at most 64 characters", http.StatusBadRequest); return }
+		req.OS = &o
+		changed["os"] = o
+	}
+	var tags interface{}
+	if req.Tags != nil {
+		list, err := normalizePeerTags(*req.Tags)
+		if err != nil { jsonError(w, err.Error(), http.StatusBadRequest); return }
+		tags = pq.Array(list)
+		changed["tags"] = list
+	}
+	networkID, code, err := authorizePeer(r.Context(), h.DB, peerID, userID)
+	if code == http.StatusInternalServerError { log.Printf("peer auth error: %v", err); jsonError(w, "internal error", code); return }
+	if err != nil { jsonError(w, err.Error(), code); return }
+	if req.Tags != nil {
+		// Tags select peers for peerings, so only admins may set them.
+		role, err := memberRole(r.Context(), h.DB, networkID, userID)
+		if err != nil { log.Printf("member check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+		if !isNetworkAdmin(role) { jsonError(w, "only network admins can change tags", http.StatusForbidden); return }
+	}
+	_, err = h.DB.ExecContext(r.Context(),
+		"UPDATE peers SET hostname = COALESCE($2, hostname), description = COALESCE($3, description), os = COALESCE($4, os), tags = COALESCE($5, tags) WHERE id = $1",
+		peerID, req.Hostname, req.Description, req.OS, tags)
+	if isUniqueViolation(err) { jsonError(w, "another peer in this network already uses that hostname", http.StatusConflict); return }
+	if err != nil { log.Printf("update peer error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	p, err := getPeer(r.Context(), h.DB, peerID)
 	if err == sql.ErrNoRows { jsonError(w, "peer not found", http.StatusNotFound); return }
 	if err != nil { log.Printf("peer query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	logActivity(h.DB, networkID, userID, "peer_updated", changed)
+	publishPeers(h.DB, h.Broker, networkID, "peer_updated", peerChange{Updated: []string{peerID}})
+	jsonOK(w, http.StatusOK, redactPeers([]Peer{*p}, userID)[0])
+}
+
+// DELETE /api/peers/:id
+// Removing a peer also drops its preshared keys (peer_psks cascades).
+func (h *PeersHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	peerID := mux.Vars(r)["id"]
+	networkID, code, err := authorizePeer(r.Context(), h.DB, peerID, userID)
+	if code == http.StatusInternalServerError { log.Printf("peer auth error: %v", err); jsonError(w, "internal error", code); return }
+	if err != nil { jsonError(w, err.Error(), code); return }
 	_, err = h.DB.ExecContext(r.Context(), "DELETE FROM peers WHERE id = $1", peerID)
 	if err != nil { log.Printf("delete peer error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
 	logActivity(h.DB, networkID, userID, "peer_left", map[string]interface{}{"peer_id": peerID})
-	ps, _ := getPeers(h.DB, networkID)
-	h.Broker.PublishToNetwork(networkID, "peers", sse.Event{Type: "peer_left", Payload: ps})
+	publishPeers(h.DB, h.Broker, networkID, "peer_left", peerChange{Removed: []string{peerID}})
 	jsonOK(w, http.StatusOK, map[string]string{"message": "peer removed"})
 }
+
+// POST /api/peers/:id/rotate-key
+// Other peers' configs switch to the new key at once. grace_seconds only
+// keeps the old key resolving to this peer on Join, so a device that has not
+// switched yet can fetch its new config.
+func (h *PeersHandler) RotateKey(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	peerID := mux.Vars(r)["id"]
+	var req struct { PublicKey string `json:"public_key"`; GraceSeconds int `json:"grace_seconds"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
+	grace := time.Duration(req.GraceSeconds) * time.Second
+	if grace < 0 || grace > maxKeyGrace { jsonError(w, "grace_seconds must be between 0 and 604800", http.StatusBadRequest); return }
+	networkID, code, err := authorizePeer(r.Context(), h.DB, peerID, userID)
+	if code == http.StatusInternalServerError { log.Printf("peer auth error: %v", err); jsonError(w, "internal error", code); return }
+	if err != nil { jsonError(w, err.Error(), code); return }
+	var ownerID, keyMode string
+	if err := h.DB.QueryRowContext(r.Context(), "SELECT user_id, key_mode FROM peers WHERE id = $1", peerID).Scan(&ownerID, &keyMode); err != nil { log.Printf("peer owner query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	// Server-managed peers get a fresh server-generated keypair; client
+	// peers must supply their new public key.
+	var serverKey wireguard.Key
+	if keyMode == keyModeServer {
+		if h.Keys == nil { jsonError(w, errServerKeysDisabled.Error(), http.StatusServiceUnavailable); return }
+		if req.PublicKey != "" { jsonError(w, "public_key must be omitted for server-managed peers", http.StatusBadRequest); return }
+		priv, pub, err := wireguard.GenerateKeyPair()
+		if err != nil { log.Printf("generate key error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+		serverKey, req.PublicKey = priv, pub.String()
+	} else {
+		if req.PublicKey == "" { jsonError(w, "public_key is required", http.StatusBadRequest); return }
+		if _, err := wireguard.ParseKey(req.PublicKey); err != nil { jsonError(w, "invalid public_key: "+err.Error(), http.StatusBadRequest); return }
+	}
+	if code, err := h.checkKeyReuse(r.Context(), req.PublicKey, networkID, ownerID); err != nil {
+		if code == http.StatusInternalServerError { log.Printf("key reuse check error: %v", err); jsonError(w, "internal error", code); return }
+		jsonError(w, err.Error(), code)
+		return
+	}
+	tx, err := h.DB.BeginTx(r.Context(), nil)
+	if err != nil { log.Printf("begin tx error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	defer tx.Rollback()
+	var oldKey, vip string
+	err = tx.QueryRowContext(r.Context(),
+		`UPDATE peers p SET public_key = $2, key_created_at = NOW(),
+			previous_public_key = CASE WHEN $3 > 0 THEN old.public_key END,
+			previous_key_expires_at = CASE WHEN $3 > 0 THEN NOW() + $3 * INTERVAL '1 second' END
+		 FROM peers old WHERE p.id = $1 AND old.id = p.id RETURNING old.public_key, p.virtual_ip`,
+		peerID, req.PublicKey, int(grace.Seconds())).Scan(&oldKey, &vip)
+	if isUniqueViolation(err) { jsonError(w, "public_key is already registered in this network", http.StatusConflict); return }
+	if err == sql.ErrNoRows { jsonError(w, "peer not found", http.StatusNotFound); return }
+	if err != nil { log.Printf("rotate key error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if keyMode == keyModeServer {
+		if err := storePrivateKey(r.Context(), tx, h.Keys, peerID, serverKey); err != nil { log.Printf("store private key error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	}
+	if err := tx.Commit(); err != nil { log.Printf("commit error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	logActivity(h.DB, networkID, userID, "key_rotated", map[string]interface{}{"peer_id": peerID, "old_public_key": oldKey, "public_key": req.PublicKey, "grace_seconds": int(grace.Seconds())})
+	publishPeers(h.DB, h.Broker, networkID, "key_rotated", peerChange{Updated: []string{peerID}})
+	peers, err := getPeers(h.DB, networkID)
+	if err != nil { log.Printf("get peers error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	jsonOK(w, http.StatusOK, map[string]interface{}{"virtual_ip": vip, "peers": redactPeers(peers, userID)})
+}
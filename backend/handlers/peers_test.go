@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/wgcloudctrl/server/sse"
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+func TestRedactPeers(t *testing.T) {
+	old := "b2xkLWtleQ=="
+	peers := func() []Peer {
+		return []Peer{{ID: "p1", UserID: "alice", PreviousPublicKey: &old}, {ID: "p2", UserID: "bob", PreviousPublicKey: &old}}
+	}
+	got := redactPeers(peers(), "alice")
+	if got[0].PreviousPublicKey == nil { t.Error("owner lost their own previous key") }
+	if got[1].PreviousPublicKey != nil { t.Error("previous key shown to another member") }
+	for _, p := range redactPeers(peers(), "") {
+		if p.PreviousPublicKey != nil { t.Errorf("peer %s: previous key in a broadcast payload", p.ID) }
+	}
+}
+
+func TestOnlyAdminsChangePeerTags(t *testing.T) {
+	db := testDB(t)
+	owner, _ := createUser(t, db)
+	member, _ := createUser(t, db)
+	netID := createNetwork(t, db, owner, map[string]string{member: "member"})
+	peerID := createPeer(t, db, netID, member, "10.10.0.2")
+	h := &PeersHandler{DB: db, Broker: sse.NewBroker()}
+	update := func(userID, body string) int {
+		req := httptest.NewRequest("PATCH", "/api/peers/"+peerID, strings.NewReader(body))
+		req = mux.SetURLVars(req.WithContext(asUser(req.Context(), userID)), map[string]string{"id": peerID})
+		rec := httptest.NewRecorder()
+		h.Update(rec, req)
+		return rec.Code
+	}
+	tags := func() []string {
+		var list []string
+		if err := db.QueryRow("SELECT tags FROM peers WHERE id = $1", peerID).Scan(pq.Array(&list)); err != nil { t.Fatal(err) }
+		return list
+	}
+
+	// The owner of the peer may edit its other fields, but not tag it into a
+	// peering.
+	if code := update(member, `{"description":"laptop"}`); code != http.StatusOK { t.Errorf("owner edits description: status %d", code) }
+	if code := update(member, `{"tags":["peered"]}`); code != http.StatusForbidden { t.Errorf("owner sets tags: status %d, want 403", code) }
+	if got := tags(); len(got) != 0 { t.Errorf("tags = %v after a refused update", got) }
+	if code := update(owner, `{"tags":["peered"]}`); code != http.StatusOK { t.Errorf("admin sets tags: status %d", code) }
+	if got := tags(); len(got) != 1 || got[0] != "peered" { t.Errorf("tags = %v, want [peered]", got) }
+}
+
+func TestRotateKeyGrace(t *testing.T) {
+	db := testDB(t)
+	owner, _ := createUser(t, db)
+	member, _ := createUser(t, db)
+	netID := createNetwork(t, db, owner, map[string]string{member: "member"})
+	peerID := createPeer(t, db, netID, member, "10.10.0.2")
+	otherID := createPeer(t, db, netID, owner, "10.10.0.3")
+	h := &PeersHandler{DB: db, Broker: sse.NewBroker()}
+	call := func(handler http.HandlerFunc, userID, path, body string, vars map[string]string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req = mux.SetURLVars(req.WithContext(asUser(req.Context(), userID)), vars)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		var resp map[string]interface{}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+	rotate := func(grace int) (oldKey, newKey string) {
+		if err := db.QueryRow("SELECT public_key FROM peers WHERE id = $1", peerID).Scan(&oldKey); err != nil { t.Fatal(err) }
+		_, pub, err := wireguard.GenerateKeyPair()
+		if err != nil { t.Fatal(err) }
+		code, resp := call(h.RotateKey, member, "/api/peers/"+peerID+"/rotate-key", `{"public_key":"`+pub.String()+`","grace_seconds":`+strconv.Itoa(grace)+`}`, map[string]string{"id": peerID})
+		if code != http.StatusOK || resp["virtual_ip"] != "10.10.0.2" { t.Fatalf("rotate: status %d, response %v", code, resp) }
+		return oldKey, pub.String()
+	}
+	join := func(key string) (int, map[string]interface{}) {
+		return call(h.Join, member, "/api/peers/join", `{"network_id":"`+netID+`","public_key":"`+key+`"}`, nil)
+	}
+	renderedKeys := func() []string {
+		self, err := getPeer(context.Background(), db, otherID)
+		if err != nil { t.Fatal(err) }
+		cfg, err := h.buildPeerConfig(context.Background(), self)
+		if err != nil { t.Fatal(err) }
+		var keys []string
+		for _, p := range cfg.Peers { keys = append(keys, p.PublicKey) }
+		return keys
+	}
+
+	oldKey, newKey := rotate(3600)
+	// Other peers only ever see the new key.
+	if keys := renderedKeys(); len(keys) != 1 || keys[0] != newKey { t.Errorf("other peer's config has keys %v, want only %s", keys, newKey) }
+	// Within the grace window the old key resolves to the same peer.
+	code, resp := join(oldKey)
+	if code != http.StatusOK || resp["peer_id"] != peerID || resp["key_rotated"] != true { t.Errorf("join with the old key in the grace window: status %d, response %v", code, resp) }
+
+	// Once the window has closed the old key is just an unknown key again.
+	if _, err := db.Exec("UPDATE peers SET previous_key_expires_at = NOW() - INTERVAL '1 second' WHERE id = $1", peerID); err != nil { t.Fatal(err) }
+	code, resp = join(oldKey)
+	if code != http.StatusOK || resp["peer_id"] == peerID || resp["key_rotated"] != nil { t.Errorf("join with the old key after the window: status %d, response %v", code, resp) }
+
+	// Without a grace window nothing of the old key is kept.
+	rotate(0)
+	var prev *string
+	if err := db.QueryRow("SELECT previous_public_key FROM peers WHERE id = $1", peerID).Scan(&prev); err != nil { t.Fatal(err) }
+	if prev != nil { t.Errorf("previous_public_key = %q after a rotation without grace", *prev) }
+}
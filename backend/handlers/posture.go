@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	mw "github.com/wgcloudctrl/server/middleware"
+	"github.com/wgcloudctrl/server/posture"
+	"github.com/wgcloudctrl/server/sse"
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+// loadPostureRules returns the network's posture rules, or nil if it has none.
+func loadPostureRules(ctx context.Context, db *sql.DB, networkID string) (*posture.Rules, error) {
+	var raw []byte
+	if err := db.QueryRowContext(ctx, "SELECT posture_rules FROM networks WHERE id = $1", networkID).Scan(&raw); err != nil { return nil, err }
+	if raw == nil { return nil, nil }
+	var rules posture.Rules
+	if err := json.Unmarshal(raw, &rules); err != nil { return nil, err }
+	return &rules, nil
+}
+
+// evaluatePosture returns the failed rules for report, or nil when the
+// network has no rules.
+func evaluatePosture(rules *posture.Rules, report *posture.Report) []posture.Failure {
+	if rules == nil { return nil }
+	return rules.Evaluate(report)
+}
+
+// recordPosture stores the peer's posture report (when given) and quarantine
+// state. Transitions into and out of quarantine are logged with the failed
+// rules and announced on the peers topic so other peers re-fetch configs.
+func recordPosture(ctx context.Context, db *sql.DB, broker *sse.Broker, networkID, peerID, userID string, report *posture.Report, failures []posture.Failure) error {
+	var reportJSON interface{}
+	if report != nil {
+		b, err := json.Marshal(report)
+		if err != nil { return err }
+		reportJSON = string(b)
+	}
+	quarantined := len(failures) > 0
+	var wasQuarantined bool
+	err := db.QueryRowContext(ctx,
+		`UPDATE peers p SET posture = COALESCE($2::jsonb, p.posture), posture_reported_at = CASE WHEN $2::jsonb IS NULL THEN p.posture_reported_at ELSE NOW() END,
+			quarantined = $3, quarantine_reason = $4
+		 FROM peers old WHERE p.id = $1 AND old.id = p.id RETURNING old.quarantined`,
+		peerID, reportJSON, quarantined, posture.Summary(failures)).Scan(&wasQuarantined)
+	if err != nil { return err }
+	if quarantined == wasQuarantined { return nil }
+	evt := "peer_released"
+	meta := map[string]interface{}{"peer_id": peerID}
+	if quarantined { evt = "peer_quarantined"; meta["failures"] = failures }
+	logActivity(db, networkID, userID, evt, meta)
+	publishPeers(db, broker, networkID, evt, peerChange{Updated: []string{peerID}})
+	return nil
+}
+
+// reevaluateNetworkPosture applies new rules to every peer's last reported
+// posture. With rules == nil all peers are released.
+func reevaluateNetworkPosture(ctx context.Context, db *sql.DB, broker *sse.Broker, networkID, userID string, rules *posture.Rules) error {
+	rows, err := db.QueryContext(ctx, "SELECT id, posture FROM peers WHERE network_id = $1", networkID)
+	if err != nil { return err }
+	type state struct { id string; report *posture.Report }
+	var peers []state
+	for rows.Next() {
+		var s state
+		var raw []byte
+		if err := rows.Scan(&s.id, &raw); err != nil { rows.Close(); return err }
+		if raw != nil {
+			s.report = &posture.Report{}
+			if err := json.Unmarshal(raw, s.report); err != nil { s.report = nil }
+		}
+		peers = append(peers, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil { return err }
+	for _, s := range peers {
+		if err := recordPosture(ctx, db, broker, networkID, s.id, userID, nil, evaluatePosture(rules, s.report)); err != nil { return err }
+	}
+	return nil
+}
+
+// POST /api/peers/:id/heartbeat
+// Called periodically by the device that owns the peer. Updates last_seen and
+// the endpoint (announcing it when it changed), and re-evaluates posture when
+// a report is included. A failing device that has already joined is
+// quarantined whatever the rule action.
+func (h *PeersHandler) Heartbeat(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	peerID := mux.Vars(r)["id"]
+	var req struct { Endpoint string `json:"endpoint"`; Posture *posture.Report `json:"posture"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
+	if req.Endpoint != "" {
+		ep, err := wireguard.ParseEndpoint(req.Endpoint)
+		if err != nil { jsonError(w, "invalid endpoint: "+err.Error(), http.StatusBadRequest); return }
+		req.Endpoint = ep
+	}
+	var networkID string
+	var quarantined, moved bool
+	err := h.DB.QueryRowContext(r.Context(),
+		`UPDATE peers p SET last_seen = NOW(), endpoint = COALESCE(NULLIF($3, ''), p.endpoint)
+		 FROM peers old WHERE p.id = $1 AND p.user_id = $2 AND old.id = p.id RETURNING p.network_id, p.quarantined, p.endpoint IS DISTINCT FROM old.endpoint`,
+		peerID, userID, req.Endpoint).Scan(&networkID, &quarantined, &moved)
+	if err == sql.ErrNoRows { jsonError(w, "peer not found", http.StatusNotFound); return }
+	if err != nil { log.Printf("heartbeat error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	// A new endpoint changes every other peer's config.
+	if moved { publishPeers(h.DB, h.Broker, networkID, "peer_updated", peerChange{Updated: []string{peerID}}) }
+	failures := []posture.Failure{}
+	if req.Posture != nil {
+		req.Posture.Normalize()
+		rules, err := loadPostureRules(r.Context(), h.DB, networkID)
+		if err != nil { log.Printf("posture rules error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+		if fs := evaluatePosture(rules, req.Posture); fs != nil { failures = fs }
+		if err := recordPosture(r.Context(), h.DB, h.Broker, networkID, peerID, userID, req.Posture, failures); err != nil { log.Printf("record posture error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+		quarantined = len(failures) > 0
+	}
+	jsonOK(w, http.StatusOK, map[string]interface{}{"quarantined": quarantined, "failures": failures})
+}
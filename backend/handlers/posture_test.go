@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wgcloudctrl/server/sse"
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+func TestJoinEnforcesPostureAction(t *testing.T) {
+	db := testDB(t)
+	owner, _ := createUser(t, db)
+	netID := createNetwork(t, db, owner, nil)
+	h := &PeersHandler{DB: db, Broker: sse.NewBroker()}
+	join := func(body string) (int, map[string]interface{}) {
+		_, pub, err := wireguard.GenerateKeyPair()
+		if err != nil { t.Fatal(err) }
+		req := httptest.NewRequest("POST", "/api/peers/join", strings.NewReader(`{"network_id":"`+netID+`","public_key":"`+pub.String()+`"`+body+`}`))
+		req = req.WithContext(asUser(req.Context(), owner))
+		rec := httptest.NewRecorder()
+		h.Join(rec, req)
+		var resp map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil { t.Fatal(err) }
+		return rec.Code, resp
+	}
+	setAction := func(action string) {
+		if _, err := db.Exec(`UPDATE networks SET posture_rules = $2 WHERE id = $1`, netID, `{"action":"`+action+`","require_firewall":true}`); err != nil { t.Fatal(err) }
+	}
+	peerCount := func() int {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM peers WHERE network_id = $1", netID).Scan(&n); err != nil { t.Fatal(err) }
+		return n
+	}
+	const failing = `,"posture":{"os":"linux","firewall_enabled":false}`
+
+	setAction("reject")
+	code, resp := join(failing)
+	if code != http.StatusForbidden || resp["failures"] == nil { t.Errorf("reject: status %d, response %v; want 403 with failures", code, resp) }
+	if n := peerCount(); n != 0 { t.Errorf("reject registered %d peers", n) }
+	// Without a report the firewall counts as disabled.
+	if code, _ := join(""); code != http.StatusForbidden { t.Errorf("reject without posture: status %d, want 403", code) }
+
+	setAction("quarantine")
+	code, resp = join(failing)
+	if code != http.StatusOK || resp["quarantined"] != true { t.Fatalf("quarantine: status %d, response %v; want 200 and quarantined", code, resp) }
+	var quarantined bool
+	var reason string
+	if err := db.QueryRow("SELECT quarantined, quarantine_reason FROM peers WHERE id = $1", resp["peer_id"]).Scan(&quarantined, &reason); err != nil { t.Fatal(err) }
+	if !quarantined || !strings.Contains(reason, "firewall") { t.Errorf("stored quarantined = %v, reason %q", quarantined, reason) }
+
+	code, resp = join(`,"posture":{"os":"linux","firewall_enabled":true}`)
+	if code != http.StatusOK || resp["quarantined"] != false { t.Errorf("compliant: status %d, response %v", code, resp) }
+}
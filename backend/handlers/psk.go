@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/wgcloudctrl/server/keystore"
+	mw "github.com/wgcloudctrl/server/middleware"
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+// Network preshared key modes. In pair mode every pair of peers shares its
+// own PSK; in hub mode only tunnels to the network's hub peer carry one, so
+// each spoke ends up with a single PSK.
+const (
+	pskModeOff  = "off"
+	pskModePair = "pair"
+	pskModeHub  = "hub"
+)
+
+func validPSKMode(m string) bool { return m == pskModeOff || m == pskModePair || m == pskModeHub }
+
+// pskPolicy is a network's preshared key configuration.
+type pskPolicy struct {
+	Mode    string
+	HubPeer *string
+}
+
+func loadPSKPolicy(ctx context.Context, db *sql.DB, networkID string) (pskPolicy, error) {
+	var p pskPolicy
+	err := db.QueryRowContext(ctx, "SELECT psk_mode, psk_hub_peer_id FROM networks WHERE id = $1", networkID).Scan(&p.Mode, &p.HubPeer)
+	return p, err
+}
+
+// covers reports whether the tunnel between peers a and b gets a PSK.
+func (p pskPolicy) covers(a, b string) bool {
+	switch p.Mode {
+	case pskModePair:
+		return true
+	case pskModeHub:
+		return p.HubPeer != nil && (*p.HubPeer == a || *p.HubPeer == b)
+	}
+	return false
+}
+
+// ensurePSK returns the preshared key for the tunnel between peers a and b,
+// generating and storing one on first use. Rows are keyed by the ordered
+// pair and cascade-delete with either peer.
+func ensurePSK(ctx context.Context, db *sql.DB, kms keystore.KMS, networkID, a, b string) (wireguard.Key, error) {
+	var key wireguard.Key
+	if kms == nil { return key, errServerKeysDisabled }
+	if a > b { a, b = b, a }
+	var bound bool
+	load := func() (*keystore.Envelope, error) {
+		var env keystore.Envelope
+		err := db.QueryRowContext(ctx, "SELECT key_id, wrapped_dek, nonce, ciphertext, aad_bound FROM peer_psks WHERE peer_a = $1 AND peer_b = $2", a, b).
+			Scan(&env.KeyID, &env.WrappedDEK, &env.Nonce, &env.Ciphertext, &bound)
+		return &env, err
+	}
+	env, err := load()
+	if err == sql.ErrNoRows {
+		psk, err := wireguard.GeneratePresharedKey()
+		if err != nil { return key, err }
+		sealed, err := keystore.Seal(kms, psk[:], pskAAD(a, b))
+		if err != nil { return key, err }
+		// A concurrent render may have created the row first; either way the
+		// stored row wins.
+		_, err = db.ExecContext(ctx,
+			"INSERT INTO peer_psks (network_id, peer_a, peer_b, key_id, wrapped_dek, nonce, ciphertext, aad_bound) VALUES ($1, $2, $3, $4, $5, $6, $7, TRUE) ON CONFLICT (peer_a, peer_b) DO NOTHING",
+			networkID, a, b, sealed.KeyID, sealed.WrappedDEK, sealed.Nonce, sealed.Ciphertext)
+		if err != nil { return key, fmt.Errorf("store psk: %w", err) }
+		env, err = load()
+	}
+	if err != nil { return key, err }
+	raw, err := keystore.Open(kms, env, envelopeAAD(bound, pskAAD(a, b)))
+	if err != nil { return key, err }
+	if len(raw) != wireguard.KeyLen { return key, fmt.Errorf("stored psk for %s/%s has length %d", a, b, len(raw)) }
+	copy(key[:], raw)
+	return key, nil
+}
+
+// POST /api/peers/:id/rotate-psk
+// Discards every PSK involving the peer; fresh keys are generated the next
+// time either side renders its configuration.
+func (h *PeersHandler) RotatePSK(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	peerID := mux.Vars(r)["id"]
+	networkID, code, err := authorizePeer(r.Context(), h.DB, peerID, userID)
+	if code == http.StatusInternalServerError { log.Printf("peer auth error: %v", err); jsonError(w, "internal error", code); return }
+	if err != nil { jsonError(w, err.Error(), code); return }
+	res, err := h.DB.ExecContext(r.Context(), "DELETE FROM peer_psks WHERE peer_a = $1 OR peer_b = $1", peerID)
+	if err != nil { log.Printf("rotate psk error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	n, _ := res.RowsAffected()
+	h.pskRotated(networkID, userID, map[string]interface{}{"peer_id": peerID, "count": n})
+	jsonOK(w, http.StatusOK, map[string]interface{}{"rotated": n})
+}
+
+// POST /api/networks/:id/rotate-psks
+func (h *PeersHandler) RotateNetworkPSKs(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	networkID := mux.Vars(r)["id"]
+	role, err := memberRole(r.Context(), h.DB, networkID, userID)
+	if err == sql.ErrNoRows || (err == nil && !isNetworkAdmin(role)) { jsonError(w, "only network owners and admins can rotate preshared keys", http.StatusForbidden); return }
+	if err != nil { log.Printf("member role error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	res, err := h.DB.ExecContext(r.Context(), "DELETE FROM peer_psks WHERE network_id = $1", networkID)
+	if err != nil { log.Printf("rotate psks error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	n, _ := res.RowsAffected()
+	h.pskRotated(networkID, userID, map[string]interface{}{"count": n})
+	jsonOK(w, http.StatusOK, map[string]interface{}{"rotated": n})
+}
+
+// pskRotated records the rotation and tells connected clients to re-fetch
+// their configuration.
+func (h *PeersHandler) pskRotated(networkID, userID string, meta map[string]interface{}) {
+	logActivity(h.DB, networkID, userID, "psk_rotated", meta)
+	publishPeers(h.DB, h.Broker, networkID, "psk_rotated", peerChange{})
+}
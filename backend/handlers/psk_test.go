@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/wgcloudctrl/server/sse"
+	"github.com/wgcloudctrl/server/wireguard"
+)
+
+func TestPSKPolicyCovers(t *testing.T) {
+	hub := "hub"
+	tests := []struct {
+		name   string
+		policy pskPolicy
+		a, b   string
+		want   bool
+	}{
+		{"off", pskPolicy{Mode: pskModeOff}, "a", "b", false},
+		{"pair", pskPolicy{Mode: pskModePair}, "a", "b", true},
+		{"pair ignores hub", pskPolicy{Mode: pskModePair, HubPeer: &hub}, "a", "b", true},
+		{"hub to spoke", pskPolicy{Mode: pskModeHub, HubPeer: &hub}, "hub", "b", true},
+		{"spoke to hub", pskPolicy{Mode: pskModeHub, HubPeer: &hub}, "a", "hub", true},
+		{"spoke to spoke", pskPolicy{Mode: pskModeHub, HubPeer: &hub}, "a", "b", false},
+		{"hub unset", pskPolicy{Mode: pskModeHub}, "a", "b", false},
+		{"unknown mode", pskPolicy{Mode: "all"}, "a", "b", false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.covers(tt.a, tt.b); got != tt.want { t.Errorf("%s: covers(%s, %s) = %v, want %v", tt.name, tt.a, tt.b, got, tt.want) }
+	}
+}
+
+func TestEnsurePSK(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	kms := testKMS(t)
+	owner, _ := createUser(t, db)
+	netID := createNetwork(t, db, owner, nil)
+	p1 := createPeer(t, db, netID, owner, "10.10.0.2")
+	p2 := createPeer(t, db, netID, owner, "10.10.0.3")
+
+	// Concurrent first renders race to create the row; all of them end up
+	// with the one that was stored.
+	keys := make([]wireguard.Key, 8)
+	var wg sync.WaitGroup
+	for i := range keys {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a, b := p1, p2
+			if i%2 == 1 { a, b = b, a }
+			k, err := ensurePSK(ctx, db, kms, netID, a, b)
+			if err != nil { t.Error(err) }
+			keys[i] = k
+		}(i)
+	}
+	wg.Wait()
+	for i, k := range keys {
+		if k != keys[0] { t.Errorf("render %d got a different PSK", i) }
+	}
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM peer_psks WHERE network_id = $1", netID).Scan(&rows); err != nil { t.Fatal(err) }
+	if rows != 1 { t.Errorf("%d PSK rows for one pair, want 1", rows) }
+	if k, err := ensurePSK(ctx, db, kms, netID, p2, p1); err != nil || k != keys[0] { t.Errorf("later render: %v, same key %v", err, k == keys[0]) }
+	if _, err := ensurePSK(ctx, db, nil, netID, p1, p2); err != errServerKeysDisabled { t.Errorf("without a KMS: %v", err) }
+}
+
+func TestDeletePeerPurgesPSKs(t *testing.T) {
+	db := testDB(t)
+	kms := testKMS(t)
+	owner, _ := createUser(t, db)
+	member, _ := createUser(t, db)
+	other, _ := createUser(t, db)
+	netID := createNetwork(t, db, owner, map[string]string{member: "member", other: "member"})
+	p1 := createPeer(t, db, netID, member, "10.10.0.2")
+	p2 := createPeer(t, db, netID, owner, "10.10.0.3")
+	if _, err := ensurePSK(context.Background(), db, kms, netID, p1, p2); err != nil { t.Fatal(err) }
+	h := &PeersHandler{DB: db, Broker: sse.NewBroker()}
+	del := func(userID string) int {
+		req := httptest.NewRequest("DELETE", "/api/peers/"+p1, nil)
+		req = mux.SetURLVars(req.WithContext(asUser(req.Context(), userID)), map[string]string{"id": p1})
+		rec := httptest.NewRecorder()
+		h.Delete(rec, req)
+		return rec.Code
+	}
+	count := func(query string) int {
+		var n int
+		if err := db.QueryRow(query, p1).Scan(&n); err != nil { t.Fatal(err) }
+		return n
+	}
+
+	if code := del(other); code != http.StatusForbidden { t.Errorf("another member deletes the peer: status %d, want 403", code) }
+	if n := count("SELECT COUNT(*) FROM peers WHERE id = $1"); n != 1 { t.Fatal("peer deleted by another member") }
+	if code := del(member); code != http.StatusOK { t.Fatalf("owner deletes the peer: status %d", code) }
+	if n := count("SELECT COUNT(*) FROM peer_psks WHERE peer_a = $1 OR peer_b = $1"); n != 0 { t.Errorf("%d PSKs left after deleting the peer", n) }
+}
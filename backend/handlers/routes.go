@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/wgcloudctrl/server/sse"
+	mw "github.com/wgcloudctrl/server/middleware"
+)
+
+type RoutesHandler struct { DB *sql.DB; Broker *sse.Broker }
+
+// Route is a LAN prefix a peer offers to route for the rest of the network.
+// Only approved routes are added to the peer's AllowedIPs.
+type Route struct {
+	ID         string     `json:"id"`
+	NetworkID  string     `json:"network_id"`
+	PeerID     string     `json:"peer_id"`
+	CIDR       string     `json:"cidr"`
+	Status     string     `json:"status"`
+	ApprovedBy *string    `json:"approved_by"`
+	ApprovedAt *time.Time `json:"approved_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+const maxRoutesPerRequest = 16
+
+// parseRoute parses and masks a CIDR. Default routes are refused; a peer that
+// should carry all traffic is an exit node.
+func parseRoute(s string) (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(strings.TrimSpace(s))
+	if err != nil { return p, fmt.Errorf("invalid CIDR %q", s) }
+	if p.Bits() == 0 { return p, fmt.Errorf("%s is a default route; use an exit node instead", s) }
+	return p.Masked(), nil
+}
+
+// routeConflict is an overlap between routes, as opposed to a database error.
+type routeConflict struct{ error }
+
+// checkRouteOverlap reports the first conflict between p and the network range
+// or another pending or approved route in the network as a routeConflict. A
+// route identical to one the same peer already has is not a conflict.
+func checkRouteOverlap(ctx context.Context, tx *sql.Tx, networkID, peerID string, p netip.Prefix) error {
+	var cidr string
+	if err := tx.QueryRowContext(ctx, "SELECT cidr FROM networks WHERE id = $1", networkID).Scan(&cidr); err != nil { return err }
+	if mesh, err := netip.ParsePrefix(cidr); err == nil && p.Overlaps(mesh) { return routeConflict{fmt.Errorf("%s overlaps the network range %s", p, mesh)} }
+	rows, err := tx.QueryContext(ctx, "SELECT peer_id, cidr FROM peer_routes WHERE network_id = $1", networkID)
+	if err != nil { return err }
+	defer rows.Close()
+	for rows.Next() {
+		var owner, cidr string
+		if err := rows.Scan(&owner, &cidr); err != nil { return err }
+		other, err := netip.ParsePrefix(cidr)
+		if err != nil { continue }
+		if owner == peerID && other == p { continue }
+		if other.Overlaps(p) { return routeConflict{fmt.Errorf("%s overlaps existing route %s", p, other)} }
+	}
+	return rows.Err()
+}
+
+// POST /api/peers/:id/routes
+func (h *RoutesHandler) Advertise(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	peerID := mux.Vars(r)["id"]
+	var req struct { CIDRs []string `json:"cidrs"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { jsonError(w, "invalid request body", http.StatusBadRequest); return }
+	if len(req.CIDRs) == 0 || len(req.CIDRs) > maxRoutesPerRequest { jsonError(w, fmt.Sprintf("cidrs must list 1 to %d prefixes", maxRoutesPerRequest), http.StatusBadRequest); return }
+	prefixes := make([]netip.Prefix, 0, len(req.CIDRs))
+	for _, c := range req.CIDRs {
+		p, err := parseRoute(c)
+		if err != nil { jsonError(w, err.Error(), http.StatusBadRequest); return }
+		for _, q := range prefixes {
+			if q.Overlaps(p) { jsonError(w, fmt.Sprintf("%s overlaps %s in the same request", p, q), http.StatusBadRequest); return }
+		}
+		prefixes = append(prefixes, p)
+	}
+	networkID, code, err := authorizePeer(r.Context(), h.DB, peerID, userID)
+	if code == http.StatusInternalServerError { log.Printf("peer auth error: %v", err); jsonError(w, "internal error", code); return }
+	if err != nil { jsonError(w, err.Error(), code); return }
+
+	routes, err := h.advertise(r.Context(), networkID, peerID, prefixes)
+	if rc, ok := err.(routeConflict); ok { jsonError(w, rc.Error(), http.StatusConflict); return }
+	if err != nil { log.Printf("advertise routes error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	cidrs := make([]string, len(routes))
+	for i, rt := range routes { cidrs[i] = rt.CIDR }
+	logActivity(h.DB, networkID, userID, "route_advertised", map[string]interface{}{"peer_id": peerID, "cidrs": cidrs})
+	h.Broker.PublishToNetwork(networkID, "admin", sse.Event{Type: "route_advertised", Payload: routes})
+	jsonOK(w, http.StatusOK, routes)
+}
+
+// advertise records prefixes as pending routes of the peer. The network row is
+// locked so concurrent advertisements cannot both pass the overlap check.
+func (h *RoutesHandler) advertise(ctx context.Context, networkID, peerID string, prefixes []netip.Prefix) ([]Route, error) {
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil { return nil, err }
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "SELECT 1 FROM networks WHERE id = $1 FOR UPDATE", networkID); err != nil { return nil, err }
+	routes := []Route{}
+	for _, p := range prefixes {
+		if err := checkRouteOverlap(ctx, tx, networkID, peerID, p); err != nil { return nil, err }
+		var rt Route
+		err := tx.QueryRowContext(ctx,
+			`INSERT INTO peer_routes (network_id, peer_id, cidr) VALUES ($1, $2, $3)
+			 ON CONFLICT (peer_id, cidr) DO UPDATE SET cidr = EXCLUDED.cidr
+			 RETURNING id, network_id, peer_id, cidr, status, approved_by, approved_at, created_at`,
+			networkID, peerID, p.String()).Scan(&rt.ID, &rt.NetworkID, &rt.PeerID, &rt.CIDR, &rt.Status, &rt.ApprovedBy, &rt.ApprovedAt, &rt.CreatedAt)
+		if err != nil { return nil, err }
+		routes = append(routes, rt)
+	}
+	return routes, tx.Commit()
+}
+
+// GET /api/networks/:id/routes?status=pending
+func (h *RoutesHandler) List(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	netID := mux.Vars(r)["id"]
+	_, err := memberRole(r.Context(), h.DB, netID, userID)
+	if err == sql.ErrNoRows { jsonError(w, "not a member of this network", http.StatusForbidden); return }
+	if err != nil { log.Printf("member check error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	status := strings.TrimSpace(r.URL.Query().Get("status"))
+	if status != "" && status != "pending" && status != "approved" { jsonError(w, "invalid status filter", http.StatusBadRequest); return }
+	rows, err := h.DB.QueryContext(r.Context(),
+		"SELECT id, network_id, peer_id, cidr, status, approved_by, approved_at, created_at FROM peer_routes WHERE network_id = $1 AND ($2 = '' OR status = $2) ORDER BY created_at",
+		netID, status)
+	if err != nil { log.Printf("list routes error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	defer rows.Close()
+	out := []Route{}
+	for rows.Next() {
+		var rt Route
+		if err := rows.Scan(&rt.ID, &rt.NetworkID, &rt.PeerID, &rt.CIDR, &rt.Status, &rt.ApprovedBy, &rt.ApprovedAt, &rt.CreatedAt); err != nil { log.Printf("scan route error: %v", err); continue }
+		out = append(out, rt)
+	}
+	jsonOK(w, http.StatusOK, out)
+}
+
+// POST /api/routes/:id/approve
+func (h *RoutesHandler) Approve(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	routeID := mux.Vars(r)["id"]
+	var networkID, peerID, cidr string
+	err := h.DB.QueryRowContext(r.Context(), "SELECT network_id, peer_id, cidr FROM peer_routes WHERE id = $1", routeID).Scan(&networkID, &peerID, &cidr)
+	if err == sql.ErrNoRows { jsonError(w, "route not found", http.StatusNotFound); return }
+	if err != nil { log.Printf("route query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	role, err := memberRole(r.Context(), h.DB, networkID, userID)
+	if err == sql.ErrNoRows || (err == nil && !isNetworkAdmin(role)) { jsonError(w, "only network owners and admins can approve routes", http.StatusForbidden); return }
+	if err != nil { log.Printf("member role error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	res, err := h.DB.ExecContext(r.Context(), "UPDATE peer_routes SET status = 'approved', approved_by = $2, approved_at = NOW() WHERE id = $1 AND status = 'pending'", routeID, userID)
+	if err != nil { log.Printf("approve route error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	if n, _ := res.RowsAffected(); n == 0 { jsonError(w, "route is already approved", http.StatusConflict); return }
+	logActivity(h.DB, networkID, userID, "route_approved", map[string]interface{}{"route_id": routeID, "peer_id": peerID, "cidr": cidr})
+	h.routesChanged(networkID, peerID)
+	jsonOK(w, http.StatusOK, map[string]string{"message": "route approved"})
+}
+
+// DELETE /api/routes/:id
+// Withdraws an advertised or approved route. Allowed for the peer's owner and
+// network admins, so this also serves to reject a pending route.
+func (h *RoutesHandler) Withdraw(w http.ResponseWriter, r *http.Request) {
+	userID := mw.UserIDFromContext(r.Context())
+	routeID := mux.Vars(r)["id"]
+	var peerID, cidr, status string
+	err := h.DB.QueryRowContext(r.Context(), "SELECT peer_id, cidr, status FROM peer_routes WHERE id = $1", routeID).Scan(&peerID, &cidr, &status)
+	if err == sql.ErrNoRows { jsonError(w, "route not found", http.StatusNotFound); return }
+	if err != nil { log.Printf("route query error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	networkID, code, err := authorizePeer(r.Context(), h.DB, peerID, userID)
+	if code == http.StatusInternalServerError { log.Printf("peer auth error: %v", err); jsonError(w, "internal error", code); return }
+	if err != nil { jsonError(w, err.Error(), code); return }
+	if _, err := h.DB.ExecContext(r.Context(), "DELETE FROM peer_routes WHERE id = $1", routeID); err != nil { log.Printf("withdraw route error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return }
+	logActivity(h.DB, networkID, userID, "route_withdrawn", map[string]interface{}{"route_id": routeID, "peer_id": peerID, "cidr": cidr})
+	if status == "approved" { h.routesChanged(networkID, peerID) }
+	jsonOK(w, http.StatusOK, map[string]string{"message": "route withdrawn"})
+}
+
+// routesChanged pushes the affected peers so clients re-render AllowedIPs.
+func (h *RoutesHandler) routesChanged(networkID string, peerIDs ...string) {
+	publishPeers(h.DB, h.Broker, networkID, "routes_updated", peerChange{Updated: peerIDs})
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		in, want, err string
+	}{
+		{"192.168.1.0/24", "192.168.1.0/24", ""},
+		{" 192.168.1.0/24 ", "192.168.1.0/24", ""},
+		{"192.168.1.77/24", "192.168.1.0/24", ""},
+		{"10.1.2.3/32", "10.1.2.3/32", ""},
+		{"fd00:1::5/64", "fd00:1::/64", ""},
+		{"0.0.0.0/0", "", "default route"},
+		{"::/0", "", "default route"},
+		{"192.168.1.0", "", "invalid CIDR"},
+		{"192.168.1.0/33", "", "invalid CIDR"},
+		{"", "", "invalid CIDR"},
+	}
+	for _, tt := range tests {
+		p, err := parseRoute(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) { t.Errorf("parseRoute(%q) error = %v, want %q", tt.in, err, tt.err) }
+			continue
+		}
+		if err != nil || p.String() != tt.want { t.Errorf("parseRoute(%q) = %v, %v; want %s", tt.in, p, err, tt.want) }
+	}
+}
+
+func TestCheckRouteOverlap(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	owner, _ := createUser(t, db)
+	netID := createNetwork(t, db, owner, nil)
+	p1 := createPeer(t, db, netID, owner, "10.10.0.2")
+	p2 := createPeer(t, db, netID, owner, "10.10.0.3")
+	if _, err := db.Exec("INSERT INTO peer_routes (network_id, peer_id, cidr, status) VALUES ($1, $2, '192.168.1.0/24', 'approved'), ($1, $2, '172.16.0.0/16', 'pending')", netID, p1); err != nil { t.Fatal(err) }
+
+	tests := []struct {
+		name, peer, cidr, conflict string
+	}{
+		{"network range", p2, "10.10.0.0/16", "network range"},
+		{"inside network range", p2, "10.10.0.128/25", "network range"},
+		{"approved route", p2, "192.168.1.128/25", "existing route 192.168.1.0/24"},
+		{"pending route", p2, "172.16.5.0/24", "existing route 172.16.0.0/16"},
+		{"covers a route", p2, "192.168.0.0/16", "existing route 192.168.1.0/24"},
+		{"same peer, same prefix", p1, "192.168.1.0/24", ""},
+		{"same peer, overlapping prefix", p1, "192.168.1.0/25", "existing route 192.168.1.0/24"},
+		{"disjoint", p2, "192.168.2.0/24", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, err := db.Begin()
+			if err != nil { t.Fatal(err) }
+			defer tx.Rollback()
+			err = checkRouteOverlap(ctx, tx, netID, tt.peer, netip.MustParsePrefix(tt.cidr))
+			if tt.conflict == "" {
+				if err != nil { t.Errorf("unexpected conflict: %v", err) }
+				return
+			}
+			var rc routeConflict
+			if !errors.As(err, &rc) || !strings.Contains(err.Error(), tt.conflict) { t.Errorf("got %v, want a conflict with %q", err, tt.conflict) }
+		})
+	}
+}
@@ -1,34 +1,79 @@
 package handlers
 
 import (
+	"database/sql"
+	"log"
 	"net/http"
 
 	"github.com/wgcloudctrl/server/sse"
 	mw "github.com/wgcloudctrl/server/middleware"
 )
 
-type SSEHandler struct { Broker *sse.Broker }
+type SSEHandler struct { DB *sql.DB; Broker *sse.Broker }
 
-// GET /api/sse/peers?network_id=X
+// Streams are authorized when they are opened. They are ended by the broker
+// when the token expires, the session signs out or the user loses access to
+// the network (see revokeNetworkStreams).
+
+func subscriber(r *http.Request) sse.Subscriber {
+	ctx := r.Context()
+	return sse.Subscriber{User: mw.UserIDFromContext(ctx), Session: mw.SessionFromContext(ctx), Expires: mw.ExpiresFromContext(ctx)}
+}
+
+// authorizeStream answers for the caller if they may not stream networkID's
+// events and returns false. adminOnly limits the stream to owners and admins.
+func (h *SSEHandler) authorizeStream(w http.ResponseWriter, r *http.Request, networkID string, adminOnly bool) bool {
+	if networkID == "" { http.Error(w, "network_id required", http.StatusBadRequest); return false }
+	role, err := memberRole(r.Context(), h.DB, networkID, mw.UserIDFromContext(r.Context()))
+	if err != nil && err != sql.ErrNoRows { log.Printf("member check error: %v", err); http.Error(w, "internal error", http.StatusInternalServerError); return false }
+	if err == sql.ErrNoRows || (adminOnly && !isNetworkAdmin(role)) { http.Error(w, "forbidden", http.StatusForbidden); return false }
+	return true
+}
+
+// networkTopics are the topics carrying a network's events.
+func networkTopics(networkID string) []string {
+	return []string{"peers:" + networkID, "activity:" + networkID, "admin:" + networkID}
+}
+
+// revokeNetworkStreams ends userID's streams on the network, or everyone's
+// when userID is empty.
+func revokeNetworkStreams(broker *sse.Broker, networkID, userID, reason string) {
+	broker.Revoke(userID, reason, networkTopics(networkID)...)
+}
+
+// GET /api/sse/peers?network_id=X[&snapshot=1]
+// Events carry a PeerDelta. With snapshot=1 the stream starts with a
+// "snapshot" event holding the full peer list, for clients (re)building state.
 func (h *SSEHandler) Peers(w http.ResponseWriter, r *http.Request) {
-	userID := mw.UserIDFromContext(r.Context())
 	networkID := r.URL.Query().Get("network_id")
-	if networkID == "" { http.Error(w, "network_id required", http.StatusBadRequest); return }
-	_ = userID
-	h.Broker.Subscribe(w, r, "peers:"+networkID)
+	if !h.authorizeStream(w, r, networkID, false) { return }
+	var initial func() []sse.Event
+	if r.URL.Query().Get("snapshot") == "1" {
+		initial = func() []sse.Event {
+			snap, err := peerSnapshot(r.Context(), h.DB, networkID)
+			if err != nil { log.Printf("peer snapshot error: %v", err); return nil }
+			return []sse.Event{{Type: "snapshot", Payload: snap}}
+		}
+	}
+	h.Broker.SubscribeWith(w, r, subscriber(r), initial, "peers:"+networkID)
 }
 
 // GET /api/sse/invitations
 func (h *SSEHandler) Invitations(w http.ResponseWriter, r *http.Request) {
 	userID := mw.UserIDFromContext(r.Context())
-	h.Broker.Subscribe(w, r, "user:"+userID)
+	h.Broker.Subscribe(w, r, subscriber(r), "user:"+userID)
 }
 
 // GET /api/sse/activity?network_id=X
 func (h *SSEHandler) Activity(w http.ResponseWriter, r *http.Request) {
-	userID := mw.UserIDFromContext(r.Context())
 	networkID := r.URL.Query().Get("network_id")
-	if networkID == "" { http.Error(w, "network_id required", http.StatusBadRequest); return }
-	_ = userID
-	h.Broker.Subscribe(w, r, "activity:"+networkID)
+	if !h.authorizeStream(w, r, networkID, false) { return }
+	h.Broker.Subscribe(w, r, subscriber(r), "activity:"+networkID)
+}
+
+// GET /api/sse/admin?network_id=X (owners and admins only)
+func (h *SSEHandler) Admin(w http.ResponseWriter, r *http.Request) {
+	networkID := r.URL.Query().Get("network_id")
+	if !h.authorizeStream(w, r, networkID, true) { return }
+	h.Broker.Subscribe(w, r, subscriber(r), "admin:"+networkID)
 }
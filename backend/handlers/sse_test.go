@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wgcloudctrl/server/sse"
+)
+
+func TestStreamsRefuseNonMembers(t *testing.T) {
+	db := testDB(t)
+	owner, _ := createUser(t, db)
+	member, _ := createUser(t, db)
+	outsider, _ := createUser(t, db)
+	netID := createNetwork(t, db, owner, map[string]string{member: "member"})
+	h := &SSEHandler{DB: db, Broker: sse.NewBroker()}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		user    string
+		query   string
+		want    int
+	}{
+		{"peers, non-member", h.Peers, outsider, "?network_id=" + netID, http.StatusForbidden},
+		{"activity, non-member", h.Activity, outsider, "?network_id=" + netID, http.StatusForbidden},
+		{"admin, non-member", h.Admin, outsider, "?network_id=" + netID, http.StatusForbidden},
+		{"admin, member", h.Admin, member, "?network_id=" + netID, http.StatusForbidden},
+		{"peers, no network", h.Peers, member, "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/sse"+tt.query, nil)
+		req = req.WithContext(asUser(req.Context(), tt.user))
+		rec := httptest.NewRecorder()
+		tt.handler(rec, req)
+		if rec.Code != tt.want { t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want) }
+		if ct := rec.Header().Get("Content-Type"); ct == "text/event-stream" { t.Errorf("%s: stream was opened", tt.name) }
+	}
+
+	// The same checks let members and admins through.
+	allowed := []struct {
+		user      string
+		adminOnly bool
+	}{{member, false}, {owner, false}, {owner, true}}
+	for _, a := range allowed {
+		req := httptest.NewRequest("GET", "/api/sse", nil)
+		req = req.WithContext(asUser(req.Context(), a.user))
+		if !h.authorizeStream(httptest.NewRecorder(), req, netID, a.adminOnly) { t.Errorf("user %s (adminOnly %v) refused", a.user, a.adminOnly) }
+	}
+}
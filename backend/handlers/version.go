@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wgcloudctrl/server/sse"
+)
+
+// Every change that can alter a peer's rendered config bumps its network's
+// config_version. Clients compare versions through ETags or wait for the next
+// one with ?wait_for_version=.
+
+const (
+	defaultWaitTimeout = 30 * time.Second
+	maxWaitTimeout     = 120 * time.Second
+	// waitRecheck bounds how long a waiter can miss a bump that was not
+	// announced on this process's broker, e.g. through a peering.
+	waitRecheck = 5 * time.Second
+)
+
+// bumpConfigVersion increments the network's config version, and those of
+// networks actively peered with it since their configs list its peers too.
+func bumpConfigVersion(db *sql.DB, networkID string) (int64, error) {
+	var v int64
+	err := db.QueryRow("UPDATE networks SET config_version = config_version + 1 WHERE id = $1 RETURNING config_version", networkID).Scan(&v)
+	if err != nil { return 0, err }
+	_, err = db.Exec(
+		`UPDATE networks SET config_version = config_version + 1 WHERE id IN (
+			SELECT CASE WHEN network_a = $1 THEN network_b ELSE network_a END FROM network_peerings
+			WHERE status = 'active' AND (network_a = $1 OR network_b = $1))`, networkID)
+	return v, err
+}
+
+// peerChange names the peers a change touched, by ID.
+type peerChange struct{ Added, Updated, Removed []string }
+
+// PeerDelta is the payload of every event on a network's peers topic. Peers
+// in Added and Updated are complete; Removed holds IDs. A change with empty
+// lists (DNS, PSK policy, peerings, ...) still alters rendered configs, so
+// clients re-fetch their config whenever Version moves.
+type PeerDelta struct {
+	Version int64    `json:"version"`
+	Added   []Peer   `json:"added"`
+	Updated []Peer   `json:"updated"`
+	Removed []string `json:"removed"`
+}
+
+// PeerSnapshot is the payload of the "snapshot" event a peers stream opened
+// with ?snapshot=1 starts with.
+type PeerSnapshot struct {
+	Version int64  `json:"version"`
+	Peers   []Peer `json:"peers"`
+}
+
+// publishPeers bumps the network's config version and pushes evt with the
+// change as a PeerDelta on its peers topic. Peers that are gone by the time
+// the delta is built are left out.
+func publishPeers(db *sql.DB, broker *sse.Broker, networkID, evt string, ch peerChange) {
+	v, err := bumpConfigVersion(db, networkID)
+	if err != nil { log.Printf("bump config version error: %v", err) }
+	d := PeerDelta{Version: v, Added: loadPeers(db, ch.Added), Updated: loadPeers(db, ch.Updated), Removed: ch.Removed}
+	if d.Removed == nil { d.Removed = []string{} }
+	broker.PublishToNetwork(networkID, "peers", sse.Event{Type: evt, Payload: d})
+}
+
+func loadPeers(db *sql.DB, ids []string) []Peer {
+	out := []Peer{}
+	for _, id := range ids {
+		p, err := getPeer(context.Background(), db, id)
+		if err != nil { if err != sql.ErrNoRows { log.Printf("peer query error: %v", err) }; continue }
+		out = append(out, *p)
+	}
+	return redactPeers(out, "")
+}
+
+// peerSnapshot returns the network's full peer list for a resyncing client.
+func peerSnapshot(ctx context.Context, db *sql.DB, networkID string) (*PeerSnapshot, error) {
+	v, err := configVersion(ctx, db, networkID)
+	if err != nil { return nil, err }
+	peers, err := getPeers(db, networkID)
+	if err != nil { return nil, err }
+	return &PeerSnapshot{Version: v, Peers: redactPeers(peers, "")}, nil
+}
+
+func configVersion(ctx context.Context, db *sql.DB, networkID string) (int64, error) {
+	var v int64
+	err := db.QueryRowContext(ctx, "SELECT config_version FROM networks WHERE id = $1", networkID).Scan(&v)
+	return v, err
+}
+
+// parseWait reads ?wait_for_version= and ?timeout= (seconds). ok is false
+// when the request does not ask to wait.
+func parseWait(r *http.Request) (after int64, timeout time.Duration, ok bool, err error) {
+	raw := r.URL.Query().Get("wait_for_version")
+	if raw == "" { return 0, 0, false, nil }
+	after, err = strconv.ParseInt(raw, 10, 64)
+	if err != nil || after < 0 { return 0, 0, false, fmt.Errorf("wait_for_version must be a non-negative integer") }
+	timeout = defaultWaitTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		secs, err := strconv.Atoi(t)
+		if err != nil || secs < 1 || time.Duration(secs)*time.Second > maxWaitTimeout { return 0, 0, false, fmt.Errorf("timeout must be between 1 and %d seconds", int(maxWaitTimeout.Seconds())) }
+		timeout = time.Duration(secs) * time.Second
+	}
+	return after, timeout, true, nil
+}
+
+// waitForVersion blocks until the network's config version exceeds after,
+// the timeout passes or the client goes away, and returns the version then
+// current.
+func waitForVersion(ctx context.Context, db *sql.DB, broker *sse.Broker, networkID string, after int64, timeout time.Duration) (int64, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		// Register before reading so a bump in between is not missed.
+		changed, cancel := broker.Notify("peers:" + networkID)
+		v, err := configVersion(ctx, db, networkID)
+		if err != nil || v > after { cancel(); return v, err }
+		recheck := time.NewTimer(waitRecheck)
+		select {
+		case <-changed:
+		case <-recheck.C:
+		case <-deadline.C:
+			cancel(); recheck.Stop()
+			return v, nil
+		case <-ctx.Done():
+			cancel(); recheck.Stop()
+			return v, ctx.Err()
+		}
+		cancel(); recheck.Stop()
+	}
+}
+
+// currentVersion returns the network's config version for a read endpoint,
+// first waiting for a newer one when the request has ?wait_for_version=. If
+// the wait times out it answers 304 itself and returns done.
+func currentVersion(w http.ResponseWriter, r *http.Request, db *sql.DB, broker *sse.Broker, networkID string) (v int64, done bool) {
+	after, timeout, wait, err := parseWait(r)
+	if err != nil { jsonError(w, err.Error(), http.StatusBadRequest); return 0, true }
+	if wait {
+		v, err = waitForVersion(r.Context(), db, broker, networkID, after, timeout)
+	} else {
+		v, err = configVersion(r.Context(), db, networkID)
+	}
+	if r.Context().Err() != nil { return 0, true }
+	if err != nil { log.Printf("config version error: %v", err); jsonError(w, "internal error", http.StatusInternalServerError); return 0, true }
+	w.Header().Set("X-Config-Version", strconv.FormatInt(v, 10))
+	if wait && v <= after { w.WriteHeader(http.StatusNotModified); return v, true }
+	return v, false
+}
+
+// peerListETag covers the config version and the peers' last_seen, which
+// changes without a version bump.
+func peerListETag(v int64, peers []Peer) string {
+	var seen int64
+	for _, p := range peers {
+		if p.LastSeen != nil && p.LastSeen.Unix() > seen { seen = p.LastSeen.Unix() }
+	}
+	return fmt.Sprintf(`"v%d-%d"`, v, seen)
+}
+
+// checkETag sets the ETag header and, if the request's If-None-Match already
+// names it, answers 304 and returns true.
+func checkETag(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" { return false }
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" { w.WriteHeader(http.StatusNotModified); return true }
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+// Package keystore provides envelope encryption for secrets the server keeps
+// on behalf of users, such as server-managed WireGuard private keys.
+//
+// Each secret is encrypted with its own random data-encryption key (DEK) and
+// the DEK is wrapped by a master key held by a KMS. Rotating the master key
+// only requires re-wrapping the DEKs, not re-encrypting the secrets.
+//
+// Callers pass associated data naming where the secret is stored, such as the
+// row it lives in. Opening fails unless the same associated data is given, so
+// an envelope copied into another row does not decrypt there.
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// KMS wraps and unwraps data-encryption keys under named master keys.
+type KMS interface {
+	// ActiveKeyID names the master key used for new wraps.
+	ActiveKeyID() string
+	// Wrap encrypts dek under the active master key.
+	Wrap(dek []byte) (keyID string, wrapped []byte, err error)
+	// Unwrap decrypts a DEK previously wrapped under keyID.
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Envelope is an encrypted secret together with its wrapped DEK.
+type Envelope struct {
+	KeyID      string
+	WrappedDEK []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+var ErrUnknownKey = errors.New("keystore: unknown master key")
+
+// Seal encrypts plaintext under a fresh DEK wrapped by kms, binding it to
+// aad.
+func Seal(kms KMS, plaintext, aad []byte) (*Envelope, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil { return nil, fmt.Errorf("generate DEK: %w", err) }
+	nonce, ct, err := gcmSeal(dek, plaintext, aad)
+	if err != nil { return nil, err }
+	keyID, wrapped, err := kms.Wrap(dek)
+	if err != nil { return nil, fmt.Errorf("wrap DEK: %w", err) }
+	return &Envelope{KeyID: keyID, WrappedDEK: wrapped, Nonce: nonce, Ciphertext: ct}, nil
+}
+
+// Open decrypts an envelope sealed with the same aad.
+func Open(kms KMS, env *Envelope, aad []byte) ([]byte, error) {
+	dek, err := kms.Unwrap(env.KeyID, env.WrappedDEK)
+	if err != nil { return nil, fmt.Errorf("unwrap DEK: %w", err) }
+	return gcmOpen(dek, env.Nonce, env.Ciphertext, aad)
+}
+
+// Bind re-encrypts an envelope sealed without associated data so that it is
+// bound to aad, keeping its DEK. It upgrades envelopes stored before secrets
+// were bound to their rows.
+func Bind(kms KMS, env *Envelope, aad []byte) error {
+	dek, err := kms.Unwrap(env.KeyID, env.WrappedDEK)
+	if err != nil { return fmt.Errorf("unwrap DEK: %w", err) }
+	plaintext, err := gcmOpen(dek, env.Nonce, env.Ciphertext, nil)
+	if err != nil { return err }
+	nonce, ct, err := gcmSeal(dek, plaintext, aad)
+	if err != nil { return err }
+	env.Nonce, env.Ciphertext = nonce, ct
+	return nil
+}
+
+// Rewrap re-wraps the envelope's DEK under the active master key. It reports
+// false when the envelope already uses the active key.
+func Rewrap(kms KMS, env *Envelope) (bool, error) {
+	if env.KeyID == kms.ActiveKeyID() { return false, nil }
+	dek, err := kms.Unwrap(env.KeyID, env.WrappedDEK)
+	if err != nil { return false, fmt.Errorf("unwrap DEK: %w", err) }
+	keyID, wrapped, err := kms.Wrap(dek)
+	if err != nil { return false, fmt.Errorf("wrap DEK: %w", err) }
+	env.KeyID, env.WrappedDEK = keyID, wrapped
+	return true, nil
+}
+
+func gcmSeal(key, plaintext, aad []byte) (nonce, ciphertext []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil { return nil, nil, err }
+	aead, err := cipher.NewGCM(block)
+	if err != nil { return nil, nil, err }
+	nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil { return nil, nil, err }
+	return nonce, aead.Seal(nil, nonce, plaintext, aad), nil
+}
+
+func gcmOpen(key, nonce, ciphertext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil { return nil, err }
+	aead, err := cipher.NewGCM(block)
+	if err != nil { return nil, err }
+	if len(nonce) != aead.NonceSize() { return nil, errors.New("keystore: bad nonce length") }
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
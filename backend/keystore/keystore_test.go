@@ -0,0 +1,121 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newKey returns a random master key in the key file's encoding.
+func newKey(t *testing.T) string {
+	t.Helper()
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil { t.Fatal(err) }
+	return base64.StdEncoding.EncodeToString(k)
+}
+
+// writeKeyFile writes contents to a key file and loads it.
+func writeKeyFile(t *testing.T, contents string) (*LocalKMS, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "master-keys.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil { t.Fatal(err) }
+	return LoadLocalKMS(path)
+}
+
+// localKMS loads a key file with the given keys and active key.
+func localKMS(t *testing.T, active string, keys map[string]string) *LocalKMS {
+	t.Helper()
+	var entries []string
+	for id, k := range keys { entries = append(entries, `"`+id+`": "`+k+`"`) }
+	kms, err := writeKeyFile(t, `{"active": "`+active+`", "keys": {`+strings.Join(entries, ", ")+`}}`)
+	if err != nil { t.Fatal(err) }
+	return kms
+}
+
+func TestSealOpen(t *testing.T) {
+	kms := localKMS(t, "k1", map[string]string{"k1": newKey(t)})
+	secret := []byte("wireguard private key")
+	aad := []byte("peer_private_keys/p1")
+	env, err := Seal(kms, secret, aad)
+	if err != nil { t.Fatal(err) }
+	if env.KeyID != "k1" { t.Errorf("KeyID = %q, want k1", env.KeyID) }
+	if bytes.Contains(env.Ciphertext, secret) { t.Error("ciphertext contains the plaintext") }
+	got, err := Open(kms, env, aad)
+	if err != nil { t.Fatal(err) }
+	if !bytes.Equal(got, secret) { t.Errorf("Open = %q, want %q", got, secret) }
+
+	// The envelope only opens for the row it was sealed for.
+	if _, err := Open(kms, env, []byte("peer_private_keys/p2")); err == nil { t.Error("opened with another row's associated data") }
+	if _, err := Open(kms, env, nil); err == nil { t.Error("opened without associated data") }
+
+	tampered := *env
+	tampered.Ciphertext = append([]byte(nil), env.Ciphertext...)
+	tampered.Ciphertext[0] ^= 1
+	if _, err := Open(kms, &tampered, aad); err == nil { t.Error("opened a tampered ciphertext") }
+}
+
+func TestOpenWithWrongMasterKey(t *testing.T) {
+	env, err := Seal(localKMS(t, "k1", map[string]string{"k1": newKey(t)}), []byte("secret"), nil)
+	if err != nil { t.Fatal(err) }
+	// Same key ID, different key material.
+	if _, err := Open(localKMS(t, "k1", map[string]string{"k1": newKey(t)}), env, nil); err == nil { t.Error("opened under the wrong master key") }
+	if _, err := Open(localKMS(t, "k2", map[string]string{"k2": newKey(t)}), env, nil); !errors.Is(err, ErrUnknownKey) { t.Errorf("Open with the key missing = %v, want ErrUnknownKey", err) }
+}
+
+func TestRewrapAfterRotation(t *testing.T) {
+	k1, k2 := newKey(t), newKey(t)
+	old := localKMS(t, "k1", map[string]string{"k1": k1})
+	aad := []byte("peer_psks/a/b")
+	env, err := Seal(old, []byte("psk"), aad)
+	if err != nil { t.Fatal(err) }
+	ciphertext := env.Ciphertext
+
+	rotated := localKMS(t, "k2", map[string]string{"k1": k1, "k2": k2})
+	changed, err := Rewrap(rotated, env)
+	if err != nil || !changed { t.Fatalf("Rewrap = %v, %v; want true, nil", changed, err) }
+	if env.KeyID != "k2" { t.Errorf("KeyID = %q after rewrap, want k2", env.KeyID) }
+	if !bytes.Equal(env.Ciphertext, ciphertext) { t.Error("rewrap re-encrypted the secret") }
+	if changed, err := Rewrap(rotated, env); err != nil || changed { t.Errorf("second Rewrap = %v, %v; want false, nil", changed, err) }
+
+	// Once re-wrapped the retired key can be dropped.
+	retired := localKMS(t, "k2", map[string]string{"k2": k2})
+	got, err := Open(retired, env, aad)
+	if err != nil || string(got) != "psk" { t.Errorf("Open after retiring k1 = %q, %v", got, err) }
+}
+
+func TestBind(t *testing.T) {
+	kms := localKMS(t, "k1", map[string]string{"k1": newKey(t)})
+	env, err := Seal(kms, []byte("legacy"), nil)
+	if err != nil { t.Fatal(err) }
+	aad := []byte("peer_private_keys/p1")
+	if err := Bind(kms, env, aad); err != nil { t.Fatal(err) }
+	if got, err := Open(kms, env, aad); err != nil || string(got) != "legacy" { t.Errorf("Open after Bind = %q, %v", got, err) }
+	if _, err := Open(kms, env, nil); err == nil { t.Error("bound envelope opened without associated data") }
+	if err := Bind(kms, env, aad); err == nil { t.Error("bound an envelope twice") }
+}
+
+func TestLoadLocalKMSRejectsBadFiles(t *testing.T) {
+	key := newKey(t)
+	short := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	tests := []struct {
+		name, contents, want string
+	}{
+		{"not json", `active: k1`, "parse master key file"},
+		{"bad base64", `{"active": "k1", "keys": {"k1": "not base64!"}}`, "32 bytes of base64"},
+		{"short key", `{"active": "k1", "keys": {"k1": "` + short + `"}}`, "32 bytes of base64"},
+		{"active undefined", `{"active": "k2", "keys": {"k1": "` + key + `"}}`, "is not defined"},
+		{"no keys", `{"active": "k1"}`, "is not defined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := writeKeyFile(t, tt.contents)
+			if err == nil || !strings.Contains(err.Error(), tt.want) { t.Errorf("LoadLocalKMS = %v, want error containing %q", err, tt.want) }
+		})
+	}
+	if _, err := LoadLocalKMS(filepath.Join(t.TempDir(), "missing.json")); err == nil || !strings.Contains(err.Error(), "read master key file") { t.Errorf("missing file: %v", err) }
+}
@@ -0,0 +1,61 @@
+package keystore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// LocalKMS keeps master keys in a JSON file readable only by the server:
+//
+//	{
+//	  "active": "2026-10",
+//	  "keys": {
+//	    "2026-01": "<base64 32 bytes>",
+//	    "2026-10": "<base64 32 bytes>"
+//	  }
+//	}
+//
+// To rotate, add a new key, point "active" at it and restart the server;
+// existing envelopes are re-wrapped on startup. Retired keys can be removed
+// once nothing references them.
+type LocalKMS struct {
+	active string
+	keys   map[string][]byte
+}
+
+// LoadLocalKMS reads a master key file.
+func LoadLocalKMS(path string) (*LocalKMS, error) {
+	data, err := os.ReadFile(path)
+	if err != nil { return nil, fmt.Errorf("read master key file: %w", err) }
+	var f struct {
+		Active string            `json:"active"`
+		Keys   map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil { return nil, fmt.Errorf("parse master key file: %w", err) }
+	k := &LocalKMS{active: f.Active, keys: make(map[string][]byte, len(f.Keys))}
+	for id, enc := range f.Keys {
+		raw, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil || len(raw) != 32 { return nil, fmt.Errorf("master key %q must be 32 bytes of base64", id) }
+		k.keys[id] = raw
+	}
+	if _, ok := k.keys[k.active]; !ok { return nil, fmt.Errorf("active master key %q is not defined", k.active) }
+	return k, nil
+}
+
+func (k *LocalKMS) ActiveKeyID() string { return k.active }
+
+func (k *LocalKMS) Wrap(dek []byte) (string, []byte, error) {
+	nonce, ct, err := gcmSeal(k.keys[k.active], dek, nil)
+	if err != nil { return "", nil, err }
+	return k.active, append(nonce, ct...), nil
+}
+
+func (k *LocalKMS) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok { return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID) }
+	const nonceSize = 12
+	if len(wrapped) < nonceSize { return nil, fmt.Errorf("keystore: wrapped key too short") }
+	return gcmOpen(key, wrapped[:nonceSize], wrapped[nonceSize:], nil)
+}
@@ -0,0 +1,92 @@
+// Package mailer renders and delivers transactional email.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/wgcloudctrl/server/config"
+)
+
+// Message is a fully rendered email ready for delivery.
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Transport delivers a rendered message.
+type Transport interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// NewTransport builds the transport selected by MAIL_TRANSPORT.
+func NewTransport(cfg *config.Config) (Transport, error) {
+	switch cfg.MailTransport {
+	case "smtp", "":
+		return &SMTPTransport{Host: cfg.SMTPHost, Port: cfg.SMTPPort, User: cfg.SMTPUser, Pass: cfg.SMTPPass}, nil
+	case "log":
+		return &LogTransport{}, nil
+	case "file":
+		return &FileTransport{Dir: cfg.MailSpoolDir}, nil
+	}
+	return nil, fmt.Errorf("unknown mail transport %q", cfg.MailTransport)
+}
+
+// Bytes renders the message as RFC 5322 with a multipart/alternative body.
+func (m *Message) Bytes() ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	parts := []struct{ ctype, content string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	}
+	for _, p := range parts {
+		if p.content == "" { continue }
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.ctype},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil { return nil, err }
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(p.content)); err != nil { return nil, err }
+		if err := qp.Close(); err != nil { return nil, err }
+	}
+	if err := mw.Close(); err != nil { return nil, err }
+
+	var buf bytes.Buffer
+	hdr := func(k, v string) { fmt.Fprintf(&buf, "%s: %s\r\n", k, v) }
+	hdr("From", m.From)
+	hdr("To", m.To)
+	hdr("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	hdr("Date", time.Now().UTC().Format(time.RFC1123Z))
+	hdr("Message-ID", messageID(m.From))
+	hdr("MIME-Version", "1.0")
+	hdr("Content-Type", "multipart/alternative; boundary=\""+mw.Boundary()+"\"")
+	buf.WriteString("\r\n")
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// messageID returns a unique Message-ID using the sender's domain.
+func messageID(from string) string {
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if i := strings.LastIndex(addr.Address, "@"); i != -1 { domain = addr.Address[i+1:] }
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b), domain)
+}
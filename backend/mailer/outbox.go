@@ -0,0 +1,122 @@
+package mailer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Outbox persists rendered messages in the email_outbox table and delivers
+// them in the background, retrying failures with exponential backoff.
+type Outbox struct {
+	DB          *sql.DB
+	Transport   Transport
+	From        string
+	MaxAttempts int
+	Interval    time.Duration
+}
+
+const (
+	defaultMaxAttempts = 6
+	defaultInterval    = 10 * time.Second
+	outboxBatchSize    = 20
+	sendTimeout        = 30 * time.Second
+	recordTimeout      = 5 * time.Second
+)
+
+// Enqueue renders the named template and stores it for delivery.
+func (o *Outbox) Enqueue(ctx context.Context, to, tmpl string, data interface{}) error {
+	subject, text, html, err := Render(tmpl, data)
+	if err != nil { return err }
+	_, err = o.DB.ExecContext(ctx,
+		"INSERT INTO email_outbox (to_addr, template, subject, text_body, html_body) VALUES ($1, $2, $3, $4, $5)",
+		to, tmpl, subject, text, html)
+	if err != nil { return fmt.Errorf("enqueue email: %w", err) }
+	return nil
+}
+
+// Run delivers due messages until ctx is cancelled.
+func (o *Outbox) Run(ctx context.Context) {
+	interval := o.Interval
+	if interval <= 0 { interval = defaultInterval }
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := o.deliverDue(ctx); err != nil && ctx.Err() == nil { log.Printf("outbox: %v", err) }
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type outboxRow struct {
+	id       string
+	to       string
+	subject  string
+	text     string
+	html     string
+	attempts int
+}
+
+// deliverDue claims a batch of due messages and attempts to send each one.
+// Claiming pushes next_attempt_at forward so a message is not picked up by
+// another replica while it is in flight.
+func (o *Outbox) deliverDue(ctx context.Context) error {
+	rows, err := o.DB.QueryContext(ctx,
+		`UPDATE email_outbox SET next_attempt_at = NOW() + INTERVAL '5 minutes'
+		 WHERE id IN (SELECT id FROM email_outbox WHERE status = 'pending' AND next_attempt_at <= NOW() ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED)
+		 RETURNING id, to_addr, subject, text_body, html_body, attempts`, outboxBatchSize)
+	if err != nil { return fmt.Errorf("claim messages: %w", err) }
+	var batch []outboxRow
+	for rows.Next() {
+		var m outboxRow
+		if err := rows.Scan(&m.id, &m.to, &m.subject, &m.text, &m.html, &m.attempts); err != nil { rows.Close(); return fmt.Errorf("scan message: %w", err) }
+		batch = append(batch, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil { return err }
+
+	for _, m := range batch {
+		// Messages left claimed on shutdown are picked up again once the claim
+		// lapses.
+		if ctx.Err() != nil { return ctx.Err() }
+		sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+		err := o.Transport.Send(sendCtx, &Message{From: o.From, To: m.to, Subject: m.subject, Text: m.text, HTML: m.html})
+		cancel()
+		o.record(m, err)
+	}
+	return nil
+}
+
+// retryPolicy returns the status a message takes after its attempts-th failed
+// attempt, and how long to wait before the next one.
+func retryPolicy(attempts, max int) (status string, backoff time.Duration) {
+	if attempts >= max { return "failed", 0 }
+	return "pending", time.Duration(1<<uint(attempts)) * time.Minute
+}
+
+// record stores the outcome of a send. It does not use the worker's context:
+// a message that went out just as the worker was stopped must still be marked
+// sent, or it would be delivered again once its claim lapses.
+func (o *Outbox) record(m outboxRow, sendErr error) {
+	ctx, cancel := context.WithTimeout(context.Background(), recordTimeout)
+	defer cancel()
+	if sendErr == nil {
+		_, err := o.DB.ExecContext(ctx, "UPDATE email_outbox SET status = 'sent', attempts = attempts + 1, last_error = '', sent_at = NOW() WHERE id = $1", m.id)
+		if err != nil { log.Printf("outbox: mark sent %s: %v", m.id, err) }
+		return
+	}
+	max := o.MaxAttempts
+	if max <= 0 { max = defaultMaxAttempts }
+	attempts := m.attempts + 1
+	status, backoff := retryPolicy(attempts, max)
+	log.Printf("outbox: send to %s failed (attempt %d/%d): %v", m.to, attempts, max, sendErr)
+	_, err := o.DB.ExecContext(ctx,
+		"UPDATE email_outbox SET status = $1, attempts = $2, last_error = $3, next_attempt_at = NOW() + $4 * INTERVAL '1 second' WHERE id = $5",
+		status, attempts, sendErr.Error(), int(backoff.Seconds()), m.id)
+	if err != nil { log.Printf("outbox: record failure %s: %v", m.id, err) }
+}
@@ -0,0 +1,142 @@
+package mailer
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dbpkg "github.com/wgcloudctrl/server/db"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	tests := []struct {
+		attempts, max int
+		status        string
+		backoff       time.Duration
+	}{
+		{1, 6, "pending", 2 * time.Minute},
+		{2, 6, "pending", 4 * time.Minute},
+		{5, 6, "pending", 32 * time.Minute},
+		{6, 6, "failed", 0},
+		{3, 3, "failed", 0},
+	}
+	for _, tt := range tests {
+		status, backoff := retryPolicy(tt.attempts, tt.max)
+		if status != tt.status || backoff != tt.backoff {
+			t.Errorf("retryPolicy(%d, %d) = %s, %v; want %s, %v", tt.attempts, tt.max, status, backoff, tt.status, tt.backoff)
+		}
+	}
+}
+
+// testDB connects to TEST_DB_URL and migrates it, or skips the test.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DB_URL")
+	if dsn == "" { t.Skip("TEST_DB_URL not set") }
+	db, err := dbpkg.Open(dsn)
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() { db.Close() })
+	if err := dbpkg.Migrate(db); err != nil { t.Fatal(err) }
+	return db
+}
+
+type outboxState struct {
+	status    string
+	attempts  int
+	lastError string
+	wait      time.Duration
+}
+
+func loadOutbox(t *testing.T, db *sql.DB, id string) outboxState {
+	t.Helper()
+	var st outboxState
+	var next time.Time
+	err := db.QueryRow("SELECT status, attempts, last_error, next_attempt_at FROM email_outbox WHERE id = $1", id).Scan(&st.status, &st.attempts, &st.lastError, &next)
+	if err != nil { t.Fatal(err) }
+	st.wait = time.Until(next)
+	return st
+}
+
+// TestOutboxRetry delivers through the spool transport: the first attempt
+// fails because the spool directory cannot be created, the retry succeeds.
+func TestOutboxRetry(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	blocked := filepath.Join(dir, "blocked")
+	if err := os.WriteFile(blocked, nil, 0o600); err != nil { t.Fatal(err) }
+
+	to := "retry-" + time.Now().Format("150405.000000") + "@example.com"
+	spool := &FileTransport{Dir: filepath.Join(blocked, "spool")}
+	o := &Outbox{DB: db, Transport: spool, From: "noreply@example.com", MaxAttempts: 3}
+	if err := o.Enqueue(ctx, to, TemplateReset, ResetData{URL: "https://example.com/reset"}); err != nil { t.Fatal(err) }
+	var id string
+	if err := db.QueryRow("SELECT id FROM email_outbox WHERE to_addr = $1", to).Scan(&id); err != nil { t.Fatal(err) }
+	t.Cleanup(func() { db.Exec("DELETE FROM email_outbox WHERE id = $1", id) })
+
+	if err := o.deliverDue(ctx); err != nil { t.Fatal(err) }
+	st := loadOutbox(t, db, id)
+	if st.status != "pending" || st.attempts != 1 || st.lastError == "" { t.Fatalf("after failure: %+v", st) }
+	if st.wait < time.Minute || st.wait > 3*time.Minute { t.Fatalf("backoff after first failure = %v, want about 2m", st.wait) }
+
+	// A message that is not due yet is left alone.
+	spool.Dir = filepath.Join(dir, "spool")
+	if err := o.deliverDue(ctx); err != nil { t.Fatal(err) }
+	if st := loadOutbox(t, db, id); st.attempts != 1 { t.Fatalf("delivered before its backoff: %+v", st) }
+
+	if _, err := db.Exec("UPDATE email_outbox SET next_attempt_at = NOW() WHERE id = $1", id); err != nil { t.Fatal(err) }
+	if err := o.deliverDue(ctx); err != nil { t.Fatal(err) }
+	if st := loadOutbox(t, db, id); st.status != "sent" || st.attempts != 2 { t.Fatalf("after retry: %+v", st) }
+	files, _ := filepath.Glob(filepath.Join(spool.Dir, "*.eml"))
+	if len(files) != 1 { t.Fatalf("spooled %d messages, want 1", len(files)) }
+}
+
+func TestOutboxGivesUp(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	blocked := filepath.Join(t.TempDir(), "blocked")
+	if err := os.WriteFile(blocked, nil, 0o600); err != nil { t.Fatal(err) }
+
+	to := "fail-" + time.Now().Format("150405.000000") + "@example.com"
+	o := &Outbox{DB: db, Transport: &FileTransport{Dir: filepath.Join(blocked, "spool")}, From: "noreply@example.com", MaxAttempts: 2}
+	if err := o.Enqueue(ctx, to, TemplateReset, ResetData{URL: "https://example.com/reset"}); err != nil { t.Fatal(err) }
+	var id string
+	if err := db.QueryRow("SELECT id FROM email_outbox WHERE to_addr = $1", to).Scan(&id); err != nil { t.Fatal(err) }
+	t.Cleanup(func() { db.Exec("DELETE FROM email_outbox WHERE id = $1", id) })
+
+	for i := 0; i < 2; i++ {
+		if _, err := db.Exec("UPDATE email_outbox SET next_attempt_at = NOW() WHERE id = $1", id); err != nil { t.Fatal(err) }
+		if err := o.deliverDue(ctx); err != nil { t.Fatal(err) }
+	}
+	if st := loadOutbox(t, db, id); st.status != "failed" || st.attempts != 2 { t.Fatalf("after %d failures: %+v", 2, st) }
+}
+
+// cancelTransport delivers messages, stopping the worker once it has sent
+// the one to the given address, as a shutdown arriving mid-send would.
+type cancelTransport struct {
+	to     string
+	cancel context.CancelFunc
+}
+
+func (c cancelTransport) Send(ctx context.Context, m *Message) error {
+	if m.To == c.to { c.cancel() }
+	return nil
+}
+
+func TestOutboxRecordsSendAfterShutdown(t *testing.T) {
+	db := testDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	to := "shutdown-" + time.Now().Format("150405.000000") + "@example.com"
+	o := &Outbox{DB: db, Transport: cancelTransport{to, cancel}, From: "noreply@example.com"}
+	if err := o.Enqueue(ctx, to, TemplateReset, ResetData{URL: "https://example.com/reset"}); err != nil { t.Fatal(err) }
+	var id string
+	if err := db.QueryRow("SELECT id FROM email_outbox WHERE to_addr = $1", to).Scan(&id); err != nil { t.Fatal(err) }
+	t.Cleanup(func() { db.Exec("DELETE FROM email_outbox WHERE id = $1", id) })
+
+	o.deliverDue(ctx)
+	if st := loadOutbox(t, db, id); st.status != "sent" || st.attempts != 1 { t.Fatalf("message sent during shutdown: %+v", st) }
+}
@@ -0,0 +1,69 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+	"time"
+)
+
+//go:embed templates/*.txt templates/*.html
+var templateFS embed.FS
+
+// Template names accepted by Render and Outbox.Enqueue.
+const (
+	TemplateReset      = "reset"
+	TemplateVerify     = "verify"
+	TemplateInvitation = "invitation"
+)
+
+// ResetData is the data for TemplateReset.
+type ResetData struct {
+	URL string
+}
+
+// VerifyData is the data for TemplateVerify.
+type VerifyData struct {
+	Email string
+	URL   string
+}
+
+// InvitationData is the data for TemplateInvitation.
+type InvitationData struct {
+	NetworkName  string
+	InviterEmail string
+	URL          string
+	ExpiresAt    time.Time
+}
+
+type emailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+var templates = mustLoadTemplates(TemplateReset, TemplateVerify, TemplateInvitation)
+
+func mustLoadTemplates(names ...string) map[string]emailTemplate {
+	m := make(map[string]emailTemplate, len(names))
+	for _, n := range names {
+		m[n] = emailTemplate{
+			text: texttemplate.Must(texttemplate.ParseFS(templateFS, "templates/"+n+".txt")),
+			html: htmltemplate.Must(htmltemplate.ParseFS(templateFS, "templates/"+n+".html")),
+		}
+	}
+	return m
+}
+
+// Render executes the named template pair and returns the subject, plain
+// text body and HTML body.
+func Render(name string, data interface{}) (subject, text, html string, err error) {
+	t, ok := templates[name]
+	if !ok { return "", "", "", fmt.Errorf("unknown email template %q", name) }
+	var sb, tb, hb bytes.Buffer
+	if err := t.text.ExecuteTemplate(&sb, "subject", data); err != nil { return "", "", "", fmt.Errorf("render subject: %w", err) }
+	if err := t.text.Execute(&tb, data); err != nil { return "", "", "", fmt.Errorf("render text: %w", err) }
+	if err := t.html.Execute(&hb, data); err != nil { return "", "", "", fmt.Errorf("render html: %w", err) }
+	return sb.String(), tb.String(), hb.String(), nil
+}
@@ -0,0 +1,80 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SMTPTransport delivers mail through an SMTP relay, upgrading to TLS when
+// the server offers STARTTLS.
+type SMTPTransport struct {
+	Host string
+	Port int
+	User string
+	Pass string
+}
+
+func (t *SMTPTransport) Send(ctx context.Context, msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil { return fmt.Errorf("render message: %w", err) }
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", t.Host, t.Port))
+	if err != nil { return fmt.Errorf("smtp dial: %w", err) }
+	if dl, ok := ctx.Deadline(); ok { nc.SetDeadline(dl) }
+	conn, err := smtp.NewClient(nc, t.Host)
+	if err != nil { nc.Close(); return fmt.Errorf("smtp.NewClient: %w", err) }
+	defer conn.Close()
+	if ok, _ := conn.Extension("STARTTLS"); ok {
+		if err := conn.StartTLS(&tls.Config{ServerName: t.Host}); err != nil { return fmt.Errorf("StartTLS: %w", err) }
+	}
+	if t.User != "" {
+		if err := conn.Auth(smtp.PlainAuth("", t.User, t.Pass, t.Host)); err != nil { return fmt.Errorf("smtp.Auth: %w", err) }
+	}
+	if err := conn.Mail(msg.From); err != nil { return fmt.Errorf("MAIL FROM: %w", err) }
+	if err := conn.Rcpt(msg.To); err != nil { return fmt.Errorf("RCPT TO: %w", err) }
+	wc, err := conn.Data()
+	if err != nil { return fmt.Errorf("DATA: %w", err) }
+	if _, err := wc.Write(data); err != nil { wc.Close(); return fmt.Errorf("write body: %w", err) }
+	if err := wc.Close(); err != nil { return fmt.Errorf("end DATA: %w", err) }
+	return conn.Quit()
+}
+
+// LogTransport prints messages to the application log instead of sending
+// them. Intended for local development.
+type LogTransport struct{}
+
+func (LogTransport) Send(ctx context.Context, msg *Message) error {
+	log.Printf("mail to=%s subject=%q\n%s", msg.To, msg.Subject, msg.Text)
+	return nil
+}
+
+// FileTransport spools each message as an .eml file in Dir, for tests and
+// staging environments.
+type FileTransport struct {
+	Dir string
+}
+
+func (t *FileTransport) Send(ctx context.Context, msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil { return fmt.Errorf("render message: %w", err) }
+	if err := os.MkdirAll(t.Dir, 0o750); err != nil { return fmt.Errorf("create spool dir: %w", err) }
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitizeFilename(msg.To))
+	return os.WriteFile(filepath.Join(t.Dir, name), data, 0o640)
+}
+
+func sanitizeFilename(s string) string {
+	out := []rune(s)
+	for i, r := range out {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '@' || r == '.' || r == '-' || r == '_') {
+			out[i] = '_'
+		}
+	}
+	return string(out)
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -14,6 +16,9 @@ import (
 	"github.com/wgcloudctrl/server/config"
 	dbpkg "github.com/wgcloudctrl/server/db"
 	"github.com/wgcloudctrl/server/handlers"
+	"github.com/wgcloudctrl/server/keystore"
+	"github.com/wgcloudctrl/server/mailer"
+	"github.com/wgcloudctrl/server/meshdns"
 	"github.com/wgcloudctrl/server/middleware"
 	"github.com/wgcloudctrl/server/sse"
 )
@@ -31,17 +36,64 @@ func main() {
 	if err := dbpkg.Migrate(db); err != nil { log.Fatalf("migrate: %v", err) }
 
 	middleware.SetJWTSecret(cfg.JWTSecret)
+	middleware.SetSessionCheck(handlers.SessionRevoked(db))
 
-	broker := sse.NewBroker()
+	// With more than one replica, events must reach subscribers on all of
+	// them; the postgres backend is started with the other workers below.
+	var broker *sse.Broker
+	var pgEvents *sse.PostgresBackend
+	if cfg.SSEBackend == "postgres" {
+		pgEvents = sse.NewPostgresBackend(db, cfg.DBURL)
+		broker = sse.NewBrokerWith(pgEvents)
+	} else {
+		broker = sse.NewBroker()
+	}
+	broker.Heartbeat = cfg.SSEHeartbeat
+
+	transport, err := mailer.NewTransport(cfg)
+	if err != nil { log.Fatalf("mailer: %v", err) }
+	outbox := &mailer.Outbox{DB: db, Transport: transport, From: cfg.SMTPFrom}
+
+	// Server-held keys are optional; without a master key file peers must
+	// bring their own keypair and preshared keys are unavailable.
+	var kms keystore.KMS
+	if cfg.KeyMasterFile != "" {
+		local, err := keystore.LoadLocalKMS(cfg.KeyMasterFile)
+		if err != nil { log.Fatalf("keystore: %v", err) }
+		kms = local
+		n, err := handlers.RewrapServerKeys(context.Background(), db, kms)
+		if err != nil { log.Fatalf("keystore rewrap: %v", err) }
+		if n > 0 { log.Printf("re-wrapped %d stored keys under master key %q", n, kms.ActiveKeyID()) }
+	}
+
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	go outbox.Run(bgCtx)
+	if pgEvents != nil {
+		go func() {
+			if err := pgEvents.Run(bgCtx); err != nil { log.Fatalf("sse backend: %v", err) }
+		}()
+	}
+
+	if cfg.MeshDNSListen != "" {
+		dns := &meshdns.Server{DB: db, Addr: cfg.MeshDNSListen, Zone: cfg.MeshDNSZone}
+		dns.Watch(broker)
+		go func() {
+			if err := dns.Run(bgCtx); err != nil { log.Fatalf("mesh DNS: %v", err) }
+		}()
+	}
 
-	authH  := &handlers.AuthHandler{DB: db, Cfg: cfg}
-	netsH  := &handlers.NetworksHandler{DB: db, Broker: broker}
-	peersH := &handlers.PeersHandler{DB: db, Broker: broker}
+	authH  := &handlers.AuthHandler{DB: db, Cfg: cfg, Mail: outbox, Broker: broker}
+	netsH  := &handlers.NetworksHandler{DB: db, Broker: broker, Keys: kms}
+	peersH := &handlers.PeersHandler{DB: db, Broker: broker, Cfg: cfg, Keys: kms}
 	mbH    := &handlers.MembersHandler{DB: db, Broker: broker}
-	invH   := &handlers.InvitationsHandler{DB: db, Broker: broker}
+	invH   := &handlers.InvitationsHandler{DB: db, Broker: broker, Cfg: cfg, Mail: outbox}
 	ilH    := &handlers.InviteLinksHandler{DB: db, Broker: broker}
 	actH   := &handlers.ActivityHandler{DB: db, Broker: broker}
-	sseH   := &handlers.SSEHandler{Broker: broker}
+	jrH    := &handlers.JoinRequestsHandler{DB: db, Broker: broker}
+	rtH    := &handlers.RoutesHandler{DB: db, Broker: broker}
+	pgH    := &handlers.PeeringsHandler{DB: db, Broker: broker}
+	sseH   := &handlers.SSEHandler{DB: db, Broker: broker}
 
 	r := mux.NewRouter()
 	r.Use(middleware.CORS)
@@ -49,6 +101,7 @@ func main() {
 	r.Use(jsonLogging)
 
 	r.HandleFunc("/healthz", healthz).Methods("GET", "OPTIONS")
+	r.HandleFunc("/metrics", metricsAuth(cfg.MetricsToken, broker.MetricsHandler)).Methods("GET")
 
 	api := r.PathPrefix("/api").Subrouter()
 
@@ -56,38 +109,79 @@ func main() {
 	api.HandleFunc("/auth/signin",         authH.Signin).Methods("POST", "OPTIONS")
 	api.HandleFunc("/auth/signout",        authH.Signout).Methods("POST", "OPTIONS")
 	api.HandleFunc("/auth/reset-password", authH.ResetPassword).Methods("POST", "OPTIONS")
+	api.HandleFunc("/auth/verify-email",   authH.VerifyEmail).Methods("POST", "OPTIONS")
 
 	auth := api.NewRoute().Subrouter()
 	auth.Use(middleware.Auth)
 	auth.HandleFunc("/auth/update-password", authH.UpdatePassword).Methods("POST", "OPTIONS")
 	auth.HandleFunc("/auth/me",              authH.Me).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/auth/resend-verification", authH.ResendVerification).Methods("POST", "OPTIONS")
 
 	auth.HandleFunc("/networks/create",          netsH.Create).Methods("POST", "OPTIONS")
 	auth.HandleFunc("/networks",                 netsH.List).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/networks/joinable",        netsH.Joinable).Methods("GET", "OPTIONS")
 	auth.HandleFunc("/networks/{id}",            netsH.Update).Methods("PATCH", "OPTIONS")
 	auth.HandleFunc("/networks/{id}",            netsH.Delete).Methods("DELETE", "OPTIONS")
+	auth.HandleFunc("/networks/{id}/join-domain", netsH.JoinByDomain).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/networks/{id}/domains",     netsH.ListDomains).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/networks/{id}/domains/{domain}/verify", netsH.VerifyDomain).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/networks/{id}/dns",         netsH.GetDNS).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/networks/{id}/dns",         netsH.UpdateDNS).Methods("PUT", "OPTIONS")
+	auth.HandleFunc("/networks/{id}/interface",   netsH.GetInterface).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/networks/{id}/interface",   netsH.UpdateInterface).Methods("PUT", "OPTIONS")
 
 	auth.HandleFunc("/peers/join",  peersH.Join).Methods("POST", "OPTIONS")
 	auth.HandleFunc("/peers",       peersH.List).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/peers/{id}",  peersH.Update).Methods("PATCH", "OPTIONS")
 	auth.HandleFunc("/peers/{id}",  peersH.Delete).Methods("DELETE", "OPTIONS")
+	auth.HandleFunc("/peers/{id}/rotate-key", peersH.RotateKey).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/peers/{id}/config",     peersH.Config).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/peers/{id}/rotate-psk", peersH.RotatePSK).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/peers/{id}/heartbeat",  peersH.Heartbeat).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/peers/{id}/interface",  peersH.GetInterface).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/peers/{id}/interface",  peersH.UpdateInterface).Methods("PUT", "OPTIONS")
+	auth.HandleFunc("/networks/{id}/rotate-psks", peersH.RotateNetworkPSKs).Methods("POST", "OPTIONS")
 
 	auth.HandleFunc("/networks/{id}/members", mbH.List).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/networks/{id}/invitations", invH.ListForNetwork).Methods("GET", "OPTIONS")
 	auth.HandleFunc("/members/{id}",          mbH.Delete).Methods("DELETE", "OPTIONS")
 
 	auth.HandleFunc("/invitations",         invH.Create).Methods("POST", "OPTIONS")
 	auth.HandleFunc("/invitations/pending", invH.Pending).Methods("GET", "OPTIONS")
 	auth.HandleFunc("/invitations/accept",  invH.Accept).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/invitations/accept-token", invH.AcceptToken).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/invitations/{id}/resend",  invH.Resend).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/invitations/{id}/revoke",  invH.Revoke).Methods("POST", "OPTIONS")
 
 	auth.HandleFunc("/invite-links",      ilH.Create).Methods("POST", "OPTIONS")
 	auth.HandleFunc("/invite-links",      ilH.List).Methods("GET", "OPTIONS")
 	auth.HandleFunc("/invite-links/{id}", ilH.Delete).Methods("DELETE", "OPTIONS")
 	auth.HandleFunc("/invite-links/join", ilH.JoinByToken).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/invite-links/{id}/redemptions", ilH.Redemptions).Methods("GET", "OPTIONS")
+
+	auth.HandleFunc("/networks/{id}/join-requests", jrH.List).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/join-requests/{id}/approve",  jrH.Approve).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/join-requests/{id}/deny",     jrH.Deny).Methods("POST", "OPTIONS")
+
+	auth.HandleFunc("/peers/{id}/routes",     rtH.Advertise).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/networks/{id}/routes",  rtH.List).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/routes/{id}/approve",   rtH.Approve).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/routes/{id}",           rtH.Withdraw).Methods("DELETE", "OPTIONS")
+	auth.HandleFunc("/peers/{id}/exit-node",         rtH.OfferExitNode).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/peers/{id}/exit-node",         rtH.WithdrawExitNode).Methods("DELETE", "OPTIONS")
+	auth.HandleFunc("/peers/{id}/exit-node/approve", rtH.ApproveExitNode).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/peers/{id}/exit-node-selection", rtH.SelectExitNode).Methods("PUT", "OPTIONS")
+	auth.HandleFunc("/networks/{id}/peerings", pgH.Request).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/networks/{id}/peerings", pgH.List).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/peerings/{id}/approve",  pgH.Approve).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/peerings/{id}",          pgH.Revoke).Methods("DELETE", "OPTIONS")
 
 	auth.HandleFunc("/activity", actH.List).Methods("GET", "OPTIONS")
 
 	auth.HandleFunc("/sse/peers",       sseH.Peers).Methods("GET")
 	auth.HandleFunc("/sse/invitations", sseH.Invitations).Methods("GET")
 	auth.HandleFunc("/sse/activity",    sseH.Activity).Methods("GET")
+	auth.HandleFunc("/sse/admin",       sseH.Admin).Methods("GET")
 
 	srv := &http.Server{
 		Addr:         ":"+cfg.Port,
@@ -120,6 +214,20 @@ func healthz(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
+// metricsAuth requires "Authorization: Bearer <token>" when token is set.
+func metricsAuth(token string, next http.HandlerFunc) http.HandlerFunc {
+	if token == "" { return next }
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
 // jsonLogging logs each request as a JSON line.
 func jsonLogging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -141,3 +249,8 @@ type responseWriter struct {
 func (rw *responseWriter) WriteHeader(code int) {
 	if !rw.wrote { rw.status = code; rw.wrote = true; rw.ResponseWriter.WriteHeader(code) }
 }
+
+// Flush passes through so event streams work behind the logger.
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok { f.Flush() }
+}
@@ -0,0 +1,208 @@
+// Package meshdns is a small authoritative DNS responder for peer names. It
+// answers A queries for <hostname>.<network>.<zone> with the peer's virtual
+// IP, using records loaded from the database. One responder serves every
+// network, so names under a network are only answered for queries sent from
+// one of that network's peers.
+package meshdns
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wgcloudctrl/server/sse"
+)
+
+const (
+	recordTTL      = 30
+	reloadDebounce = 500 * time.Millisecond
+	reloadInterval = time.Minute
+	tcpIdleTimeout = 10 * time.Second
+)
+
+// Server serves the mesh zone on UDP and TCP.
+type Server struct {
+	DB   *sql.DB
+	Addr string
+	Zone string
+
+	mu      sync.RWMutex
+	records map[string][]net.IP // lower-case FQDN without trailing dot
+	names   map[string]bool     // every name that exists, including network apexes
+	// sources holds, per network apex, the virtual IPs allowed to query it.
+	sources map[string]map[netip.Addr]bool
+
+	reload chan struct{}
+}
+
+// Watch reloads the records whenever peers change. It hooks into the same
+// events that are pushed to SSE clients.
+func (s *Server) Watch(b *sse.Broker) {
+	s.initReload()
+	b.AddListener(func(topic string, evt sse.Event) {
+		if !strings.HasPrefix(topic, "peers:") { return }
+		select {
+		case s.reload <- struct{}{}:
+		default:
+		}
+	})
+}
+
+func (s *Server) initReload() {
+	if s.reload == nil { s.reload = make(chan struct{}, 1) }
+}
+
+// Run loads the records and serves queries until ctx is cancelled.
+func (s *Server) Run(ctx context.Context) error {
+	s.initReload()
+	s.Zone = strings.Trim(strings.ToLower(s.Zone), ".")
+	if err := s.Load(ctx); err != nil { return err }
+	pc, err := net.ListenPacket("udp", s.Addr)
+	if err != nil { return err }
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil { pc.Close(); return err }
+	go func() { <-ctx.Done(); pc.Close(); ln.Close() }()
+	go s.reloadLoop(ctx)
+	go s.serveTCP(ln)
+	log.Printf("mesh DNS listening on %s for zone %s", s.Addr, s.Zone)
+	s.serveUDP(pc)
+	return nil
+}
+
+func (s *Server) reloadLoop(ctx context.Context) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.reload:
+			time.Sleep(reloadDebounce)
+		case <-ticker.C:
+		}
+		if err := s.Load(ctx); err != nil && ctx.Err() == nil { log.Printf("mesh DNS reload: %v", err) }
+	}
+}
+
+// Load replaces the in-memory records with the current peers. Quarantined
+// peers and networks without a DNS name are not published, and quarantined
+// peers may not query.
+func (s *Server) Load(ctx context.Context) error {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT lower(p.hostname), n.dns_name, p.virtual_ip FROM peers p JOIN networks n ON n.id = p.network_id
+		 WHERE n.dns_name IS NOT NULL AND NOT p.quarantined`)
+	if err != nil { return err }
+	defer rows.Close()
+	records := map[string][]net.IP{}
+	names := map[string]bool{s.Zone: true}
+	sources := map[string]map[netip.Addr]bool{}
+	for rows.Next() {
+		var host, network, vip string
+		if err := rows.Scan(&host, &network, &vip); err != nil { return err }
+		addr, err := netip.ParseAddr(vip)
+		if err != nil { continue }
+		netName := network + "." + s.Zone
+		if sources[netName] == nil { sources[netName] = map[netip.Addr]bool{} }
+		sources[netName][addr] = true
+		if host == "" { continue }
+		fqdn := host + "." + netName
+		records[fqdn] = append(records[fqdn], addr.AsSlice())
+		names[fqdn], names[netName] = true, true
+	}
+	if err := rows.Err(); err != nil { return err }
+	s.mu.Lock()
+	s.records, s.names, s.sources = records, names, sources
+	s.mu.Unlock()
+	return nil
+}
+
+// networkApex returns the <network>.<zone> name that name falls under.
+func (s *Server) networkApex(name string) string {
+	rest := strings.TrimSuffix(name, "."+s.Zone)
+	return rest[strings.LastIndexByte(rest, '.')+1:] + "." + s.Zone
+}
+
+// sourceAddr returns the IP a query came from.
+func sourceAddr(a net.Addr) netip.Addr {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+// answer builds the response to one query message from src, or nil to stay
+// silent. Names under a network are refused, whether they exist or not,
+// unless src is one of the network's peers.
+func (s *Server) answer(msg []byte, limit int, src netip.Addr) []byte {
+	q, err := parseQuery(msg)
+	if err != nil {
+		if len(msg) < headerLen || msg[2]&0x80 != 0 { return nil }
+		return buildResponse(msg, question{}, rcodeFormErr, nil, 0, limit)
+	}
+	if msg[2]&0x78 != 0 { return buildResponse(msg, q, rcodeNotImp, nil, 0, limit) }
+	name := strings.ToLower(strings.TrimSuffix(q.name, "."))
+	if q.class != classIN || (name != s.Zone && !strings.HasSuffix(name, "."+s.Zone)) {
+		return buildResponse(msg, q, rcodeRefused, nil, 0, limit)
+	}
+	s.mu.RLock()
+	allowed := name == s.Zone || s.sources[s.networkApex(name)][src]
+	ips, exists := s.records[name], s.names[name]
+	s.mu.RUnlock()
+	if !allowed { return buildResponse(msg, q, rcodeRefused, nil, 0, limit) }
+	if !exists { return buildResponse(msg, q, rcodeNXDomain, nil, 0, limit) }
+	if q.qtype != typeA { ips = nil } // NODATA for other types
+	return buildResponse(msg, q, rcodeNoError, ips, recordTTL, limit)
+}
+
+func (s *Server) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) { return }
+			log.Printf("mesh DNS read: %v", err)
+			continue
+		}
+		if resp := s.answer(buf[:n], maxUDPPayload, sourceAddr(addr)); resp != nil { pc.WriteTo(resp, addr) }
+	}
+}
+
+func (s *Server) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) { return }
+			log.Printf("mesh DNS accept: %v", err)
+			continue
+		}
+		go s.handleTCP(conn)
+	}
+}
+
+// handleTCP serves length-prefixed queries on one connection (RFC 7766).
+func (s *Server) handleTCP(conn net.Conn) {
+	defer conn.Close()
+	src := sourceAddr(conn.RemoteAddr())
+	var lenBuf [2]byte
+	for {
+		conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		if _, err := io.ReadFull(conn, lenBuf[:]); err != nil { return }
+		msg := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(conn, msg); err != nil { return }
+		resp := s.answer(msg, 0xFFFF, src)
+		if resp == nil { return }
+		out := binary.BigEndian.AppendUint16(make([]byte, 0, len(resp)+2), uint16(len(resp)))
+		if _, err := conn.Write(append(out, resp...)); err != nil { return }
+	}
+}
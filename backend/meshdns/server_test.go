@@ -0,0 +1,65 @@
+package meshdns
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func query(name string, qtype uint16) []byte {
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, l := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(l)))
+		msg = append(msg, l...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, classIN)
+}
+
+func testServer() *Server {
+	a, b := netip.MustParseAddr("10.10.0.2"), netip.MustParseAddr("10.20.0.2")
+	return &Server{
+		Zone:    "mesh",
+		records: map[string][]net.IP{"laptop.alpha.mesh": {a.AsSlice()}, "db.beta.mesh": {b.AsSlice()}},
+		names:   map[string]bool{"mesh": true, "alpha.mesh": true, "laptop.alpha.mesh": true, "beta.mesh": true, "db.beta.mesh": true},
+		sources: map[string]map[netip.Addr]bool{"alpha.mesh": {a: true}, "beta.mesh": {b: true}},
+	}
+}
+
+func TestAnswerOnlyToNetworkPeers(t *testing.T) {
+	s := testServer()
+	tests := []struct {
+		name, src string
+		rcode     int
+		answers   int
+	}{
+		{"laptop.alpha.mesh", "10.10.0.2", rcodeNoError, 1},
+		{"LAPTOP.Alpha.mesh", "10.10.0.2", rcodeNoError, 1},
+		{"missing.alpha.mesh", "10.10.0.2", rcodeNXDomain, 0},
+		{"db.beta.mesh", "10.10.0.2", rcodeRefused, 0},
+		{"laptop.alpha.mesh", "10.20.0.2", rcodeRefused, 0},
+		{"laptop.alpha.mesh", "198.51.100.7", rcodeRefused, 0},
+		// Unknown networks look the same as other tenants' networks.
+		{"x.gamma.mesh", "198.51.100.7", rcodeRefused, 0},
+		{"example.com", "10.10.0.2", rcodeRefused, 0},
+		{"mesh", "198.51.100.7", rcodeNoError, 0},
+	}
+	for _, tt := range tests {
+		resp := s.answer(query(tt.name, typeA), maxUDPPayload, netip.MustParseAddr(tt.src))
+		if resp == nil { t.Fatalf("%s from %s: no response", tt.name, tt.src) }
+		rcode, answers := int(resp[3]&0x0F), int(binary.BigEndian.Uint16(resp[6:8]))
+		if rcode != tt.rcode || answers != tt.answers {
+			t.Errorf("%s from %s: rcode %d with %d answers, want %d with %d", tt.name, tt.src, rcode, answers, tt.rcode, tt.answers)
+		}
+	}
+}
+
+func TestSourceAddr(t *testing.T) {
+	mapped := &net.UDPAddr{IP: net.ParseIP("::ffff:10.10.0.2"), Port: 5353}
+	if got := sourceAddr(mapped); got != netip.MustParseAddr("10.10.0.2") { t.Errorf("sourceAddr(%v) = %v", mapped, got) }
+	tcp := &net.TCPAddr{IP: net.ParseIP("10.20.0.2"), Port: 5353}
+	if got := sourceAddr(tcp); got != netip.MustParseAddr("10.20.0.2") { t.Errorf("sourceAddr(%v) = %v", tcp, got) }
+}
@@ -0,0 +1,91 @@
+package meshdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// DNS wire-format constants used by the responder (RFC 1035).
+const (
+	typeA    = 1
+	typeAAAA = 28
+	classIN  = 1
+
+	rcodeNoError  = 0
+	rcodeFormErr  = 1
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+	rcodeRefused  = 5
+
+	headerLen     = 12
+	maxUDPPayload = 512
+)
+
+var errMalformed = errors.New("malformed query")
+
+// question is the single question of a query.
+type question struct {
+	name  string // as received, without the trailing dot
+	qtype uint16
+	class uint16
+	raw   []byte // wire bytes of the question section
+}
+
+// parseQuery validates the header of msg and returns its question.
+func parseQuery(msg []byte) (question, error) {
+	var q question
+	if len(msg) < headerLen { return q, errMalformed }
+	if msg[2]&0x80 != 0 { return q, errMalformed } // a response, not a query
+	if binary.BigEndian.Uint16(msg[4:6]) != 1 { return q, errMalformed }
+	off := headerLen
+	var labels []string
+	for {
+		if off >= len(msg) { return q, errMalformed }
+		n := int(msg[off])
+		off++
+		if n == 0 { break }
+		if n > 63 || off+n > len(msg) { return q, errMalformed } // compression is not valid here
+		labels = append(labels, string(msg[off:off+n]))
+		off += n
+	}
+	if off+4 > len(msg) { return q, errMalformed }
+	q.name = strings.Join(labels, ".")
+	q.qtype = binary.BigEndian.Uint16(msg[off : off+2])
+	q.class = binary.BigEndian.Uint16(msg[off+2 : off+4])
+	q.raw = msg[headerLen : off+4]
+	return q, nil
+}
+
+// buildResponse answers query with rcode and A records for ips. The answer
+// section is dropped and TC set when it would not fit in limit bytes.
+func buildResponse(query []byte, q question, rcode int, ips []net.IP, ttl uint32, limit int) []byte {
+	resp := make([]byte, headerLen, headerLen+len(q.raw)+len(ips)*16)
+	copy(resp[0:2], query[0:2])
+	opcode := query[2] & 0x78
+	rd := query[2] & 0x01
+	resp[2] = 0x80 | opcode | 0x04 | rd // QR, AA
+	resp[3] = byte(rcode)
+	if q.raw != nil {
+		binary.BigEndian.PutUint16(resp[4:6], 1)
+		resp = append(resp, q.raw...)
+	}
+	answers := make([]byte, 0, len(ips)*16)
+	for _, ip := range ips {
+		v4 := ip.To4()
+		if v4 == nil { continue }
+		answers = append(answers, 0xC0, headerLen) // pointer to the question name
+		answers = binary.BigEndian.AppendUint16(answers, typeA)
+		answers = binary.BigEndian.AppendUint16(answers, classIN)
+		answers = binary.BigEndian.AppendUint32(answers, ttl)
+		answers = binary.BigEndian.AppendUint16(answers, 4)
+		answers = append(answers, v4...)
+	}
+	if limit > 0 && len(resp)+len(answers) > limit {
+		resp[2] |= 0x02 // TC
+		return resp
+	}
+	binary.BigEndian.PutUint16(resp[6:8], uint16(len(answers)/16))
+	return append(resp, answers...)
+}
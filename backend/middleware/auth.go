@@ -2,9 +2,13 @@ package middleware
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -14,6 +18,10 @@ type contextKey string
 const (
 	ContextKeyUserID contextKey = "user_id"
 	ContextKeyEmail  contextKey = "email"
+	// ContextKeySession identifies the token the request was made with, and
+	// ContextKeyExpires holds its expiry.
+	ContextKeySession contextKey = "session"
+	ContextKeyExpires contextKey = "expires"
 )
 
 type Claims struct {
@@ -28,6 +36,18 @@ func SetJWTSecret(secret string) {
 	jwtSecret = []byte(secret)
 }
 
+// SessionCheck reports whether a session has been revoked, e.g. by signing
+// out, so that its token is refused before it expires.
+type SessionCheck func(ctx context.Context, session string) (revoked bool, err error)
+
+var sessionCheck SessionCheck
+
+// SetSessionCheck makes Auth refuse tokens whose session check reports
+// revoked. Without one, tokens are valid until they expire.
+func SetSessionCheck(check SessionCheck) {
+	sessionCheck = check
+}
+
 func Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
@@ -45,25 +65,70 @@ func Auth(next http.Handler) http.Handler {
 			return
 		}
 		tokenStr := parts[1]
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
-			}
-			return jwtSecret, nil
-		})
-		if err != nil || !token.Valid {
+		claims, err := ParseToken(tokenStr)
+		if err != nil {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusUnauthorized)
 			json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired token"})
 			return
 		}
+		session := SessionID(tokenStr)
+		if sessionCheck != nil {
+			revoked, err := sessionCheck(r.Context(), session)
+			if err != nil {
+				log.Printf("session check error: %v", err)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "internal error"})
+				return
+			}
+			if revoked {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"error": "session has been signed out"})
+				return
+			}
+		}
 		ctx := context.WithValue(r.Context(), ContextKeyUserID, claims.UserID)
 		ctx = context.WithValue(ctx, ContextKeyEmail, claims.Email)
+		ctx = context.WithValue(ctx, ContextKeySession, session)
+		if claims.ExpiresAt != nil {
+			ctx = context.WithValue(ctx, ContextKeyExpires, claims.ExpiresAt.Time)
+		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// ParseToken verifies a bearer token and returns its claims.
+func ParseToken(tokenStr string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return jwtSecret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	// Session tokens carry no audience; one that does was issued for
+	// something else, such as an invitation.
+	if len(claims.Audience) > 0 {
+		return nil, jwt.ErrTokenInvalidAudience
+	}
+	return claims, nil
+}
+
+// SessionID names the session a token belongs to without exposing the token.
+// Tokens are not stored, so a session is simply one issued token.
+func SessionID(tokenStr string) string {
+	sum := sha256.Sum256([]byte(tokenStr))
+	return hex.EncodeToString(sum[:16])
+}
+
 func UserIDFromContext(ctx context.Context) string {
 	v, _ := ctx.Value(ContextKeyUserID).(string)
 	return v
@@ -73,3 +138,15 @@ func EmailFromContext(ctx context.Context) string {
 	v, _ := ctx.Value(ContextKeyEmail).(string)
 	return v
 }
+
+func SessionFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(ContextKeySession).(string)
+	return v
+}
+
+// ExpiresFromContext returns the token's expiry, or the zero time if it has
+// none.
+func ExpiresFromContext(ctx context.Context) time.Time {
+	v, _ := ctx.Value(ContextKeyExpires).(time.Time)
+	return v
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func signed(t *testing.T, claims Claims) string {
+	t.Helper()
+	tok, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func TestAuthRejectsTokensWithAudience(t *testing.T) {
+	SetJWTSecret("test-secret")
+	exp := jwt.NewNumericDate(time.Now().Add(time.Hour))
+	tests := []struct {
+		name   string
+		claims Claims
+		want   int
+	}{
+		{"session", Claims{UserID: "u1", RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: exp}}, http.StatusOK},
+		{"invitation audience", Claims{UserID: "u1", RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: exp, Audience: jwt.ClaimStrings{"invitation"}}}, http.StatusUnauthorized},
+		{"expired", Claims{UserID: "u1", RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))}}, http.StatusUnauthorized},
+	}
+	h := Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+signed(t, tt.claims))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestAuthRefusesRevokedSessions(t *testing.T) {
+	SetJWTSecret("test-secret")
+	exp := jwt.NewNumericDate(time.Now().Add(time.Hour))
+	revoked := signed(t, Claims{UserID: "u1", RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: exp, ID: "revoked"}})
+	live := signed(t, Claims{UserID: "u1", RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: exp, ID: "live"}})
+	broken := signed(t, Claims{UserID: "u1", RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: exp, ID: "broken"}})
+	SetSessionCheck(func(ctx context.Context, session string) (bool, error) {
+		switch session {
+		case SessionID(revoked):
+			return true, nil
+		case SessionID(broken):
+			return false, errors.New("database down")
+		}
+		return false, nil
+	})
+	t.Cleanup(func() { SetSessionCheck(nil) })
+
+	var gotSession string
+	h := Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { gotSession = SessionFromContext(r.Context()) }))
+	for _, tt := range []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"live", live, http.StatusOK},
+		{"revoked", revoked, http.StatusUnauthorized},
+		{"check fails", broken, http.StatusInternalServerError},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+	if gotSession != SessionID(live) {
+		t.Errorf("session in context = %q, want %q", gotSession, SessionID(live))
+	}
+}
@@ -0,0 +1,130 @@
+// Package posture describes the device posture a peer reports and evaluates
+// it against a network's posture rules.
+package posture
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Report is the posture a device sends on join and with each heartbeat.
+// Pointer fields distinguish "not reported" from false.
+type Report struct {
+	OS              string `json:"os"`
+	OSVersion       string `json:"os_version"`
+	DiskEncrypted   *bool  `json:"disk_encrypted,omitempty"`
+	FirewallEnabled *bool  `json:"firewall_enabled,omitempty"`
+	AgentVersion    string `json:"agent_version"`
+}
+
+// Actions taken when a device fails a rule.
+const (
+	ActionReject     = "reject"
+	ActionQuarantine = "quarantine"
+)
+
+// Rules is a network's posture policy. Zero values impose no requirement.
+type Rules struct {
+	Action                string            `json:"action"`
+	AllowedOS             []string          `json:"allowed_os,omitempty"`
+	MinOSVersion          map[string]string `json:"min_os_version,omitempty"`
+	RequireDiskEncryption bool              `json:"require_disk_encryption,omitempty"`
+	RequireFirewall       bool              `json:"require_firewall,omitempty"`
+	MinAgentVersion       string            `json:"min_agent_version,omitempty"`
+}
+
+// Failure names a rule the device did not satisfy.
+type Failure struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Normalize lower-cases OS names so that reports and rules compare equal.
+func (r *Report) Normalize() {
+	r.OS = strings.ToLower(strings.TrimSpace(r.OS))
+	r.OSVersion = strings.TrimSpace(r.OSVersion)
+	r.AgentVersion = strings.TrimSpace(r.AgentVersion)
+}
+
+// Validate checks the rules and normalizes OS names.
+func (rs *Rules) Validate() error {
+	if rs.Action != ActionReject && rs.Action != ActionQuarantine { return errors.New("action must be reject or quarantine") }
+	for i, os := range rs.AllowedOS { rs.AllowedOS[i] = strings.ToLower(strings.TrimSpace(os)) }
+	norm := make(map[string]string, len(rs.MinOSVersion))
+	for os, v := range rs.MinOSVersion {
+		if _, ok := parseVersion(v); !ok { return fmt.Errorf("min_os_version for %s: invalid version %q", os, v) }
+		norm[strings.ToLower(strings.TrimSpace(os))] = v
+	}
+	rs.MinOSVersion = norm
+	if rs.MinAgentVersion != "" {
+		if _, ok := parseVersion(rs.MinAgentVersion); !ok { return fmt.Errorf("min_agent_version: invalid version %q", rs.MinAgentVersion) }
+	}
+	return nil
+}
+
+// Evaluate returns every rule the report fails. A nil report fails every
+// rule that requires a reported value.
+func (rs *Rules) Evaluate(r *Report) []Failure {
+	if r == nil { r = &Report{} }
+	var out []Failure
+	if len(rs.AllowedOS) > 0 && !contains(rs.AllowedOS, r.OS) {
+		out = append(out, Failure{"allowed_os", fmt.Sprintf("os %q is not one of %s", r.OS, strings.Join(rs.AllowedOS, ", "))})
+	}
+	if min, ok := rs.MinOSVersion[r.OS]; ok && !atLeast(r.OSVersion, min) {
+		out = append(out, Failure{"min_os_version", fmt.Sprintf("%s version %q is below %s", r.OS, r.OSVersion, min)})
+	}
+	if rs.RequireDiskEncryption && (r.DiskEncrypted == nil || !*r.DiskEncrypted) {
+		out = append(out, Failure{"require_disk_encryption", "disk encryption is not enabled"})
+	}
+	if rs.RequireFirewall && (r.FirewallEnabled == nil || !*r.FirewallEnabled) {
+		out = append(out, Failure{"require_firewall", "firewall is not enabled"})
+	}
+	if rs.MinAgentVersion != "" && !atLeast(r.AgentVersion, rs.MinAgentVersion) {
+		out = append(out, Failure{"min_agent_version", fmt.Sprintf("agent version %q is below %s", r.AgentVersion, rs.MinAgentVersion)})
+	}
+	return out
+}
+
+// Summary joins failure messages for storage as a quarantine reason.
+func Summary(fs []Failure) string {
+	msgs := make([]string, len(fs))
+	for i, f := range fs { msgs[i] = f.Message }
+	return strings.Join(msgs, "; ")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list { if v == s { return true } }
+	return false
+}
+
+// parseVersion parses a dotted numeric version such as "14.2.1". A leading
+// "v" and any suffix after "-" or "+" are ignored.
+func parseVersion(s string) ([]int, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, "-+ "); i != -1 { s = s[:i] }
+	if s == "" { return nil, false }
+	parts := strings.Split(s, ".")
+	out := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 { return nil, false }
+		out[i] = n
+	}
+	return out, true
+}
+
+// atLeast reports whether version v is >= min. Unparseable versions fail.
+func atLeast(v, min string) bool {
+	a, ok := parseVersion(v)
+	if !ok { return false }
+	b, _ := parseVersion(min)
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) { x = a[i] }
+		if i < len(b) { y = b[i] }
+		if x != y { return x > y }
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package posture
+
+import (
+	"reflect"
+	"testing"
+)
+
+func boolPtr(b bool) *bool { return &b }
+
+// rules returns the names of the rules that failed.
+func rules(fs []Failure) []string {
+	var out []string
+	for _, f := range fs { out = append(out, f.Rule) }
+	return out
+}
+
+func TestEvaluate(t *testing.T) {
+	strict := Rules{
+		Action:                ActionReject,
+		AllowedOS:             []string{"macos", "linux"},
+		MinOSVersion:          map[string]string{"macos": "14.2"},
+		RequireDiskEncryption: true,
+		RequireFirewall:       true,
+		MinAgentVersion:       "1.2.0",
+	}
+	good := Report{OS: "macos", OSVersion: "14.10", DiskEncrypted: boolPtr(true), FirewallEnabled: boolPtr(true), AgentVersion: "1.2.3"}
+	with := func(f func(*Report)) *Report { r := good; f(&r); return &r }
+	tests := []struct {
+		name   string
+		rules  Rules
+		report *Report
+		want   []string
+	}{
+		{"compliant", strict, &good, nil},
+		{"nil report", strict, nil, []string{"allowed_os", "require_disk_encryption", "require_firewall", "min_agent_version"}},
+		{"nil report, no rules", Rules{Action: ActionReject}, nil, nil},
+		{"disk encryption false", strict, with(func(r *Report) { r.DiskEncrypted = boolPtr(false) }), []string{"require_disk_encryption"}},
+		{"disk encryption absent", strict, with(func(r *Report) { r.DiskEncrypted = nil }), []string{"require_disk_encryption"}},
+		{"firewall false", strict, with(func(r *Report) { r.FirewallEnabled = boolPtr(false) }), []string{"require_firewall"}},
+		{"firewall absent", strict, with(func(r *Report) { r.FirewallEnabled = nil }), []string{"require_firewall"}},
+		{"absent fields not required", Rules{Action: ActionReject}, &Report{OS: "linux"}, nil},
+		{"os not allowed", strict, with(func(r *Report) { r.OS = "windows" }), []string{"allowed_os"}},
+		{"os version below", strict, with(func(r *Report) { r.OSVersion = "14.1" }), []string{"min_os_version"}},
+		{"os version unparseable", strict, with(func(r *Report) { r.OSVersion = "sonoma" }), []string{"min_os_version"}},
+		{"no minimum for this os", strict, with(func(r *Report) { r.OS, r.OSVersion = "linux", "" }), nil},
+		{"agent below", strict, with(func(r *Report) { r.AgentVersion = "v1.1.9" }), []string{"min_agent_version"}},
+		{"agent missing", strict, with(func(r *Report) { r.AgentVersion = "" }), []string{"min_agent_version"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules(tt.rules.Evaluate(tt.report)); !reflect.DeepEqual(got, tt.want) { t.Errorf("failed rules = %v, want %v", got, tt.want) }
+		})
+	}
+}
+
+func TestAtLeast(t *testing.T) {
+	tests := []struct {
+		v, min string
+		want   bool
+	}{
+		{"14.10", "14.2", true},
+		{"14.2", "14.10", false},
+		{"14.2", "14.2", true},
+		{"14.2.0", "14.2", true},
+		{"14", "14.0.1", false},
+		{"v1.2.3-beta", "1.2.3", true},
+		{"v1.2.3-beta", "1.2.4", false},
+		{"1.2.3+build.7", "1.2.3", true},
+		{"2", "10", false},
+		{"", "1.0", false},
+		{"latest", "1.0", false},
+		{"1.x", "1.0", false},
+		{"1..2", "1.0", false},
+		{"-1", "0", false},
+	}
+	for _, tt := range tests {
+		if got := atLeast(tt.v, tt.min); got != tt.want { t.Errorf("atLeast(%q, %q) = %v, want %v", tt.v, tt.min, got, tt.want) }
+	}
+}
+
+func TestValidate(t *testing.T) {
+	rs := Rules{Action: ActionQuarantine, AllowedOS: []string{" macOS ", "Linux"}, MinOSVersion: map[string]string{" Windows": "10.0.19045"}, MinAgentVersion: "v2.0"}
+	if err := rs.Validate(); err != nil { t.Fatal(err) }
+	if want := []string{"macos", "linux"}; !reflect.DeepEqual(rs.AllowedOS, want) { t.Errorf("AllowedOS = %v, want %v", rs.AllowedOS, want) }
+	if want := map[string]string{"windows": "10.0.19045"}; !reflect.DeepEqual(rs.MinOSVersion, want) { t.Errorf("MinOSVersion = %v, want %v", rs.MinOSVersion, want) }
+
+	// Normalized rules match a normalized report regardless of case.
+	r := Report{OS: " MacOS", OSVersion: "14.0"}
+	r.Normalize()
+	if fs := rs.Evaluate(&r); len(fs) != 1 || fs[0].Rule != "min_agent_version" { t.Errorf("failures = %v, want only min_agent_version", rules(fs)) }
+
+	for _, bad := range []Rules{
+		{Action: ""},
+		{Action: "block"},
+		{Action: ActionReject, MinOSVersion: map[string]string{"macos": "fourteen"}},
+		{Action: ActionReject, MinAgentVersion: "latest"},
+	} {
+		if err := bad.Validate(); err == nil { t.Errorf("Validate(%+v) accepted invalid rules", bad) }
+	}
+}
+
+func TestSummary(t *testing.T) {
+	fs := []Failure{{"require_firewall", "firewall is not enabled"}, {"min_agent_version", "agent version \"\" is below 1.0"}}
+	if got, want := Summary(fs), `firewall is not enabled; agent version "" is below 1.0`; got != want { t.Errorf("Summary = %q, want %q", got, want) }
+	if got := Summary(nil); got != "" { t.Errorf("Summary(nil) = %q", got) }
+}
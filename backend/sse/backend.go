@@ -0,0 +1,82 @@
+package sse
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Backend carries published events and revocations between the brokers of
+// all replicas. Publish hands an envelope to the backend, which passes it to
+// the deliver func of every attached broker, the publisher's included.
+type Backend interface {
+	Attach(deliver func(Envelope))
+	Publish(env Envelope) error
+}
+
+// Envelope is one message between brokers: an event on Topic, or a
+// revocation. ID is the event ID when the backend assigns it; zero leaves it
+// to the receiving broker.
+type Envelope struct {
+	ID     uint64      `json:"id,omitempty"`
+	Topic  string      `json:"topic,omitempty"`
+	Event  *Event      `json:"event,omitempty"`
+	Revoke *Revocation `json:"revoke,omitempty"`
+	// resync tells the local broker that envelopes may have been lost. It
+	// never leaves the process.
+	resync bool
+}
+
+// Revocation ends matching streams; see Broker.Revoke and RevokeSession.
+type Revocation struct {
+	User    string   `json:"user,omitempty"`
+	Session string   `json:"session,omitempty"`
+	Topics  []string `json:"topics,omitempty"`
+	Reason  string   `json:"reason"`
+}
+
+// UnmarshalJSON keeps the payload as raw JSON, so an event that crossed a
+// backend is written to clients exactly as it was published.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var w struct {
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(b, &w); err != nil { return err }
+	e.Type, e.Payload = w.Type, w.Payload
+	return nil
+}
+
+// MemoryBackend delivers synchronously within the process. It is the
+// default, for a single replica; brokers attached to the same MemoryBackend
+// see each other's events under the same IDs.
+type MemoryBackend struct {
+	mu       sync.RWMutex
+	delivers []func(Envelope)
+	// pub serializes Publish, so envelopes reach every broker in ID order.
+	pub    sync.Mutex
+	nextID uint64
+}
+
+func NewMemoryBackend() *MemoryBackend { return &MemoryBackend{nextID: newIDBase()} }
+
+func (m *MemoryBackend) Attach(deliver func(Envelope)) {
+	m.mu.Lock()
+	m.delivers = append(m.delivers, deliver)
+	m.mu.Unlock()
+}
+
+// Publish assigns event envelopes the next ID and delivers env to every
+// attached broker before returning.
+func (m *MemoryBackend) Publish(env Envelope) error {
+	m.mu.RLock()
+	delivers := m.delivers
+	m.mu.RUnlock()
+	m.pub.Lock()
+	defer m.pub.Unlock()
+	if env.Event != nil {
+		m.nextID++
+		env.ID = m.nextID
+	}
+	for _, d := range delivers { d(env) }
+	return nil
+}
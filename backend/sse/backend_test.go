@@ -0,0 +1,154 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dbpkg "github.com/wgcloudctrl/server/db"
+)
+
+// nextEvent reads the next event carrying an ID and returns the ID and its
+// data line.
+func nextEvent(t *testing.T, rd *bufio.Reader) (id, data string) {
+	t.Helper()
+	id = strings.TrimSpace(strings.TrimPrefix(readUntil(t, rd, "id: "), "id: "))
+	data = strings.TrimSpace(strings.TrimPrefix(readUntil(t, rd, "data: "), "data: "))
+	return id, data
+}
+
+func TestBrokersShareMemoryBackend(t *testing.T) {
+	backend := NewMemoryBackend()
+	b1, b2 := NewBrokerWith(backend), NewBrokerWith(backend)
+	srv1, srv2 := newTestServer(t, b1), newTestServer(t, b2)
+	on1, on2 := stream(t, srv1, "peers:n1"), stream(t, srv2, "peers:n1")
+
+	// An event published on either broker reaches both, under one ID.
+	b1.PublishToNetwork("n1", "peers", Event{Type: "peer_joined", Payload: map[string]string{"seq": "1"}})
+	id1, data1 := nextEvent(t, on1)
+	id2, data2 := nextEvent(t, on2)
+	if id1 != id2 || data1 != data2 { t.Fatalf("brokers disagree: %s %s / %s %s", id1, data1, id2, data2) }
+	b2.PublishToNetwork("n1", "peers", Event{Type: "peer_joined", Payload: map[string]string{"seq": "2"}})
+	if id, data := nextEvent(t, on1); id <= id1 || !strings.Contains(data, `"seq":"2"`) { t.Fatalf("b2's event on b1: %s %s", id, data) }
+
+	// So a client can resume on the other broker.
+	b2.PublishToNetwork("n1", "peers", Event{Type: "peer_left", Payload: map[string]string{"seq": "3"}})
+	resumed := stream(t, srv1, "peers:n1", id1)
+	for _, seq := range []string{"2", "3"} {
+		if _, data := nextEvent(t, resumed); !strings.Contains(data, `"seq":"`+seq+`"`) { t.Errorf("replay: got %s, want seq %s", data, seq) }
+	}
+
+	// Revocations reach streams on every broker.
+	b2.Revoke("u1", "removed_from_network", "peers:n1")
+	for _, rd := range []*bufio.Reader{on1, on2, resumed} { readUntil(t, rd, "event: revoked") }
+}
+
+// testDB opens TEST_DB_URL and migrates it, or skips the test.
+func testDB(t *testing.T) (*sql.DB, string) {
+	t.Helper()
+	dsn := os.Getenv("TEST_DB_URL")
+	if dsn == "" { t.Skip("TEST_DB_URL not set") }
+	db, err := dbpkg.Open(dsn)
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() { db.Close() })
+	if err := dbpkg.Migrate(db); err != nil { t.Fatal(err) }
+	return db, dsn
+}
+
+// waitListening publishes probes through b until it receives one back, once
+// its backend's listener is up.
+func waitListening(t *testing.T, b *Broker, topic string) {
+	t.Helper()
+	got := make(chan struct{}, 1)
+	b.AddListener(func(tp string, evt Event) {
+		if tp != topic { return }
+		select {
+		case got <- struct{}{}:
+		default:
+		}
+	})
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		b.Publish(topic, Event{Type: "probe"})
+		select {
+		case <-got:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	t.Fatal("backend listener did not come up")
+}
+
+func TestPostgresBrokersShareEvents(t *testing.T) {
+	db, dsn := testDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	pg1, pg2 := NewPostgresBackend(db, dsn), NewPostgresBackend(db, dsn)
+	b1, b2 := NewBrokerWith(pg1), NewBrokerWith(pg2)
+	for _, pg := range []*PostgresBackend{pg1, pg2} {
+		go func(pg *PostgresBackend) {
+			if err := pg.Run(ctx); err != nil { t.Error(err) }
+		}(pg)
+	}
+	// Other test runs may share the channel; keep to a topic of our own.
+	b := make([]byte, 8)
+	rand.Read(b)
+	netID := hex.EncodeToString(b)
+	waitListening(t, b1, "probe:"+netID)
+	waitListening(t, b2, "probe:"+netID)
+
+	srv1, srv2 := newTestServer(t, b1), newTestServer(t, b2)
+	on1, on2 := stream(t, srv1, "peers:"+netID), stream(t, srv2, "peers:"+netID)
+
+	big := strings.Repeat("x", 2*notifyLimit)
+	b1.PublishToNetwork(netID, "peers", Event{Type: "peer_joined", Payload: map[string]string{"size": "small"}})
+	b1.PublishToNetwork(netID, "peers", Event{Type: "peer_updated", Payload: map[string]string{"blob": big}})
+	var ids [2]string
+	for i, want := range []string{`"size":"small"`, `"blob":"` + big + `"`} {
+		id1, data1 := nextEvent(t, on1)
+		id2, data2 := nextEvent(t, on2)
+		if id1 != id2 { t.Errorf("event %d: IDs %s and %s differ across replicas", i, id1, id2) }
+		if !strings.Contains(data1, want) || data1 != data2 { t.Errorf("event %d: payload not delivered intact (%d and %d bytes)", i, len(data1), len(data2)) }
+		ids[i] = id1
+	}
+	// The large envelope went by reference through the sse_events table.
+	var stored bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sse_events WHERE id = $1)", ids[1]).Scan(&stored); err != nil { t.Fatal(err) }
+	if !stored { t.Errorf("event %s over notifyLimit was not stored in sse_events", ids[1]) }
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sse_events WHERE id = $1)", ids[0]).Scan(&stored); err != nil { t.Fatal(err) }
+	if stored { t.Errorf("small event %s was stored instead of sent inline", ids[0]) }
+
+	// Concurrent publishers on both replicas: every replica sees the events
+	// in increasing ID order, so none is skipped on resume.
+	const publishers, each = 8, 10
+	var wg sync.WaitGroup
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func(b *Broker) {
+			defer wg.Done()
+			for j := 0; j < each; j++ { b.PublishToNetwork(netID, "peers", Event{Type: "peer_updated"}) }
+		}([]*Broker{b1, b2}[i%2])
+	}
+	wg.Wait()
+	for i, rd := range []*bufio.Reader{on1, on2} {
+		var last uint64
+		for n := 0; n < publishers*each; n++ {
+			raw, _ := nextEvent(t, rd)
+			id, err := strconv.ParseUint(raw, 10, 64)
+			if err != nil { t.Fatalf("replica %d: bad id %q", i+1, raw) }
+			if id <= last { t.Fatalf("replica %d: event %d arrived after %d", i+1, id, last) }
+			last = id
+		}
+	}
+
+	b2.Revoke("u1", "removed_from_network", "peers:"+netID)
+	readUntil(t, on1, "event: revoked")
+	readUntil(t, on2, "event: revoked")
+}
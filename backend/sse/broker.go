@@ -3,30 +3,120 @@ package sse
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// DefaultHeartbeat is how often an idle stream gets a comment line, so
+// proxies and load balancers do not time it out.
+const DefaultHeartbeat = 15 * time.Second
+
 type Event struct {
 	Type    string      `json:"type"`
 	Payload interface{} `json:"payload"`
 }
 
+// clientBuffer is how many events may queue for a client before it counts
+// as a slow consumer.
+const clientBuffer = 64
+
+// Subscriber identifies who opened a stream, so that it can be ended when
+// their access goes away. A zero Expires never ends the stream.
+type Subscriber struct {
+	User    string
+	Session string
+	Expires time.Time
+}
+
+// Reasons a stream is ended by the server.
+const (
+	reasonSlow    = "slow_consumer"
+	reasonResync  = "resync"
+	reasonExpired = "session_expired"
+)
+
 type client struct {
-	send   chan Event
+	send   chan message
 	topics []string
+	sub    Subscriber
+	// stop is closed, once, to end the stream: when the client's buffer
+	// overflows or its access is revoked. stopped and reason are guarded by
+	// mu.
+	stop    chan struct{}
+	stopped bool
+	reason  string
+}
+
+// stopLocked ends the client's stream with reason; the first reason wins.
+func (c *client) stopLocked(reason string) bool {
+	if c.stopped { return false }
+	c.stopped, c.reason = true, reason
+	close(c.stop)
+	return true
 }
 
+func (c *client) subscribed(topics []string) bool {
+	if len(topics) == 0 { return true }
+	for _, t := range c.topics {
+		for _, u := range topics {
+			if t == u { return true }
+		}
+	}
+	return false
+}
+
+// Listener is called synchronously for every published event and must not
+// block or publish.
+type Listener func(topic string, evt Event)
+
 type Broker struct {
-	mu      sync.RWMutex
-	clients map[*client]struct{}
+	backend   Backend
+	mu        sync.RWMutex
+	clients   map[*client]struct{}
+	listeners []Listener
+	waiters   map[string][]chan struct{}
+	rings     map[string]*ring
+	// firstID is the ID base of this process; nextID the last ID issued.
+	// With a backend that assigns IDs, firstID is set by the first event
+	// received (seeded) and nextID follows the events.
+	firstID, nextID uint64
+	seeded          bool
+
+	// Heartbeat is the interval between keep-alive comments on idle streams.
+	Heartbeat time.Duration
+
+	published, dropped, slowDisconnects, connections atomic.Uint64
+}
+
+// NewBroker returns a broker for a single replica.
+func NewBroker() *Broker { return NewBrokerWith(NewMemoryBackend()) }
+
+// NewBrokerWith returns a broker that publishes through backend, so that
+// subscribers on every broker sharing it get the events.
+func NewBrokerWith(backend Backend) *Broker {
+	base := newIDBase()
+	b := &Broker{backend: backend, clients: make(map[*client]struct{}), waiters: make(map[string][]chan struct{}), rings: make(map[string]*ring), firstID: base, nextID: base, Heartbeat: DefaultHeartbeat}
+	backend.Attach(b.deliver)
+	return b
 }
 
-func NewBroker() *Broker {
-	return &Broker{clients: make(map[*client]struct{})}
+// Subscribe streams events on topics to sub until the client goes away or
+// the stream is ended by Revoke, RevokeSession or sub.Expires.
+func (b *Broker) Subscribe(w http.ResponseWriter, r *http.Request, sub Subscriber, topics ...string) {
+	b.SubscribeWith(w, r, sub, nil, topics...)
 }
 
-func (b *Broker) Subscribe(w http.ResponseWriter, r *http.Request, topics ...string) {
+// SubscribeWith is Subscribe with events sent ahead of the live stream, such
+// as a snapshot. initial is called once the client is registered, so nothing
+// published meanwhile is lost; such events follow the initial ones.
+//
+// A client reconnecting with Last-Event-ID first gets the events it missed.
+// If they are no longer buffered it gets a "reset" event instead and should
+// rebuild its state from scratch.
+func (b *Broker) SubscribeWith(w http.ResponseWriter, r *http.Request, sub Subscriber, initial func() []Event, topics ...string) {
 	flusher, ok := w.(http.Flusher)
 	if !ok { http.Error(w, "streaming not supported", http.StatusInternalServerError); return }
 	w.Header().Set("Content-Type", "text/event-stream")
@@ -34,11 +124,16 @@ func (b *Broker) Subscribe(w http.ResponseWriter, r *http.Request, topics ...str
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("X-Accel-Buffering", "no")
 
-	c := &client{send: make(chan Event, 64), topics: topics}
+	c := &client{send: make(chan message, clientBuffer), topics: topics, sub: sub, stop: make(chan struct{})}
 
+	var missed []message
+	reset := false
+	last, resuming := lastEventID(r)
 	b.mu.Lock()
+	if resuming { missed, ok = b.replayLocked(last, topics); reset = !ok }
 	b.clients[c] = struct{}{}
 	b.mu.Unlock()
+	b.connections.Add(1)
 
 	defer func() {
 		b.mu.Lock()
@@ -48,36 +143,194 @@ func (b *Broker) Subscribe(w http.ResponseWriter, r *http.Request, topics ...str
 	}()
 
 	fmt.Fprintf(w, "event: ping\n\n")
+	if reset { writeEvent(w, 0, Event{Type: "reset", Payload: map[string]string{"reason": "missed events are no longer available"}}) }
+	if initial != nil {
+		for _, evt := range initial() { writeEvent(w, 0, evt) }
+	}
+	for _, m := range missed { writeEvent(w, m.id, m.evt) }
 	flusher.Flush()
 
+	heartbeat := time.NewTicker(b.Heartbeat)
+	defer heartbeat.Stop()
+	if !sub.Expires.IsZero() {
+		expiry := time.AfterFunc(time.Until(sub.Expires), func() {
+			b.mu.Lock()
+			c.stopLocked(reasonExpired)
+			b.mu.Unlock()
+		})
+		defer expiry.Stop()
+	}
 	for {
 		select {
 		case <-r.Context().Done():
 			return
-		case evt, open := <-c.send:
+		case m, open := <-c.send:
 			if !open { return }
-			data, err := json.Marshal(evt)
-			if err != nil { continue }
-			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evt.Type, data)
+			writeEvent(w, m.id, m.evt)
 			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-c.stop:
+			b.mu.RLock()
+			reason := c.reason
+			b.mu.RUnlock()
+			if reason != reasonSlow && reason != reasonResync {
+				// Queued events are not delivered: the subscriber may no
+				// longer see them.
+				writeEvent(w, 0, Event{Type: "revoked", Payload: map[string]string{"reason": reason}})
+				flusher.Flush()
+				return
+			}
+			// Deliver what is queued, then tell the client to come back with
+			// Last-Event-ID; the replay buffer covers what was dropped.
+			for drained := false; !drained; {
+				select {
+				case m := <-c.send:
+					writeEvent(w, m.id, m.evt)
+				default:
+					drained = true
+				}
+			}
+			fmt.Fprintf(w, "retry: 1000\n")
+			writeEvent(w, 0, Event{Type: "reconnect", Payload: map[string]string{"reason": reason}})
+			flusher.Flush()
+			return
 		}
 	}
 }
 
+// writeEvent writes one event in the text/event-stream format. Events with
+// an ID update the client's Last-Event-ID.
+func writeEvent(w http.ResponseWriter, id uint64, evt Event) {
+	data, err := json.Marshal(evt)
+	if err != nil { return }
+	if id != 0 { fmt.Fprintf(w, "id: %d\n", id) }
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evt.Type, data)
+}
+
+// AddListener registers fn to observe every published event, for in-process
+// consumers such as the mesh DNS responder.
+func (b *Broker) AddListener(fn Listener) {
+	b.mu.Lock()
+	b.listeners = append(b.listeners, fn)
+	b.mu.Unlock()
+}
+
+// Notify returns a channel that is closed by the next event published on
+// topic, for request handlers that wait for a change (long-polling). Call
+// cancel when done waiting.
+func (b *Broker) Notify(topic string) (ch <-chan struct{}, cancel func()) {
+	c := make(chan struct{})
+	b.mu.Lock()
+	b.waiters[topic] = append(b.waiters[topic], c)
+	b.mu.Unlock()
+	return c, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		list := b.waiters[topic]
+		for i, w := range list {
+			if w == c { b.waiters[topic] = append(list[:i], list[i+1:]...); break }
+		}
+		if len(b.waiters[topic]) == 0 { delete(b.waiters, topic) }
+	}
+}
+
+// Publish sends evt to the subscribers of topic on every broker sharing the
+// backend.
 func (b *Broker) Publish(topic string, evt Event) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+	b.published.Add(1)
+	if err := b.backend.Publish(Envelope{Topic: topic, Event: &evt}); err != nil { log.Printf("sse publish error: %v", err) }
+}
+
+// deliver handles an envelope from the backend on this broker.
+func (b *Broker) deliver(env Envelope) {
+	switch {
+	case env.resync:
+		b.resync()
+	case env.Revoke != nil:
+		b.revokeLocal(*env.Revoke)
+	case env.Event != nil:
+		b.deliverEvent(env.ID, env.Topic, *env.Event)
+	}
+}
+
+func (b *Broker) deliverEvent(id uint64, topic string, evt Event) {
+	b.mu.Lock()
+	if id == 0 {
+		b.nextID++
+		id = b.nextID
+	} else if !b.seeded {
+		b.firstID, b.nextID, b.seeded = id-1, id, true
+	} else if id > b.nextID {
+		b.nextID = id
+	}
+	m := message{id: id, evt: evt}
+	rg := b.rings[topic]
+	if rg == nil { rg = &ring{}; b.rings[topic] = rg }
+	rg.add(m)
+	waiters := b.waiters[topic]
+	delete(b.waiters, topic)
+	listeners := b.listeners
 	for c := range b.clients {
+		// A stopped client resumes, if at all, through the replay buffer.
+		if c.stopped { continue }
 		for _, t := range c.topics {
 			if t == topic {
 				select {
-				case c.send <- evt:
+				case c.send <- m:
 				default:
+					b.dropped.Add(1)
+					if c.stopLocked(reasonSlow) { b.slowDisconnects.Add(1) }
 				}
 				break
 			}
 		}
 	}
+	b.mu.Unlock()
+
+	for _, c := range waiters { close(c) }
+	for _, fn := range listeners { fn(topic, evt) }
+}
+
+// Revoke ends the streams userID has open on any of topics (all of them if
+// none are given), telling the client why with a "revoked" event. An empty
+// userID matches every subscriber, e.g. when a network is deleted.
+func (b *Broker) Revoke(userID, reason string, topics ...string) {
+	b.revoke(Revocation{User: userID, Topics: topics, Reason: reason})
+}
+
+// RevokeSession ends every stream opened with the given session.
+func (b *Broker) RevokeSession(session, reason string) {
+	if session == "" { return }
+	b.revoke(Revocation{Session: session, Reason: reason})
+}
+
+func (b *Broker) revoke(rv Revocation) {
+	if err := b.backend.Publish(Envelope{Revoke: &rv}); err != nil { log.Printf("sse revoke error: %v", err) }
+}
+
+func (b *Broker) revokeLocal(rv Revocation) {
+	b.mu.Lock()
+	for c := range b.clients {
+		if rv.Session != "" {
+			if c.sub.Session == rv.Session { c.stopLocked(rv.Reason) }
+			continue
+		}
+		if (rv.User == "" || c.sub.User == rv.User) && c.subscribed(rv.Topics) { c.stopLocked(rv.Reason) }
+	}
+	b.mu.Unlock()
+}
+
+// resync drops the replay buffers after the backend may have lost events,
+// and sends every client away to reconnect; their Last-Event-ID then predates
+// firstID, so they get a "reset".
+func (b *Broker) resync() {
+	b.mu.Lock()
+	b.rings = make(map[string]*ring)
+	b.firstID, b.seeded = b.nextID+1, false
+	for c := range b.clients { c.stopLocked(reasonResync) }
+	b.mu.Unlock()
 }
 
 func (b *Broker) PublishToUser(userID string, evt Event) {
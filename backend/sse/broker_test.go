@@ -0,0 +1,182 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stream opens topics on srv and returns a reader positioned after the
+// initial ping. With lastID the stream resumes after that event.
+func stream(t *testing.T, srv *httptest.Server, topics string, lastID ...string) *bufio.Reader {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"?topics="+topics, nil)
+	if len(lastID) > 0 { req.Header.Set("Last-Event-ID", lastID[0]) }
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() { resp.Body.Close() })
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" { t.Fatalf("Content-Type = %q", ct) }
+	rd := bufio.NewReader(resp.Body)
+	if line, _ := rd.ReadString('\n'); line != "event: ping\n" { t.Fatalf("first line = %q, want ping", line) }
+	return rd
+}
+
+// newTestServer serves b's streams. It is closed after the streams opened
+// on it, which are cancelled first.
+func newTestServer(t *testing.T, b *Broker) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.Subscribe(w, r, Subscriber{User: "u1"}, strings.Split(r.URL.Query().Get("topics"), ",")...)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// readUntil reads lines until one has the given prefix or the deadline
+// passes.
+func readUntil(t *testing.T, rd *bufio.Reader, prefix string) string {
+	t.Helper()
+	found := make(chan string, 1)
+	go func() {
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil { close(found); return }
+			if strings.HasPrefix(line, prefix) { found <- line; return }
+		}
+	}()
+	select {
+	case line, ok := <-found:
+		if !ok { t.Fatalf("stream ended before %q", prefix) }
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %q line within 5s", prefix)
+	}
+	return ""
+}
+
+func TestHeartbeatOnIdleStream(t *testing.T) {
+	b := NewBroker()
+	b.Heartbeat = 20 * time.Millisecond
+	srv := newTestServer(t, b)
+	rd := stream(t, srv, "peers:n1")
+	readUntil(t, rd, ": keepalive")
+	readUntil(t, rd, ": keepalive")
+}
+
+func TestEventsReachSubscribedTopicsOnly(t *testing.T) {
+	b := NewBroker()
+	srv := newTestServer(t, b)
+	rd := stream(t, srv, "peers:n1")
+	b.PublishToNetwork("n2", "peers", Event{Type: "peer_joined", Payload: map[string]string{"n": "2"}})
+	b.PublishToNetwork("n1", "peers", Event{Type: "peer_joined", Payload: map[string]string{"n": "1"}})
+	if line := readUntil(t, rd, "data: "); !strings.Contains(line, `"n":"1"`) { t.Errorf("got %q, want the n1 event", line) }
+}
+
+func TestRevokeEndsStream(t *testing.T) {
+	b := NewBroker()
+	srv := newTestServer(t, b)
+	rd := stream(t, srv, "peers:n1")
+	b.Revoke("u1", "removed_from_network", "peers:n1")
+	if line := readUntil(t, rd, "data: "); !strings.Contains(line, `"type":"revoked"`) || !strings.Contains(line, "removed_from_network") {
+		t.Errorf("got %q, want a revoked event", line)
+	}
+}
+
+// gatedWriter is a streaming ResponseWriter whose writes block after the
+// first flush until the gate is opened, like a client that stopped reading.
+type gatedWriter struct {
+	hdr   http.Header
+	ready chan struct{}
+	gate  chan struct{}
+	once  sync.Once
+	mu    sync.Mutex
+	buf   bytes.Buffer
+}
+
+func newGatedWriter() *gatedWriter {
+	return &gatedWriter{hdr: http.Header{}, ready: make(chan struct{}), gate: make(chan struct{})}
+}
+
+func (g *gatedWriter) Header() http.Header { return g.hdr }
+func (g *gatedWriter) WriteHeader(int)     {}
+func (g *gatedWriter) Flush()              { g.once.Do(func() { close(g.ready) }) }
+
+func (g *gatedWriter) Write(p []byte) (int, error) {
+	select {
+	case <-g.ready:
+		<-g.gate
+	default:
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.buf.Write(p)
+}
+
+func TestSlowConsumerIsSentToReconnect(t *testing.T) {
+	b := NewBroker()
+	w := newGatedWriter()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Subscribe(w, httptest.NewRequest("GET", "/sse", nil), Subscriber{User: "u1"}, "peers:n1")
+	}()
+	<-w.ready
+
+	// The stream takes at most one event before its write blocks; the rest
+	// fill the buffer and the last one overflows it.
+	for i := 0; i < clientBuffer+2; i++ { b.PublishToNetwork("n1", "peers", Event{Type: "peer_updated"}) }
+	close(w.gate)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not ended")
+	}
+
+	body := w.buf.String()
+	if !strings.Contains(body, "retry: 1000\nevent: reconnect\n") || !strings.Contains(body, `"reason":"slow_consumer"`) {
+		t.Errorf("stream does not end with a reconnect event:\n%s", body[max(0, len(body)-200):])
+	}
+	if n := strings.Count(body, "event: peer_updated"); n < clientBuffer {
+		t.Errorf("%d queued events delivered before the reconnect, want at least %d", n, clientBuffer)
+	}
+	if st := b.Stats(); st.SlowDisconnects != 1 || st.Dropped == 0 {
+		t.Errorf("stats = %+v, want 1 slow disconnect and dropped events", st)
+	}
+	rec := httptest.NewRecorder()
+	b.MetricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "\nsse_slow_consumer_disconnects_total 1\n") {
+		t.Errorf("metrics do not count the disconnect:\n%s", rec.Body)
+	}
+}
+
+func TestMetricsOutput(t *testing.T) {
+	b := NewBroker()
+	srv := newTestServer(t, b)
+	stream(t, srv, "peers:n1,activity:n1")
+	stream(t, srv, "peers:n2")
+	b.PublishToNetwork("n1", "peers", Event{Type: "peer_joined"})
+	b.PublishToUser("u1", Event{Type: "invitation"})
+
+	rec := httptest.NewRecorder()
+	b.MetricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" { t.Errorf("Content-Type = %q", ct) }
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE sse_subscribers gauge\n",
+		"sse_subscribers{kind=\"activity\"} 1\nsse_subscribers{kind=\"peers\"} 2\n",
+		"\nsse_connections_total 2\n",
+		"\nsse_events_published_total 2\n",
+		"\nsse_events_dropped_total 0\n",
+		"\nsse_slow_consumer_disconnects_total 0\n",
+	} {
+		if !strings.Contains(body, want) { t.Errorf("metrics missing %q:\n%s", want, body) }
+	}
+	if strings.Contains(body, "n1") || strings.Contains(body, "u1") { t.Errorf("metrics expose IDs:\n%s", body) }
+}
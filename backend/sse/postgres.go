@@ -0,0 +1,128 @@
+package sse
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	pgChannel = "sse_events"
+	// notifyLimit keeps NOTIFY payloads under Postgres's 8000-byte limit.
+	// Larger envelopes are stored in sse_events and sent by reference.
+	notifyLimit = 7000
+	// eventRetention is how long stored envelopes are kept for replicas to
+	// fetch.
+	eventRetention = 10 * time.Minute
+	// publishLock is the advisory lock key ("sse_evts") serializing Publish.
+	publishLock = 0x7373655f65767473
+)
+
+// PostgresBackend fans events out to every replica through LISTEN/NOTIFY on
+// the application database. Event IDs come from the sse_events sequence, so
+// they agree across replicas and a client can resume on any of them.
+type PostgresBackend struct {
+	DB  *sql.DB
+	DSN string
+
+	mu       sync.RWMutex
+	delivers []func(Envelope)
+}
+
+func NewPostgresBackend(db *sql.DB, dsn string) *PostgresBackend {
+	return &PostgresBackend{DB: db, DSN: dsn}
+}
+
+func (p *PostgresBackend) Attach(deliver func(Envelope)) {
+	p.mu.Lock()
+	p.delivers = append(p.delivers, deliver)
+	p.mu.Unlock()
+}
+
+// notification is the NOTIFY payload: the envelope itself, or with Ref set
+// the ID of the sse_events row holding it.
+type notification struct {
+	ID  uint64          `json:"id"`
+	Env json.RawMessage `json:"env,omitempty"`
+	Ref bool            `json:"ref,omitempty"`
+}
+
+// Publish sends env to every replica, this one included once Run receives
+// it back.
+//
+// Notifications arrive in commit order, so the ID is taken and the
+// transaction committed under an advisory lock: otherwise concurrent
+// publishers could commit out of ID order, and a client resuming after the
+// later ID would never be replayed the earlier one.
+func (p *PostgresBackend) Publish(env Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil { return err }
+	tx, err := p.DB.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", int64(publishLock)); err != nil { return err }
+	if len(data) <= notifyLimit {
+		_, err = tx.Exec("SELECT pg_notify($1, json_build_object('id', nextval('sse_events_id_seq'), 'env', $2::json)::text)", pgChannel, string(data))
+	} else {
+		_, err = tx.Exec(
+			`WITH e AS (INSERT INTO sse_events (payload) VALUES ($2) RETURNING id)
+			SELECT pg_notify($1, json_build_object('id', id, 'ref', true)::text) FROM e`, pgChannel, string(data))
+	}
+	if err != nil { return err }
+	return tx.Commit()
+}
+
+// Run listens for envelopes and delivers them, in order, until ctx is
+// cancelled. When the listener connection drops, attached brokers are told
+// to resync since envelopes may have been missed.
+func (p *PostgresBackend) Run(ctx context.Context) error {
+	listener := pq.NewListener(p.DSN, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil { log.Printf("sse listener: %v", err) }
+	})
+	defer listener.Close()
+	if err := listener.Listen(pgChannel); err != nil { return fmt.Errorf("listen %s: %w", pgChannel, err) }
+	log.Printf("sse: fanning out events through postgres channel %s", pgChannel)
+
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n := <-listener.Notify:
+			if n == nil { p.deliver(Envelope{resync: true}); continue }
+			env, err := p.decode(ctx, n.Extra)
+			if err != nil { log.Printf("sse notification error: %v", err); continue }
+			p.deliver(env)
+		case <-tick.C:
+			go listener.Ping()
+			if _, err := p.DB.ExecContext(ctx, "DELETE FROM sse_events WHERE created_at < $1", time.Now().Add(-eventRetention)); err != nil { log.Printf("sse events cleanup error: %v", err) }
+		}
+	}
+}
+
+func (p *PostgresBackend) decode(ctx context.Context, payload string) (Envelope, error) {
+	var n notification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil { return Envelope{}, err }
+	data := []byte(n.Env)
+	if n.Ref {
+		if err := p.DB.QueryRowContext(ctx, "SELECT payload FROM sse_events WHERE id = $1", n.ID).Scan(&data); err != nil { return Envelope{}, fmt.Errorf("load event %d: %w", n.ID, err) }
+	}
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil { return Envelope{}, err }
+	env.ID = n.ID
+	return env, nil
+}
+
+func (p *PostgresBackend) deliver(env Envelope) {
+	p.mu.RLock()
+	delivers := p.delivers
+	p.mu.RUnlock()
+	for _, d := range delivers { d(env) }
+}
@@ -0,0 +1,68 @@
+package sse
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ReplaySize is how many recent events each topic keeps for clients that
+// reconnect with Last-Event-ID.
+const ReplaySize = 256
+
+// message is an event with the ID it was published under.
+type message struct {
+	id  uint64
+	evt Event
+}
+
+// ring holds a topic's most recent events, oldest first.
+type ring struct {
+	msgs []message
+	// evicted is the ID of the newest event that fell out of the ring.
+	evicted uint64
+}
+
+func (r *ring) add(m message) {
+	if len(r.msgs) == ReplaySize {
+		r.evicted = r.msgs[0].id
+		r.msgs = append(r.msgs[:0], r.msgs[1:]...)
+	}
+	r.msgs = append(r.msgs, m)
+}
+
+// newIDBase seeds event IDs from the clock so they keep increasing across
+// restarts, and a client that saw events from a previous process is told to
+// reset rather than given a partial replay.
+func newIDBase() uint64 { return uint64(time.Now().UnixMilli()) << 10 }
+
+// lastEventID reads the ID a reconnecting client last saw, from the
+// Last-Event-ID header (sent by EventSource) or ?last_event_id=.
+func lastEventID(r *http.Request) (uint64, bool) {
+	raw := r.Header.Get("Last-Event-ID")
+	if raw == "" { raw = r.URL.Query().Get("last_event_id") }
+	if raw == "" { return 0, false }
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil { return 0, false }
+	return id, true
+}
+
+// replayLocked returns the buffered events on topics published after last,
+// in ID order. ok is false when some of them are no longer buffered. b.mu
+// must be held.
+func (b *Broker) replayLocked(last uint64, topics []string) (msgs []message, ok bool) {
+	if last < b.firstID || last > b.nextID { return nil, false }
+	for _, t := range topics {
+		rg := b.rings[t]
+		if rg == nil { continue }
+		if rg.evicted > last { return nil, false }
+		for _, m := range rg.msgs {
+			if m.id > last { msgs = append(msgs, m) }
+		}
+	}
+	// Merge topics back into publish order.
+	for i := 1; i < len(msgs); i++ {
+		for j := i; j > 0 && msgs[j].id < msgs[j-1].id; j-- { msgs[j], msgs[j-1] = msgs[j-1], msgs[j] }
+	}
+	return msgs, true
+}
@@ -0,0 +1,101 @@
+package sse
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// publishN publishes n events on topic and returns the ID of the first.
+func publishN(b *Broker, topic string, n int) uint64 {
+	var first uint64
+	for i := 0; i < n; i++ {
+		b.Publish(topic, Event{Type: "e", Payload: i})
+		if i == 0 {
+			b.mu.Lock()
+			first = b.nextID
+			b.mu.Unlock()
+		}
+	}
+	return first
+}
+
+func replay(b *Broker, last uint64, topics ...string) ([]message, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.replayLocked(last, topics)
+}
+
+func TestReplayAfterEviction(t *testing.T) {
+	b := NewBroker()
+	first := publishN(b, "t", ReplaySize+1)
+
+	// The first event fell out of the ring: a client that has not seen it
+	// must reset, one that has gets everything after it.
+	if _, ok := replay(b, first-1, "t"); ok { t.Error("replayed past an evicted event") }
+	msgs, ok := replay(b, first, "t")
+	if !ok || len(msgs) != ReplaySize { t.Fatalf("replay after the evicted event = %d events, %v; want %d", len(msgs), ok, ReplaySize) }
+	if msgs[0].id != first+1 { t.Errorf("first replayed ID = %d, want %d", msgs[0].id, first+1) }
+
+	srv := newTestServer(t, b)
+	rd := stream(t, srv, "t", strconv.FormatUint(first-1, 10))
+	readUntil(t, rd, "event: reset")
+}
+
+func TestReplayOutOfRange(t *testing.T) {
+	b := NewBroker()
+	first := publishN(b, "t", 3)
+	last := first + 2
+
+	if _, ok := replay(b, first-2, "t"); ok { t.Error("replayed an ID from before this broker's first event") }
+	if _, ok := replay(b, last+1, "t"); ok { t.Error("replayed an ID newer than any issued") }
+	if msgs, ok := replay(b, last, "t"); !ok || len(msgs) != 0 { t.Errorf("replay when up to date = %d events, %v", len(msgs), ok) }
+	if msgs, ok := replay(b, first-1, "t"); !ok || len(msgs) != 3 { t.Errorf("replay from the start = %d events, %v", len(msgs), ok) }
+	if msgs, ok := replay(b, first, "other"); !ok || len(msgs) != 0 { t.Errorf("replay of a quiet topic = %d events, %v", len(msgs), ok) }
+}
+
+func TestReplayMergesTopicsInOrder(t *testing.T) {
+	b := NewBroker()
+	topics := []string{"a", "b", "c"}
+	for i := 0; i < 12; i++ { b.Publish(topics[i*7%3], Event{Type: "e", Payload: i}) }
+	b.mu.Lock()
+	start := b.firstID
+	b.mu.Unlock()
+
+	msgs, ok := replay(b, start+3, "c", "a", "b")
+	if !ok || len(msgs) != 9 { t.Fatalf("replay = %d events, %v; want 9", len(msgs), ok) }
+	for i, m := range msgs {
+		if m.id != start+4+uint64(i) { t.Errorf("event %d has ID %d, want %d", i, m.id, start+4+uint64(i)) }
+	}
+	if msgs, _ := replay(b, start, "a"); len(msgs) != 4 { t.Errorf("replay of one topic = %d events, want 4", len(msgs)) }
+}
+
+func TestLastEventID(t *testing.T) {
+	tests := []struct {
+		header, query string
+		want          uint64
+		ok            bool
+	}{
+		{"", "", 0, false},
+		{"42", "", 42, true},
+		{"", "42", 42, true},
+		{"42", "7", 42, true},
+		{"abc", "", 0, false},
+		{"-1", "", 0, false},
+		{"1.5", "", 0, false},
+		{"99999999999999999999", "", 0, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/events?last_event_id="+tt.query, nil)
+		if tt.header != "" { r.Header.Set("Last-Event-ID", tt.header) }
+		if got, ok := lastEventID(r); got != tt.want || ok != tt.ok { t.Errorf("lastEventID(header %q, query %q) = %d, %v; want %d, %v", tt.header, tt.query, got, ok, tt.want, tt.ok) }
+	}
+
+	// A malformed ID is treated as a fresh connection, not a reset.
+	b := NewBroker()
+	srv := newTestServer(t, b)
+	rd := stream(t, srv, "t", "not-a-number")
+	b.Publish("t", Event{Type: "live"})
+	if line := readUntil(t, rd, "data: "); !strings.Contains(line, `"type":"live"`) { t.Errorf("first event = %q, want the live event", line) }
+}
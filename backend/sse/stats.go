@@ -0,0 +1,73 @@
+package sse
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Stats is a point-in-time view of the broker's counters.
+type Stats struct {
+	// Subscribers counts open subscriptions per topic. A stream on several
+	// topics counts once for each.
+	Subscribers map[string]int
+	// Connections is the number of streams opened since start.
+	Connections uint64
+	Published   uint64
+	// Dropped counts events not delivered because a client's buffer was
+	// full; SlowDisconnects the clients cut off for it.
+	Dropped         uint64
+	SlowDisconnects uint64
+}
+
+func (b *Broker) Stats() Stats {
+	st := Stats{
+		Subscribers:     make(map[string]int),
+		Connections:     b.connections.Load(),
+		Published:       b.published.Load(),
+		Dropped:         b.dropped.Load(),
+		SlowDisconnects: b.slowDisconnects.Load(),
+	}
+	b.mu.RLock()
+	for c := range b.clients {
+		for _, t := range c.topics { st.Subscribers[t]++ }
+	}
+	b.mu.RUnlock()
+	return st
+}
+
+// topicKind strips the network or user ID from a topic ("peers:<id>" becomes
+// "peers") so metrics do not expose IDs.
+func topicKind(topic string) string {
+	if i := strings.IndexByte(topic, ':'); i >= 0 { return topic[:i] }
+	return topic
+}
+
+// MetricsHandler serves the counters in the Prometheus text format, with
+// subscribers summed per topic kind.
+func (b *Broker) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	st := b.Stats()
+	kinds := map[string]int{}
+	for t, n := range st.Subscribers { kinds[topicKind(t)] += n }
+	names := make([]string, 0, len(kinds))
+	for k := range kinds { names = append(names, k) }
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP sse_subscribers Open SSE subscriptions by topic kind.")
+	fmt.Fprintln(w, "# TYPE sse_subscribers gauge")
+	for _, k := range names { fmt.Fprintf(w, "sse_subscribers{kind=%q} %d\n", k, kinds[k]) }
+	fmt.Fprintln(w, "# HELP sse_connections_total SSE streams opened.")
+	fmt.Fprintln(w, "# TYPE sse_connections_total counter")
+	fmt.Fprintf(w, "sse_connections_total %d\n", st.Connections)
+	fmt.Fprintln(w, "# HELP sse_events_published_total Events published to the broker.")
+	fmt.Fprintln(w, "# TYPE sse_events_published_total counter")
+	fmt.Fprintf(w, "sse_events_published_total %d\n", st.Published)
+	fmt.Fprintln(w, "# HELP sse_events_dropped_total Events not delivered to a client whose buffer was full.")
+	fmt.Fprintln(w, "# TYPE sse_events_dropped_total counter")
+	fmt.Fprintf(w, "sse_events_dropped_total %d\n", st.Dropped)
+	fmt.Fprintln(w, "# HELP sse_slow_consumer_disconnects_total Clients disconnected for falling behind.")
+	fmt.Fprintln(w, "# TYPE sse_slow_consumer_disconnects_total counter")
+	fmt.Fprintf(w, "sse_slow_consumer_disconnects_total %d\n", st.SlowDisconnects)
+}
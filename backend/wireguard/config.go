@@ -0,0 +1,82 @@
+package wireguard
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Interface is the [Interface] section of a device configuration.
+type Interface struct {
+	PrivateKey string
+	Address    []string
+	DNS        []string // resolver IPs
+	// SearchDomains are appended to the resolver list by wg-quick.
+	SearchDomains []string
+	// DNSRoutes send queries for a domain to specific resolvers (split DNS).
+	DNSRoutes []DNSRoute
+	// Zero values leave the setting to the implementation's default.
+	ListenPort int
+	MTU        int
+	FwMark     uint32
+	Table      string // "off", "auto" or a routing table number
+	// PostUp and PostDown are shell commands run by wg-quick.
+	PostUp   []string
+	PostDown []string
+}
+
+// DNSRoute resolves Domain and its subdomains through Nameservers.
+type DNSRoute struct {
+	Domain      string
+	Nameservers []string
+}
+
+// PeerConfig is one [Peer] section of a device configuration.
+type PeerConfig struct {
+	PublicKey           string
+	PresharedKey        string
+	Endpoint            string
+	AllowedIPs          []string
+	PersistentKeepalive int
+}
+
+// Config is a complete device configuration for a single peer.
+type Config struct {
+	Interface Interface
+	Peers     []PeerConfig
+}
+
+// WGQuick renders the configuration in the wg-quick(8) format. An empty
+// PrivateKey is rendered as a placeholder for the user to fill in.
+func (c *Config) WGQuick() string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	if c.Interface.PrivateKey != "" {
+		fmt.Fprintf(&b, "PrivateKey = %s\n", c.Interface.PrivateKey)
+	} else {
+		b.WriteString("PrivateKey = <your-private-key>\n")
+	}
+	if c.Interface.ListenPort > 0 { fmt.Fprintf(&b, "ListenPort = %d\n", c.Interface.ListenPort) }
+	if c.Interface.FwMark > 0 { fmt.Fprintf(&b, "FwMark = %d\n", c.Interface.FwMark) }
+	if len(c.Interface.Address) > 0 { fmt.Fprintf(&b, "Address = %s\n", strings.Join(c.Interface.Address, ", ")) }
+	if dns := append(append([]string{}, c.Interface.DNS...), c.Interface.SearchDomains...); len(dns) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(dns, ", "))
+	}
+	// wg-quick has no split DNS; routes are listed for reference and applied
+	// by the agent or a resolver-aware format.
+	for _, rt := range c.Interface.DNSRoutes {
+		fmt.Fprintf(&b, "# DNS route: %s via %s\n", rt.Domain, strings.Join(rt.Nameservers, ", "))
+	}
+	if c.Interface.MTU > 0 { fmt.Fprintf(&b, "MTU = %d\n", c.Interface.MTU) }
+	if c.Interface.Table != "" { fmt.Fprintf(&b, "Table = %s\n", c.Interface.Table) }
+	for _, cmd := range c.Interface.PostUp { fmt.Fprintf(&b, "PostUp = %s\n", cmd) }
+	for _, cmd := range c.Interface.PostDown { fmt.Fprintf(&b, "PostDown = %s\n", cmd) }
+	for _, p := range c.Peers {
+		b.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", p.PublicKey)
+		if p.PresharedKey != "" { fmt.Fprintf(&b, "PresharedKey = %s\n", p.PresharedKey) }
+		if p.Endpoint != "" { fmt.Fprintf(&b, "Endpoint = %s\n", p.Endpoint) }
+		if len(p.AllowedIPs) > 0 { fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(p.AllowedIPs, ", ")) }
+		if p.PersistentKeepalive > 0 { fmt.Fprintf(&b, "PersistentKeepalive = %d\n", p.PersistentKeepalive) }
+	}
+	return b.String()
+}
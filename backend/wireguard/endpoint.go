@@ -0,0 +1,57 @@
+package wireguard
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidEndpoint = errors.New("endpoint must be host:port, e.g. 203.0.113.5:51820, [2001:db8::1]:51820 or vpn.example.com:51820")
+	ErrInvalidPort     = errors.New("endpoint port must be between 1 and 65535")
+	ErrInvalidHost     = errors.New("endpoint host must be an IPv4 address, an IPv6 address in brackets, or a DNS hostname")
+)
+
+// ParseEndpoint validates a peer endpoint and returns it in canonical form
+// (lower-cased hostname, compressed IPv6 in brackets).
+func ParseEndpoint(s string) (string, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil || host == "" || portStr == "" { return "", ErrInvalidEndpoint }
+	port, err := strconv.Atoi(portStr)
+	if err != nil || portStr[0] == '+' || portStr[0] == '-' { return "", ErrInvalidPort }
+	if port < 1 || port > 65535 { return "", ErrInvalidPort }
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Zone() != "" { return "", ErrInvalidHost }
+		if ip.Is4() && strings.Contains(s, "[") { return "", ErrInvalidHost }
+		if ip.Is6() && !strings.HasPrefix(s, "[") { return "", ErrInvalidHost }
+		return netip.AddrPortFrom(ip, uint16(port)).String(), nil
+	}
+	if strings.HasPrefix(s, "[") { return "", ErrInvalidHost }
+	if !ValidHostname(host) { return "", ErrInvalidHost }
+	return net.JoinHostPort(strings.ToLower(strings.TrimSuffix(host, ".")), strconv.Itoa(port)), nil
+}
+
+// ValidHostname reports whether h is an RFC 1123 hostname. A single trailing
+// dot is allowed. All-numeric names are rejected so that malformed IPv4
+// addresses are not mistaken for hostnames.
+func ValidHostname(h string) bool {
+	h = strings.TrimSuffix(h, ".")
+	if h == "" || len(h) > 253 { return false }
+	allNumeric := true
+	for _, label := range strings.Split(h, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' { return false }
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			switch {
+			case c >= '0' && c <= '9':
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '-':
+				allNumeric = false
+			default:
+				return false
+			}
+		}
+	}
+	return !allNumeric
+}
@@ -0,0 +1,57 @@
+package wireguard
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		in, want string
+		err      error
+	}{
+		{"203.0.113.5:51820", "203.0.113.5:51820", nil},
+		{"[2001:DB8:0::1]:51820", "[2001:db8::1]:51820", nil},
+		{"VPN.Example.com.:51820", "vpn.example.com:51820", nil},
+		{"203.0.113.5", "", ErrInvalidEndpoint},
+		{"203.0.113.5:0", "", ErrInvalidPort},
+		{"203.0.113.5:+80", "", ErrInvalidPort},
+		{"[203.0.113.5]:80", "", ErrInvalidHost},
+		{"2001:db8::1:80", "", ErrInvalidEndpoint},
+		{"[fe80::1%eth0]:80", "", ErrInvalidHost},
+		{"999.1.1.1:80", "", ErrInvalidHost},
+		{"-bad.example.com:80", "", ErrInvalidHost},
+	}
+	for _, tt := range tests {
+		got, err := ParseEndpoint(tt.in)
+		if got != tt.want || err != tt.err { t.Errorf("ParseEndpoint(%q) = %q, %v; want %q, %v", tt.in, got, err, tt.want, tt.err) }
+	}
+}
+
+func FuzzParseEndpoint(f *testing.F) {
+	for _, s := range []string{
+		"203.0.113.5:51820",
+		"[2001:db8::1]:51820",
+		"[::ffff:1.2.3.4]:1",
+		"vpn.example.com:65535",
+		"vpn.example.com.:80",
+		"[fe80::1%eth0]:80",
+		"1.2.3.4:080",
+		"a:1",
+		":80",
+		"[]:80",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		out, err := ParseEndpoint(s)
+		if err != nil { return }
+		// The canonical form parses to itself.
+		again, err := ParseEndpoint(out)
+		if err != nil || again != out { t.Fatalf("ParseEndpoint(%q) = %q, which re-parses as %q, %v", s, out, again, err) }
+		host, _, err := net.SplitHostPort(out)
+		if err != nil { t.Fatalf("ParseEndpoint(%q) = %q: %v", s, out, err) }
+		if !strings.Contains(host, ":") && net.ParseIP(host) == nil && !ValidHostname(host) { t.Fatalf("ParseEndpoint(%q) = %q with invalid host", s, out) }
+	})
+}
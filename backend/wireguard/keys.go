@@ -0,0 +1,68 @@
+// Package wireguard parses, validates and generates WireGuard key material
+// and peer parameters.
+package wireguard
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// KeyLen is the length in bytes of a Curve25519 key.
+const KeyLen = 32
+
+// Key is a raw Curve25519 public, private or preshared key.
+type Key [KeyLen]byte
+
+var ErrInvalidKey = errors.New("key must be 32 bytes encoded as base64 (44 characters)")
+
+// ParseKey decodes a base64-encoded WireGuard key as produced by `wg genkey`
+// and `wg pubkey`. The all-zero key is rejected because it is never a valid
+// Curve25519 public key.
+func ParseKey(s string) (Key, error) {
+	var k Key
+	if len(s) != base64.StdEncoding.EncodedLen(KeyLen) { return k, ErrInvalidKey }
+	b, err := base64.StdEncoding.Strict().DecodeString(s)
+	if err != nil || len(b) != KeyLen { return k, ErrInvalidKey }
+	copy(k[:], b)
+	if k.IsZero() { return k, fmt.Errorf("%w: all-zero key", ErrInvalidKey) }
+	return k, nil
+}
+
+// String returns the base64 encoding used in WireGuard configuration files.
+func (k Key) String() string { return base64.StdEncoding.EncodeToString(k[:]) }
+
+// IsZero reports whether every byte of the key is zero.
+func (k Key) IsZero() bool {
+	var acc byte
+	for _, b := range k { acc |= b }
+	return acc == 0
+}
+
+// GenerateKeyPair returns a new clamped Curve25519 private key and its
+// public key, equivalent to `wg genkey | tee priv | wg pubkey`.
+func GenerateKeyPair() (priv, pub Key, err error) {
+	if _, err = rand.Read(priv[:]); err != nil { return priv, pub, fmt.Errorf("generate private key: %w", err) }
+	priv[0] &= 248
+	priv[31] = (priv[31] & 127) | 64
+	pub, err = PublicKey(priv)
+	return priv, pub, err
+}
+
+// PublicKey derives the public key for a private key.
+func PublicKey(priv Key) (Key, error) {
+	var pub Key
+	sk, err := ecdh.X25519().NewPrivateKey(priv[:])
+	if err != nil { return pub, err }
+	copy(pub[:], sk.PublicKey().Bytes())
+	return pub, nil
+}
+
+// GeneratePresharedKey returns 32 random bytes, equivalent to `wg genpsk`.
+func GeneratePresharedKey() (Key, error) {
+	var k Key
+	_, err := rand.Read(k[:])
+	return k, err
+}
@@ -0,0 +1,34 @@
+package wireguard
+
+import "testing"
+
+func FuzzParseKey(f *testing.F) {
+	for _, s := range []string{
+		"yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		"HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=",
+		"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+		"yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk",
+		"yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBml=",
+		"yAnz5TF-lXXJte14tji3zlMNq_hd2rYUIgJBgB3fBmk=",
+		"",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		k, err := ParseKey(s)
+		if err != nil { return }
+		if k.IsZero() { t.Fatalf("ParseKey(%q) accepted the zero key", s) }
+		// Strict decoding leaves one encoding per key.
+		if k.String() != s { t.Fatalf("ParseKey(%q).String() = %q", s, k.String()) }
+		k2, err := ParseKey(k.String())
+		if err != nil || k2 != k { t.Fatalf("ParseKey(%q) round trip = %v, %v", k.String(), k2, err) }
+	})
+}
+
+func TestGeneratedKeysParse(t *testing.T) {
+	priv, pub, err := GenerateKeyPair()
+	if err != nil { t.Fatal(err) }
+	for _, k := range []Key{priv, pub} {
+		if got, err := ParseKey(k.String()); err != nil || got != k { t.Errorf("ParseKey(%s) = %v, %v", k, got, err) }
+	}
+}
@@ -2,7 +2,7 @@ import { Toaster } from "@/components/ui/toaster";
 import { Toaster as Sonner } from "@/components/ui/sonner";
 import { TooltipProvider } from "@/components/ui/tooltip";
 import { QueryClient, QueryClientProvider } from "@tanstack/react-query";
-import { BrowserRouter, Routes, Route, Navigate } from "react-router-dom";
+import { BrowserRouter, Routes, Route, Navigate, useLocation, useSearchParams } from "react-router-dom";
 import { AuthProvider, useAuth } from "@/hooks/useAuth";
 import { ErrorBoundary } from "@/components/ErrorBoundary";
 import { lazy, Suspense } from "react";
@@ -11,6 +11,7 @@ const Index = lazy(() => import("./pages/Index"));
 const AuthPage = lazy(() => import("./pages/Auth"));
 const ResetPasswordPage = lazy(() => import("./pages/ResetPassword"));
 const JoinViaLinkPage = lazy(() => import("./pages/JoinViaLink"));
+const AcceptInvitationPage = lazy(() => import("./pages/AcceptInvitation"));
 const NotFound = lazy(() => import("./pages/NotFound"));
 
 const queryClient = new QueryClient({
@@ -30,17 +31,28 @@ function LoadingFallback() {
   );
 }
 
+// safeRedirect only follows paths within the app, never another origin.
+function safeRedirect(redirect: string | null) {
+  if (!redirect || !redirect.startsWith("/") || redirect.startsWith("//")) return "/";
+  return redirect;
+}
+
 function ProtectedRoute({ children }: { children: React.ReactNode }) {
   const { user, loading } = useAuth();
+  const location = useLocation();
   if (loading) return <LoadingFallback />;
-  if (!user) return <Navigate to="/auth" replace />;
+  if (!user) {
+    const from = location.pathname + location.search;
+    return <Navigate to={from === "/" ? "/auth" : `/auth?redirect=${encodeURIComponent(from)}`} replace />;
+  }
   return <>{children}</>;
 }
 
 function AuthRoute({ children }: { children: React.ReactNode }) {
   const { user, loading } = useAuth();
+  const [params] = useSearchParams();
   if (loading) return null;
-  if (user) return <Navigate to="/" replace />;
+  if (user) return <Navigate to={safeRedirect(params.get("redirect"))} replace />;
   return <>{children}</>;
 }
 
@@ -51,6 +63,7 @@ const AppRoutes = () => (
         <Route path="/auth" element={<AuthRoute><AuthPage /></AuthRoute>} />
         <Route path="/reset-password" element={<ResetPasswordPage />} />
         <Route path="/join/:token" element={<ProtectedRoute><JoinViaLinkPage /></ProtectedRoute>} />
+        <Route path="/invite/:token" element={<ProtectedRoute><AcceptInvitationPage /></ProtectedRoute>} />
         <Route path="/" element={<ProtectedRoute><Index /></ProtectedRoute>} />
         <Route path="*" element={<NotFound />} />
       </Routes>
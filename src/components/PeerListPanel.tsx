@@ -121,7 +121,9 @@ export function PeerListPanel({ networkId, peers, onRefresh, isOwner }: PeerList
                 className="p-3 rounded-md bg-muted border border-border text-xs font-mono"
               >
                 <div className="flex items-center justify-between mb-1">
-                  <span className="text-primary">{peer.virtual_ip}</span>
+                  <span className="text-primary">
+                    {peer.hostname ? `${peer.hostname} · ${peer.virtual_ip}` : peer.virtual_ip}
+                  </span>
                   <div className="flex items-center gap-2">
                     <StatusDot status={status} />
                     {isOwner && (
@@ -150,6 +152,15 @@ export function PeerListPanel({ networkId, peers, onRefresh, isOwner }: PeerList
                 <div className="text-muted-foreground truncate">
                   pubkey: {peer.public_key.slice(0, 20)}...
                 </div>
+                {peer.tags && peer.tags.length > 0 && (
+                  <div className="mt-1 flex flex-wrap gap-1">
+                    {peer.tags.map((tag) => (
+                      <span key={tag} className="px-1.5 py-0.5 rounded bg-background border border-border text-muted-foreground">
+                        {tag}
+                      </span>
+                    ))}
+                  </div>
+                )}
               </div>
             );
           })}
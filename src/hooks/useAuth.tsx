@@ -12,11 +12,17 @@ export interface AuthSession {
   user: AuthUser;
 }
 
+// SignUpResult reports whether an invite_token sent with sign-up was accepted.
+export interface SignUpResult {
+  network_id?: string;
+  invitation_error?: string;
+}
+
 interface AuthContextType {
   user: AuthUser | null;
   session: AuthSession | null;
   loading: boolean;
-  signUp: (email: string, password: string) => Promise<void>;
+  signUp: (email: string, password: string, inviteToken?: string) => Promise<SignUpResult>;
   signIn: (email: string, password: string) => Promise<void>;
   signOut: () => Promise<void>;
 }
@@ -54,11 +60,11 @@ export function AuthProvider({ children }: { children: ReactNode }) {
     setLoading(false);
   }, []);
 
-  const signUp = async (email: string, password: string) => {
+  const signUp = async (email: string, password: string, inviteToken?: string) => {
     const res = await fetch(API_BASE + "/api/auth/signup", {
       method: "POST",
       headers: { "Content-Type": "application/json" },
-      body: JSON.stringify({ email, password }),
+      body: JSON.stringify(inviteToken ? { email, password, invite_token: inviteToken } : { email, password }),
     });
     const data = await res.json();
     if (!res.ok) throw new Error(data.error || "Sign up failed");
@@ -66,6 +72,7 @@ export function AuthProvider({ children }: { children: ReactNode }) {
     saveSession(data.token, u);
     setUser(u);
     setSession({ access_token: data.token, user: u });
+    return { network_id: data.network_id, invitation_error: data.invitation_error };
   };
 
   const signIn = async (email: string, password: string) => {
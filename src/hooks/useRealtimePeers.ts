@@ -1,5 +1,5 @@
 import { useEffect, useRef } from "react";
-import { getPeers, type Peer } from "@/lib/api";
+import { applyPeerDelta, getPeers, type Peer, type PeerDelta } from "@/lib/api";
 
 const API_BASE = import.meta.env.VITE_API_URL || "";
 
@@ -16,26 +16,42 @@ export function useRealtimePeers({ networkId, enabled, onUpdate }: UseRealtimePe
   useEffect(() => {
     if (!enabled || !networkId) return;
 
-    // Initial fetch
-    getPeers(networkId).then((peers) => onUpdateRef.current(peers)).catch(() => {});
-
     const token = localStorage.getItem("wgctrl_token");
-    if (!token) return;
+    if (!token) {
+      getPeers(networkId).then((peers) => onUpdateRef.current(peers)).catch(() => {});
+      return;
+    }
 
     let controller: AbortController | null = new AbortController();
     let retryTimeout: ReturnType<typeof setTimeout> | null = null;
+    let current: Peer[] = [];
+    let lastEventId: string | null = null;
+
+    const refetch = () =>
+      getPeers(networkId)
+        .then((peers) => {
+          current = peers;
+          onUpdateRef.current(peers);
+        })
+        .catch(() => {});
 
     const connectSSE = async () => {
       if (!controller || controller.signal.aborted) return;
       try {
-        const resp = await fetch(API_BASE + "/api/sse/peers?network_id=" + encodeURIComponent(networkId), {
-          headers: { Authorization: "Bearer " + token },
-          signal: controller.signal,
-        });
-        if (!resp.body) return;
+        // The first connection asks for a snapshot; reconnects resume from
+        // the last event seen and the server replays what was missed.
+        const headers: Record<string, string> = { Authorization: "Bearer " + token };
+        let url = API_BASE + "/api/sse/peers?network_id=" + encodeURIComponent(networkId);
+        if (lastEventId) headers["Last-Event-ID"] = lastEventId;
+        else url += "&snapshot=1";
+        const resp = await fetch(url, { headers, signal: controller.signal });
+        // Not (or no longer) allowed to watch this network: stop retrying.
+        if (resp.status === 401 || resp.status === 403) return;
+        if (!resp.ok || !resp.body) throw new Error("SSE connect failed: " + resp.status);
         const reader = resp.body.getReader();
         const decoder = new TextDecoder();
         let buf = "";
+        let retryIn: number | null = 5000;
         while (true) {
           const { done, value } = await reader.read();
           if (done) break;
@@ -43,11 +59,41 @@ export function useRealtimePeers({ networkId, enabled, onUpdate }: UseRealtimePe
           const parts = buf.split("\n\n");
           buf = parts.pop() || "";
           for (const part of parts) {
-            if (part.includes("data:") && !part.includes("connected")) {
-              getPeers(networkId).then((peers) => onUpdateRef.current(peers)).catch(() => {});
+            const lines = part.split("\n");
+            const idLine = lines.find((l) => l.startsWith("id:"));
+            if (idLine) lastEventId = idLine.slice(3).trim();
+            const line = lines.find((l) => l.startsWith("data:"));
+            if (!line) continue;
+            let evt: { type: string; payload: any };
+            try {
+              evt = JSON.parse(line.slice(5));
+            } catch {
+              continue;
+            }
+            if (evt.type === "revoked") {
+              // Signed out, removed from the network or token expired.
+              retryIn = null;
+              continue;
+            } else if (evt.type === "reconnect") {
+              // Dropped for falling behind; resume from lastEventId right away.
+              retryIn = 1000;
+              continue;
+            } else if (evt.type === "reset") {
+              // Too much was missed to replay; start over from the full list.
+              refetch();
+              continue;
+            } else if (evt.type === "snapshot") {
+              current = evt.payload.peers;
+            } else if (evt.payload && Array.isArray(evt.payload.added)) {
+              current = applyPeerDelta(current, evt.payload as PeerDelta);
+            } else {
+              // Every peer event carries a delta; anything else is not ours.
+              continue;
             }
+            onUpdateRef.current(current);
           }
         }
+        if (retryIn !== null && controller && !controller.signal.aborted) retryTimeout = setTimeout(connectSSE, retryIn);
       } catch (err: any) {
         if (err && err.name !== "AbortError" && controller && !controller.signal.aborted) {
           retryTimeout = setTimeout(connectSSE, 5000);
@@ -7,12 +7,20 @@ export interface Peer {
   endpoint: string;
   last_seen?: string;
   network_id?: string;
+  quarantined?: boolean;
+  hostname?: string;
+  description?: string;
+  tags?: string[];
+  routes?: string[];
+  exit_node?: "none" | "offered" | "approved";
+  exit_node_id?: string | null;
 }
 
 export interface NetworkInfo {
   id: string;
   name: string | null;
   description: string | null;
+  cidr?: string;
   created_at: string;
 }
 
@@ -86,6 +94,27 @@ export async function joinNetwork(network_id: string, public_key: string, endpoi
   return req("/peers/join", { method: "POST", body: JSON.stringify({ network_id, public_key, endpoint }) });
 }
 
+/** Payload of peers-topic SSE events; see DOCUMENTATION.md. */
+export interface PeerDelta {
+  version: number;
+  added: Peer[];
+  updated: Peer[];
+  removed: string[];
+}
+
+/** Applies a delta to a peer list, keeping the order of existing peers. */
+export function applyPeerDelta(peers: Peer[], delta: PeerDelta): Peer[] {
+  const removed = new Set(delta.removed);
+  const updated = new Map(delta.updated.map((p) => [p.id, p]));
+  const next = peers
+    .filter((p) => !p.id || !removed.has(p.id))
+    .map((p) => (p.id && updated.has(p.id) ? updated.get(p.id)! : p));
+  for (const p of delta.added) {
+    if (!next.some((q) => q.id === p.id)) next.push(p);
+  }
+  return next;
+}
+
 export async function getPeers(network_id: string): Promise<Peer[]> {
   const data = await req<{ peers: Peer[] }>("/peers?network_id=" + encodeURIComponent(network_id));
   return data.peers || [];
@@ -139,15 +168,24 @@ export async function acceptInvitation(invitation_id: string, action: "accept" |
   return req("/invitations/accept", { method: "POST", body: JSON.stringify({ invitation_id, action }) });
 }
 
+export async function acceptInvitationToken(token: string): Promise<{ network_id: string }> {
+  return req("/invitations/accept-token", { method: "POST", body: JSON.stringify({ token }) });
+}
+
 export async function createInvitation(network_id: string, invited_email: string): Promise<any> {
   return req("/invitations", { method: "POST", body: JSON.stringify({ network_id, invited_email }) });
 }
 
 export function generateWireGuardConfig(privateKey: string, virtualIp: string, peers: Peer[]): string {
   let config = `[Interface]\nPrivateKey = ${privateKey}\nAddress = ${virtualIp}/24\n`;
+  const self = peers.find((p) => p.virtual_ip === virtualIp);
   for (const peer of peers) {
-    if (peer.virtual_ip === virtualIp) continue;
-    config += `\n[Peer]\nPublicKey = ${peer.public_key}\nEndpoint = ${peer.endpoint}\nAllowedIPs = ${peer.virtual_ip}/32\nPersistentKeepalive = 25\n`;
+    if (peer.virtual_ip === virtualIp || peer.quarantined) continue;
+    const allowed =
+      peer.id && peer.id === self?.exit_node_id && peer.exit_node === "approved"
+        ? ["0.0.0.0/0", "::/0"]
+        : [`${peer.virtual_ip}/32`, ...(peer.routes ?? [])];
+    config += `\n[Peer]\nPublicKey = ${peer.public_key}\nEndpoint = ${peer.endpoint}\nAllowedIPs = ${allowed.join(", ")}\nPersistentKeepalive = 25\n`;
   }
   return config;
 }
@@ -1,11 +1,15 @@
 import { useState } from "react";
 import { Shield, LogIn, UserPlus, Loader2, KeyRound } from "lucide-react";
+import { useSearchParams } from "react-router-dom";
 import { useAuth } from "@/hooks/useAuth";
 
 const API_BASE = import.meta.env.VITE_API_URL || "";
 
 export default function AuthPage() {
   const { signIn, signUp } = useAuth();
+  const [params] = useSearchParams();
+  // Arriving from an invitation link, sign-up accepts the invitation too.
+  const inviteToken = params.get("redirect")?.match(/^\/invite\/([^/?#]+)/)?.[1];
   const [isSignUp, setIsSignUp] = useState(false);
   const [forgotPassword, setForgotPassword] = useState(false);
   const [email, setEmail] = useState("");
@@ -42,7 +46,7 @@ export default function AuthPage() {
     setError(null);
     try {
       if (isSignUp) {
-        await signUp(email.trim(), password);
+        await signUp(email.trim(), password, inviteToken);
       } else {
         await signIn(email.trim(), password);
       }
@@ -75,6 +79,12 @@ export default function AuthPage() {
             {icon} {title}
           </h2>
 
+          {inviteToken && !resetSent && (
+            <p className="text-xs text-muted-foreground mb-4">
+              Sign in or create an account with the invited email to accept the invitation.
+            </p>
+          )}
+
           {resetSent ? (
             <div className="text-center py-4">
               <p className="text-sm text-foreground mb-2">Check your email</p>
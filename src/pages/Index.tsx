@@ -86,7 +86,7 @@ const Index = () => {
           <div className="flex items-center gap-4 mt-6 mb-8 text-xs text-muted-foreground font-mono flex-wrap">
             <div className="flex items-center gap-2">
               <Terminal className="h-3 w-3" />
-              <span>subnet: 10.10.0.0/24</span>
+              <span>subnet: {networks.find((n) => n.id === activeNetwork)?.cidr ?? "10.10.0.0/24"}</span>
             </div>
             <span className="text-border">|</span>
             <div className="flex items-center gap-2">